@@ -0,0 +1,109 @@
+package viewproxy
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+// SetCacheControl replaces the response's Cache-Control header with one
+// combined from every successful result, unless Cache-Control is ignored.
+func (rb *responseBuilder) SetCacheControl(results []*multiplexer.Result) {
+	if rb.isIgnoredHeader("Cache-Control") {
+		return
+	}
+
+	var values []string
+	for _, result := range results {
+		if result.Err == nil {
+			values = append(values, strings.Join(result.Header().Values("Cache-Control"), ", "))
+		}
+	}
+
+	rb.writer.Header().Set("Cache-Control", combineCacheControl(values))
+}
+
+// combineCacheControl returns a Cache-Control value that is no more cacheable
+// than any of values. An empty value is treated as no-store, and a value
+// without max-age as max-age=0.
+func combineCacheControl(values []string) string {
+	if len(values) == 0 {
+		return "no-store"
+	}
+
+	public := true
+	private, noCache, mustRevalidate := false, false, false
+	maxAge := -1
+
+	for _, value := range values {
+		directives := parseCacheControl(value)
+		if len(directives) == 0 {
+			return "no-store"
+		}
+
+		if _, ok := directives["no-store"]; ok {
+			return "no-store"
+		}
+
+		_, isPublic := directives["public"]
+		_, isPrivate := directives["private"]
+		_, isNoCache := directives["no-cache"]
+		_, isMustRevalidate := directives["must-revalidate"]
+
+		public = public && isPublic
+		private = private || isPrivate
+		noCache = noCache || isNoCache
+		mustRevalidate = mustRevalidate || isMustRevalidate
+
+		age, err := strconv.Atoi(directives["max-age"])
+		if err != nil || age < 0 {
+			age = 0
+		}
+
+		if maxAge == -1 || age < maxAge {
+			maxAge = age
+		}
+	}
+
+	var combined []string
+	if private {
+		combined = append(combined, "private")
+	} else if public {
+		combined = append(combined, "public")
+	}
+
+	if noCache {
+		combined = append(combined, "no-cache")
+	}
+
+	combined = append(combined, "max-age="+strconv.Itoa(maxAge))
+
+	if mustRevalidate {
+		combined = append(combined, "must-revalidate")
+	}
+
+	return strings.Join(combined, ", ")
+}
+
+// parseCacheControl returns the directives in a Cache-Control value, keyed by
+// their lowercased name, with any unquoted argument as the value.
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+
+	for _, directive := range strings.Split(value, ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			continue
+		}
+
+		name, argument := directive, ""
+		if i := strings.Index(directive, "="); i != -1 {
+			name, argument = directive[:i], strings.Trim(directive[i+1:], `"`)
+		}
+
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(argument)
+	}
+
+	return directives
+}
@@ -0,0 +1,78 @@
+package viewproxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCombineCacheControl(t *testing.T) {
+	tests := map[string]struct {
+		values []string
+		want   string
+	}{
+		"public":          {values: []string{"public, max-age=300", "public, max-age=60"}, want: "public, max-age=60"},
+		"private":         {values: []string{"public, max-age=300", "private, max-age=600"}, want: "private, max-age=300"},
+		"no-store":        {values: []string{"public, max-age=300", "no-store"}, want: "no-store"},
+		"missing":         {values: []string{"public, max-age=300", ""}, want: "no-store"},
+		"no max-age":      {values: []string{"public, max-age=300", "public"}, want: "public, max-age=0"},
+		"no-cache":        {values: []string{"max-age=300", "No-Cache, must-revalidate"}, want: "no-cache, max-age=0, must-revalidate"},
+		"mixed public":    {values: []string{"public, max-age=300", "max-age=60"}, want: "max-age=60"},
+		"quoted argument": {values: []string{`max-age="120"`}, want: "max-age=120"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, combineCacheControl(tc.values))
+		})
+	}
+}
+
+func TestCombineCacheControlResponses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		case "/header":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/footer":
+			w.Header().Set("Cache-Control", "public, max-age=600")
+		case "/account":
+			w.Header().Set("Cache-Control", "no-store")
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		combine   bool
+		fragments []*Fragment
+		want      string
+	}{
+		"disabled": {fragments: []*Fragment{NewFragment("/header"), NewFragment("/account")}, want: "public, max-age=3600"},
+		"max-age":  {combine: true, fragments: []*Fragment{NewFragment("/header"), NewFragment("/footer")}, want: "public, max-age=60"},
+		"no-store": {combine: true, fragments: []*Fragment{NewFragment("/header"), NewFragment("/account")}, want: "no-store"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.CombineCacheControl = tc.combine
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), tc.fragments)
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, tc.want, resp.Header.Get("Cache-Control"))
+		})
+	}
+}
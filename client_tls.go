@@ -0,0 +1,133 @@
+package viewproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TLSClientConfig configures the certificates viewproxy presents when
+// fetching fragments from targets that require mutual TLS.
+type TLSClientConfig struct {
+	// Path to the PEM encoded client certificate.
+	CertFile string
+	// Path to the PEM encoded private key for the client certificate.
+	KeyFile string
+	// Path to a PEM encoded bundle of CA certificates used to verify the
+	// target. The system roots are used when empty.
+	CAFile string
+}
+
+func (c TLSClientConfig) build() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{certificate}}
+
+	if c.CAFile != "" {
+		caPem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// hostTransport routes requests to a transport configured for the request's
+// host, falling back to a default transport for all other hosts. Hosts are
+// stored with their port, see normalizeTLSHost.
+type hostTransport struct {
+	fallback http.RoundTripper
+	hosts    map[string]http.RoundTripper
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if transport, ok := t.hosts[normalizeTLSHost(req.URL.Host, req.URL.Scheme)]; ok {
+		return transport.RoundTrip(req)
+	}
+
+	return t.fallback.RoundTrip(req)
+}
+
+// normalizeTLSHost lowercases host and adds the default port for scheme when
+// it doesn't have one, so `example.com` and `example.com:443` are the same
+// https host.
+func normalizeTLSHost(host string, scheme string) string {
+	host = strings.ToLower(host)
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+
+	port := "443"
+	if scheme == "http" {
+		port = "80"
+	}
+
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// ConfigureClientTLS configures the transport used to fetch fragments and
+// proxy requests to present a client certificate to every target.
+func (s *Server) ConfigureClientTLS(config TLSClientConfig) error {
+	return s.ConfigureClientTLSForHost("", config)
+}
+
+// ConfigureClientTLSForHost configures a client certificate that is only
+// presented to the given host (e.g. `internal.example.com:443`), allowing
+// different certificates for each target. Hosts without a port use 443. Other
+// hosts continue to use the existing transport, whose settings, like a DNS
+// cache, are kept for the host's transport. An error is returned when
+// HttpTransport isn't an *http.Transport.
+func (s *Server) ConfigureClientTLSForHost(host string, config TLSClientConfig) error {
+	tlsConfig, err := config.build()
+	if err != nil {
+		return err
+	}
+
+	hosts, ok := s.HttpTransport.(*hostTransport)
+	if !ok {
+		hosts = &hostTransport{fallback: s.HttpTransport, hosts: make(map[string]http.RoundTripper)}
+	}
+
+	base, ok := hosts.fallback.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("can't configure client TLS for HttpTransport %T, it must be an *http.Transport", hosts.fallback)
+	}
+
+	// Keep the existing TLS settings, like RootCAs or MinVersion, unless
+	// config replaces them.
+	if base.TLSClientConfig != nil {
+		merged := base.TLSClientConfig.Clone()
+		merged.Certificates = tlsConfig.Certificates
+		if tlsConfig.RootCAs != nil {
+			merged.RootCAs = tlsConfig.RootCAs
+		}
+		tlsConfig = merged
+	}
+
+	transport := base.Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	if host == "" {
+		hosts.fallback = transport
+	} else {
+		hosts.hosts[normalizeTLSHost(host, "https")] = transport
+	}
+	s.HttpTransport = hosts
+
+	return nil
+}
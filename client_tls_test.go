@@ -0,0 +1,226 @@
+package viewproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "viewproxy-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	caCert, caKey := generateCertificate(t, nil, nil)
+	clientCert, clientKey := generateCertificate(t, caCert, caKey)
+
+	clientPool := x509.NewCertPool()
+	clientPool.AddCert(caCert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello " + r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientPool}
+	server.StartTLS()
+	defer server.Close()
+
+	serverUrl, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+
+	config := TLSClientConfig{
+		CertFile: writePem(t, dir, "client.pem", "CERTIFICATE", clientCert.Raw),
+		KeyFile:  writePem(t, dir, "client-key.pem", "EC PRIVATE KEY", marshalKey(t, clientKey)),
+		CAFile:   writePem(t, dir, "ca.pem", "CERTIFICATE", server.Certificate().Raw),
+	}
+
+	tests := map[string]struct {
+		configure    func(*Server) error
+		expectedCode int
+		expectedBody string
+	}{
+		"without client certificate": {
+			configure:    func(s *Server) error { return nil },
+			expectedCode: http.StatusBadGateway,
+			expectedBody: "502 bad gateway",
+		},
+		"default client certificate": {
+			configure:    func(s *Server) error { return s.ConfigureClientTLS(config) },
+			expectedCode: http.StatusOK,
+			expectedBody: "hello viewproxy client",
+		},
+		"per host client certificate": {
+			configure:    func(s *Server) error { return s.ConfigureClientTLSForHost(serverUrl.Host, config) },
+			expectedCode: http.StatusOK,
+			expectedBody: "hello viewproxy client",
+		},
+		"client certificate for another host": {
+			configure:    func(s *Server) error { return s.ConfigureClientTLSForHost("example.com:443", config) },
+			expectedCode: http.StatusBadGateway,
+			expectedBody: "502 bad gateway",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{})
+			assert.Nil(t, tc.configure(viewProxyServer))
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.expectedCode, resp.StatusCode)
+			assert.Equal(t, tc.expectedBody, string(body))
+		})
+	}
+}
+
+func TestClientTLSMissingFiles(t *testing.T) {
+	viewProxyServer := NewServer("https://localhost")
+	err := viewProxyServer.ConfigureClientTLS(TLSClientConfig{CertFile: "missing.pem", KeyFile: "missing-key.pem"})
+
+	assert.Error(t, err)
+	assert.Same(t, http.DefaultTransport, viewProxyServer.HttpTransport)
+}
+
+func TestClientTLSHostsUseDefaultPorts(t *testing.T) {
+	tests := map[string]struct {
+		registered string
+		requestUrl string
+		want       bool
+	}{
+		"same host and port":        {registered: "example.com:443", requestUrl: "https://example.com:443/layout", want: true},
+		"registered with port":      {registered: "example.com:443", requestUrl: "https://example.com/layout", want: true},
+		"requested with port":       {registered: "example.com", requestUrl: "https://example.com:443/layout", want: true},
+		"neither has a port":        {registered: "example.com", requestUrl: "https://EXAMPLE.com/layout", want: true},
+		"other port":                {registered: "example.com", requestUrl: "https://example.com:8443/layout", want: false},
+		"http default port":         {registered: "example.com:80", requestUrl: "http://example.com/layout", want: true},
+		"http isn't the https port": {registered: "example.com", requestUrl: "http://example.com/layout", want: false},
+		"ipv6":                      {registered: "[::1]", requestUrl: "https://[::1]/layout", want: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var used string
+			transports := &hostTransport{
+				fallback: roundTripperFunc(func(*http.Request) (*http.Response, error) { used = "fallback"; return nil, nil }),
+				hosts: map[string]http.RoundTripper{
+					normalizeTLSHost(tc.registered, "https"): roundTripperFunc(func(*http.Request) (*http.Response, error) { used = "host"; return nil, nil }),
+				},
+			}
+
+			_, err := transports.RoundTrip(httptest.NewRequest("GET", tc.requestUrl, nil))
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.want, used == "host")
+		})
+	}
+}
+
+func TestClientTLSKeepsExistingTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "viewproxy-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	caCert, caKey := generateCertificate(t, nil, nil)
+	clientCert, clientKey := generateCertificate(t, caCert, caKey)
+	config := TLSClientConfig{
+		CertFile: writePem(t, dir, "client.pem", "CERTIFICATE", clientCert.Raw),
+		KeyFile:  writePem(t, dir, "client-key.pem", "EC PRIVATE KEY", marshalKey(t, clientKey)),
+	}
+
+	viewProxyServer := NewServer("https://example.com")
+	viewProxyServer.ConfigureDNSCache(time.Minute)
+	viewProxyServer.HttpTransport.(*http.Transport).TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS13}
+	assert.Nil(t, viewProxyServer.ConfigureClientTLSForHost("example.com", config))
+
+	transports := viewProxyServer.HttpTransport.(*hostTransport)
+	transport := transports.hosts["example.com:443"].(*http.Transport)
+	assert.NotNil(t, transport.DialContext, "Expected the DNS cache dialer to be kept")
+	assert.Equal(t, uint16(tls.VersionTLS13), transport.TLSClientConfig.MinVersion)
+	assert.Len(t, transport.TLSClientConfig.Certificates, 1)
+	assert.Empty(t, transports.fallback.(*http.Transport).TLSClientConfig.Certificates)
+
+	viewProxyServer.HttpTransport = roundTripperFunc(func(*http.Request) (*http.Response, error) { return nil, nil })
+	assert.EqualError(t, viewProxyServer.ConfigureClientTLS(config), "can't configure client TLS for HttpTransport viewproxy.roundTripperFunc, it must be an *http.Transport")
+}
+
+// generateCertificate generates a CA certificate when parent is nil, otherwise
+// it generates a certificate for 127.0.0.1 signed by the parent that can be
+// used by clients and servers.
+func generateCertificate(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "viewproxy client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	if parent == nil {
+		template.Subject = pkix.Name{CommonName: "viewproxy ca"}
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+
+	certificate, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return certificate, key
+}
+
+func marshalKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	return der
+}
+
+func writePem(t *testing.T, dir string, name string, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	assert.Nil(t, err)
+
+	return path
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -15,7 +15,7 @@ func main() {
 	server := viewproxy.NewServer(target)
 	server.Port = getPort()
 	server.ProxyTimeout = time.Duration(5) * time.Second
-	server.Logger = buildLogger()
+	server.Logger = viewproxy.NewStdLogger(buildLogger())
 	server.DefaultPageTitle = "Demo app"
 	server.IgnoreHeader("etag")
 	server.PassThrough = true
@@ -7,6 +7,8 @@ import (
 )
 
 type configRouteEntry struct {
+	Name      string      `json:"name"`
+	Method    string      `json:"method"`
 	Url       string      `json:"url"`
 	Layout    *Fragment   `json:"layout"`
 	Fragments []*Fragment `json:"fragments"`
@@ -0,0 +1,45 @@
+package viewproxy
+
+import "context"
+
+type routeContextKey struct{}
+
+// routeMatch holds the route matched for a request. It's stored in the
+// request context before middleware runs and filled in once the route is
+// matched, so server middleware can read it after calling the next handler.
+type routeMatch struct {
+	route      *Route
+	parameters map[string]string
+}
+
+// withRouteMatch returns ctx with a routeMatch, reusing the one already in ctx
+// when there is one.
+func withRouteMatch(ctx context.Context) (context.Context, *routeMatch) {
+	if match, ok := ctx.Value(routeContextKey{}).(*routeMatch); ok {
+		return ctx, match
+	}
+
+	match := &routeMatch{}
+	return context.WithValue(ctx, routeContextKey{}, match), match
+}
+
+// RouteFromContext returns the route matched for the request ctx belongs to,
+// or nil when no route matched. Middleware added with Server.Use runs before
+// routes are matched, so it should call this after calling the next handler.
+func RouteFromContext(ctx context.Context) *Route {
+	if match, ok := ctx.Value(routeContextKey{}).(*routeMatch); ok {
+		return match.route
+	}
+
+	return nil
+}
+
+// ParamsFromContext returns the parameters extracted from the path of the
+// request ctx belongs to, or nil when no route matched.
+func ParamsFromContext(ctx context.Context) map[string]string {
+	if match, ok := ctx.Value(routeContextKey{}).(*routeMatch); ok {
+		return match.parameters
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package viewproxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteAndParamsFromContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	seen := make(map[string]string)
+	record := func(name string, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if route := RouteFromContext(r.Context()); route != nil {
+			seen[name] = strings.Join(route.Parts, "/") + " " + ParamsFromContext(r.Context())["name"]
+		} else {
+			seen[name] = "none"
+		}
+	}
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			record("server middleware before", r)
+			next.ServeHTTP(w, r)
+			record("server middleware after", r)
+		})
+	})
+	viewProxyServer.BeforeFragment = func(req *http.Request, fragment *Fragment, parameters map[string]string) {
+		record("before fragment", req)
+	}
+	viewProxyServer.GetWithOptions("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/fragment")}, RouteOptions{
+		Middleware: []func(http.Handler) http.Handler{
+			func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					record("route middleware", r)
+					next.ServeHTTP(w, r)
+				})
+			},
+		},
+	})
+
+	w := httptest.NewRecorder()
+	viewProxyServer.handler().ServeHTTP(w, httptest.NewRequest("GET", "/hello/world", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, map[string]string{
+		"server middleware before": "none",
+		"server middleware after":  "/hello/:name world",
+		"route middleware":         "/hello/:name world",
+		"before fragment":          "/hello/:name world",
+	}, seen)
+
+	w = httptest.NewRecorder()
+	viewProxyServer.handler().ServeHTTP(w, httptest.NewRequest("GET", "/missing", nil))
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "none", seen["server middleware after"])
+}
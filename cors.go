@@ -0,0 +1,89 @@
+package viewproxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig configures the CORS middleware.
+type CORSConfig struct {
+	// The origins allowed to make cross-origin requests, or `*` for any.
+	AllowedOrigins []string
+	// The methods allowed in preflight requests. Defaults to GET, HEAD, and
+	// POST when empty.
+	AllowedMethods []string
+	// The request headers allowed in preflight requests.
+	AllowedHeaders []string
+	// Allow cookies and credentials on cross-origin requests. Since browsers
+	// reject a `*` origin with credentials, the request's origin is echoed
+	// back instead.
+	AllowCredentials bool
+	// How long browsers may cache preflight responses. Omitted when zero.
+	MaxAge time.Duration
+}
+
+// CORS returns middleware that answers preflight `OPTIONS` requests from
+// allowed origins directly and adds `Access-Control-*` headers to other
+// requests from allowed origins.
+func CORS(config CORSConfig) func(http.Handler) http.Handler {
+	methods := config.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Origin")
+
+			allowOrigin := config.allowOrigin(origin)
+			if allowOrigin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+			if config.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			if len(config.AllowedHeaders) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(config.AllowedHeaders, ", "))
+			}
+			if config.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(config.MaxAge.Seconds())))
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for origin, or an
+// empty string when the origin isn't allowed.
+func (c CORSConfig) allowOrigin(origin string) string {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" && !c.AllowCredentials {
+			return "*"
+		}
+
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+
+	return ""
+}
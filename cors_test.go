@@ -0,0 +1,114 @@
+package viewproxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORS(t *testing.T) {
+	tests := map[string]struct {
+		config          CORSConfig
+		method          string
+		origin          string
+		requestMethod   string
+		expectedCode    int
+		expectedHeaders map[string]string
+	}{
+		"preflight": {
+			config:        CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowedHeaders: []string{"X-Requested-With"}, MaxAge: 10 * time.Minute},
+			method:        "OPTIONS",
+			origin:        "https://app.example.com",
+			requestMethod: "GET",
+			expectedCode:  http.StatusNoContent,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Methods":     "GET, HEAD, POST",
+				"Access-Control-Allow-Headers":     "X-Requested-With",
+				"Access-Control-Max-Age":           "600",
+				"Access-Control-Allow-Credentials": "",
+				"Vary":                             "Origin",
+			},
+		},
+		"preflight disallowed origin": {
+			config:        CORSConfig{AllowedOrigins: []string{"https://app.example.com"}},
+			method:        "OPTIONS",
+			origin:        "https://evil.example.com",
+			requestMethod: "GET",
+			expectedCode:  http.StatusMethodNotAllowed,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin":  "",
+				"Access-Control-Allow-Methods": "",
+			},
+		},
+		"simple request": {
+			config:       CORSConfig{AllowedOrigins: []string{"https://app.example.com"}},
+			method:       "GET",
+			origin:       "https://app.example.com",
+			expectedCode: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin":  "https://app.example.com",
+				"Access-Control-Allow-Methods": "",
+			},
+		},
+		"wildcard": {
+			config:       CORSConfig{AllowedOrigins: []string{"*"}},
+			method:       "GET",
+			origin:       "https://app.example.com",
+			expectedCode: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "*",
+			},
+		},
+		"wildcard with credentials": {
+			config:       CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+			method:       "GET",
+			origin:       "https://app.example.com",
+			expectedCode: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		},
+		"same origin": {
+			config:       CORSConfig{AllowedOrigins: []string{"*"}},
+			method:       "GET",
+			expectedCode: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "",
+				"Vary":                        "",
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer(targetServer.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.Use(CORS(tc.config))
+			viewProxyServer.Get("/hello/:name", NewFragment("/layouts/test_layout"), []*Fragment{})
+
+			r := httptest.NewRequest(tc.method, "/hello/world", nil)
+			if tc.origin != "" {
+				r.Header.Set("Origin", tc.origin)
+			}
+			if tc.requestMethod != "" {
+				r.Header.Set("Access-Control-Request-Method", tc.requestMethod)
+			}
+			w := httptest.NewRecorder()
+
+			viewProxyServer.handler().ServeHTTP(w, r)
+
+			resp := w.Result()
+			assert.Equal(t, tc.expectedCode, resp.StatusCode)
+			for name, value := range tc.expectedHeaders {
+				assert.Equal(t, value, resp.Header.Get(name), name)
+			}
+		})
+	}
+}
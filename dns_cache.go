@@ -0,0 +1,119 @@
+package viewproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type hostResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type dnsCacheEntry struct {
+	addresses []net.IPAddr
+	expiresAt time.Time
+}
+
+// dnsCache resolves hosts for the transport's dialer, reusing resolved
+// addresses until the TTL expires so repeated connections to the target don't
+// each require a DNS lookup.
+type dnsCache struct {
+	resolver hostResolver
+	dialer   *net.Dialer
+	ttl      time.Duration
+	now      func() time.Time
+	mu       sync.Mutex
+	entries  map[string]dnsCacheEntry
+}
+
+func newDNSCache(resolver hostResolver, ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		resolver: resolver,
+		dialer:   &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		ttl:      ttl,
+		now:      time.Now,
+		entries:  make(map[string]dnsCacheEntry),
+	}
+}
+
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]net.IPAddr, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+
+	if ok && c.now().Before(entry.expiresAt) {
+		return entry.addresses, nil
+	}
+
+	addresses, err := c.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[host] = dnsCacheEntry{addresses: addresses, expiresAt: c.now().Add(c.ttl)}
+	c.mu.Unlock()
+
+	return addresses, nil
+}
+
+func (c *dnsCache) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if net.ParseIP(host) != nil {
+		return c.dialer.DialContext(ctx, network, address)
+	}
+
+	addresses, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range addresses {
+		var conn net.Conn
+		conn, err = c.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	if err == nil {
+		err = &net.DNSError{Err: "no addresses found", Name: host, IsNotFound: true}
+	}
+
+	return nil, err
+}
+
+// ConfigureDNSCache caches DNS lookups made when connecting to the target for
+// the given TTL, reducing resolver load and latency under high fan-out. The
+// cache is added to the dialer of the current HttpTransport, including
+// transports added by ConfigureClientTLS, which keep it when called
+// afterwards. Custom transports that aren't an *http.Transport are left
+// unchanged.
+func (s *Server) ConfigureDNSCache(ttl time.Duration) {
+	cache := newDNSCache(net.DefaultResolver, ttl)
+	s.HttpTransport = withDialContext(s.HttpTransport, cache.DialContext)
+}
+
+func withDialContext(transport http.RoundTripper, dial func(context.Context, string, string) (net.Conn, error)) http.RoundTripper {
+	switch t := transport.(type) {
+	case *http.Transport:
+		clone := t.Clone()
+		clone.DialContext = dial
+		return clone
+	case *hostTransport:
+		t.fallback = withDialContext(t.fallback, dial)
+		for host, hostTransport := range t.hosts {
+			t.hosts[host] = withDialContext(hostTransport, dial)
+		}
+		return t
+	default:
+		return transport
+	}
+}
@@ -0,0 +1,78 @@
+package viewproxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeResolver struct {
+	lookups int32
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	atomic.AddInt32(&r.lookups, 1)
+
+	if host != "viewproxy.test" {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+}
+
+func TestDNSCache(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	serverUrl, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+
+	now := time.Now()
+	resolver := &fakeResolver{}
+	cache := newDNSCache(resolver, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	transport := withDialContext(http.DefaultTransport, cache.DialContext).(*http.Transport)
+	transport.DisableKeepAlives = true
+	client := &http.Client{Transport: transport}
+
+	get := func() {
+		resp, err := client.Get(fmt.Sprintf("http://viewproxy.test:%s", serverUrl.Port()))
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(body))
+	}
+
+	get()
+	get()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&resolver.lookups), "Expected lookups within the TTL to be cached")
+
+	now = now.Add(2 * time.Minute)
+	get()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&resolver.lookups), "Expected lookup after the TTL to resolve again")
+
+	_, err = client.Get(fmt.Sprintf("http://missing.test:%s", serverUrl.Port()))
+	assert.Error(t, err)
+}
+
+func TestConfigureDNSCacheDoesNotModifyDefaultTransport(t *testing.T) {
+	viewProxyServer := NewServer("http://localhost")
+	viewProxyServer.ConfigureDNSCache(time.Minute)
+
+	assert.NotSame(t, http.DefaultTransport, viewProxyServer.HttpTransport)
+	assert.NotNil(t, viewProxyServer.HttpTransport.(*http.Transport).DialContext)
+}
@@ -0,0 +1,50 @@
+package viewproxy
+
+import (
+	"strings"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+// fragmentsHeader is set by layouts of routes with DynamicFragments to name
+// the fragments to fetch.
+const fragmentsHeader = "X-View-Proxy-Fragments"
+
+// dynamicFragments returns the route's fragments named by the layout's
+// fragments header, in the order they were registered, and removes the
+// header so it isn't sent to the client. Names that don't match a registered
+// fragment are ignored so the layout can't request arbitrary URLs. All of the
+// route's fragments are returned when the layout doesn't set the header.
+func (s *Server) dynamicFragments(route *Route, layout *multiplexer.Result) []*Fragment {
+	values := layout.Header().Values(fragmentsHeader)
+	if len(values) == 0 {
+		return route.fragments
+	}
+	layout.Header().Del(fragmentsHeader)
+
+	names := make(map[string]bool)
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names[name] = true
+			}
+		}
+	}
+
+	fragments := make([]*Fragment, 0, len(names))
+	found := make(map[string]bool, len(names))
+	for _, fragment := range route.fragments {
+		if names[fragment.Name()] {
+			fragments = append(fragments, fragment)
+			found[fragment.Name()] = true
+		}
+	}
+
+	for name := range names {
+		if !found[name] {
+			s.Logger.Warnf("Layout %s requested unknown fragment %q, ignoring it", layout.Url, name)
+		}
+	}
+
+	return fragments
+}
@@ -0,0 +1,92 @@
+package viewproxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer/multiplexertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDynamicFragments(t *testing.T) {
+	tests := map[string]struct {
+		fragmentsHeader  []string
+		expectedBody     string
+		expectedRequests []string
+	}{
+		"subset": {
+			fragmentsHeader:  []string{"footer, header"},
+			expectedBody:     "<header>|<footer>",
+			expectedRequests: []string{"/layout", "/header", "/footer"},
+		},
+		"multiple headers": {
+			fragmentsHeader:  []string{"header", "sidebar"},
+			expectedBody:     "<header>|<aside>|",
+			expectedRequests: []string{"/layout", "/header", "/aside"},
+		},
+		"unregistered fragments are ignored": {
+			fragmentsHeader:  []string{"header,admin"},
+			expectedBody:     "<header>|",
+			expectedRequests: []string{"/layout", "/header"},
+		},
+		"no fragments": {
+			fragmentsHeader:  []string{""},
+			expectedBody:     "",
+			expectedRequests: []string{"/layout"},
+		},
+		"all fragments without the header": {
+			expectedBody:     "<header>|<aside>|<footer>",
+			expectedRequests: []string{"/layout", "/header", "/aside", "/footer"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			transport := multiplexertest.NewTransport()
+			transport.Add("http://views.internal/layout", multiplexertest.Response{
+				Header: http.Header{"X-View-Proxy-Fragments": tc.fragmentsHeader},
+				Body:   "{{{VIEW_PROXY_CONTENT}}}",
+			})
+			transport.Add("http://views.internal/header", multiplexertest.Response{Body: "<header>|"})
+			transport.Add("http://views.internal/aside", multiplexertest.Response{Body: "<aside>|"})
+			transport.Add("http://views.internal/footer", multiplexertest.Response{Body: "<footer>"})
+			transport.Add("http://views.internal/admin", multiplexertest.Response{Body: "<admin>"})
+
+			viewProxyServer := NewServer("http://views.internal")
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.HttpTransport = transport
+			viewProxyServer.GetWithOptions(
+				"/hello/:name",
+				NewFragment("/layout"),
+				[]*Fragment{NewFragment("/header"), NewFragmentWithMetadata("/aside", map[string]string{"name": "sidebar"}), NewFragment("/footer")},
+				RouteOptions{DynamicFragments: true},
+			)
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tc.expectedBody, w.Body.String())
+			assert.Empty(t, w.Header().Get("X-View-Proxy-Fragments"))
+
+			// The layout is fetched first, then the fragments in parallel.
+			paths := make([]string, 0, len(transport.Requests()))
+			for _, req := range transport.Requests() {
+				paths = append(paths, req.URL.Path)
+			}
+			if assert.NotEmpty(t, paths) {
+				assert.Equal(t, "/layout", paths[0])
+				assert.ElementsMatch(t, tc.expectedRequests, paths)
+			}
+		})
+	}
+}
+
+func TestFragmentName(t *testing.T) {
+	assert.Equal(t, "widgets/header", NewFragment("/widgets/header/").Name())
+	assert.Equal(t, "header", NewFragmentWithMetadata("/widgets/header", map[string]string{"name": "header"}).Name())
+}
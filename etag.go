@@ -0,0 +1,36 @@
+package viewproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// etag returns a strong ETag for body.
+func etag(body []byte) string {
+	sum := sha256.Sum256(body)
+
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// etagMatches returns true when the If-None-Match value ifNoneMatch is `*` or
+// lists tag, comparing weak and strong tags alike.
+func etagMatches(ifNoneMatch string, tag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isCacheable returns true when the response's Cache-Control doesn't forbid
+// storing it.
+func isCacheable(header http.Header) bool {
+	_, noStore := parseCacheControl(strings.Join(header.Values("Cache-Control"), ", "))["no-store"]
+
+	return !noStore
+}
@@ -0,0 +1,80 @@
+package viewproxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateETags(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Header().Set("ETag", `"layout"`)
+			w.Header().Set("Cache-Control", "public, max-age=60")
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		case "/private":
+			w.Header().Set("Cache-Control", "no-store")
+			w.Write([]byte("private"))
+		default:
+			w.Header().Set("Cache-Control", "public, max-age=60")
+			w.Write([]byte(strings.Repeat("hello", 10)))
+		}
+	}))
+	defer server.Close()
+
+	body := "<body>" + strings.Repeat("hello", 10) + "</body>"
+
+	tests := map[string]struct {
+		path           string
+		ifNoneMatch    string
+		acceptEncoding string
+		expectedCode   int
+		expectedETag   string
+		expectedBody   string
+	}{
+		"first request": {path: "/hello/world", expectedCode: http.StatusOK, expectedETag: etag([]byte(body)), expectedBody: body},
+		"matching":      {path: "/hello/world", ifNoneMatch: `"other", ` + etag([]byte(body)), expectedCode: http.StatusNotModified, expectedETag: etag([]byte(body))},
+		"weak matching": {path: "/hello/world", ifNoneMatch: "W/" + etag([]byte(body)), expectedCode: http.StatusNotModified, expectedETag: etag([]byte(body))},
+		"stale":         {path: "/hello/world", ifNoneMatch: `"layout"`, expectedCode: http.StatusOK, expectedETag: etag([]byte(body)), expectedBody: body},
+		"compressed":    {path: "/hello/world", ifNoneMatch: etag([]byte(body)), acceptEncoding: "gzip", expectedCode: http.StatusNotModified, expectedETag: etag([]byte(body))},
+		"not cacheable": {path: "/private/world", ifNoneMatch: "*", expectedCode: http.StatusOK, expectedBody: "<body>private</body>"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.GenerateETags = true
+			viewProxyServer.CombineCacheControl = true
+			viewProxyServer.CompressResponses = true
+			viewProxyServer.CompressionMinSize = 0
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/hello")})
+			viewProxyServer.Get("/private/:name", NewFragment("/layout"), []*Fragment{NewFragment("/private")})
+
+			r := httptest.NewRequest("GET", tc.path, nil)
+			if tc.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tc.ifNoneMatch)
+			}
+			if tc.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			responseBody, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.expectedCode, resp.StatusCode)
+			assert.Equal(t, tc.expectedETag, resp.Header.Get("ETag"))
+			assert.Equal(t, tc.expectedBody, string(responseBody))
+		})
+	}
+}
@@ -0,0 +1,14 @@
+package viewproxy
+
+// FetchOrder determines when a route's fragments are fetched relative to its
+// layout.
+type FetchOrder int
+
+const (
+	// Fetch the layout and fragments in parallel.
+	FetchParallel FetchOrder = iota
+	// Fetch the layout first and only fetch the fragments after it succeeds,
+	// e.g. for origins that authorize the page in the layout. Fragments
+	// aren't fetched when the layout fails or redirects.
+	FetchLayoutFirst
+)
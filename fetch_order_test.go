@@ -0,0 +1,96 @@
+package viewproxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchOrder(t *testing.T) {
+	tests := map[string]struct {
+		fetchOrder            FetchOrder
+		layoutStatus          int
+		expectedCode          int
+		expectedFragments     int32
+		expectedAfterLayout   bool
+		expectedLocation      string
+		expectedBodyOnSuccess string
+	}{
+		"parallel": {
+			fetchOrder:            FetchParallel,
+			layoutStatus:          http.StatusOK,
+			expectedCode:          http.StatusOK,
+			expectedFragments:     1,
+			expectedAfterLayout:   false,
+			expectedBodyOnSuccess: "<body>header</body>",
+		},
+		"layout first": {
+			fetchOrder:            FetchLayoutFirst,
+			layoutStatus:          http.StatusOK,
+			expectedCode:          http.StatusOK,
+			expectedFragments:     1,
+			expectedAfterLayout:   true,
+			expectedBodyOnSuccess: "<body>header</body>",
+		},
+		"layout first with a failing layout": {
+			fetchOrder:        FetchLayoutFirst,
+			layoutStatus:      http.StatusForbidden,
+			expectedCode:      http.StatusForbidden,
+			expectedFragments: 0,
+		},
+		"layout first with a redirecting layout": {
+			fetchOrder:        FetchLayoutFirst,
+			layoutStatus:      http.StatusFound,
+			expectedCode:      http.StatusFound,
+			expectedFragments: 0,
+			expectedLocation:  "/login",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var layoutDone, fragmentRequests int32
+			var fragmentAfterLayout atomic.Value
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/layout":
+					time.Sleep(50 * time.Millisecond)
+					atomic.StoreInt32(&layoutDone, 1)
+					if tc.layoutStatus == http.StatusFound {
+						w.Header().Set("Location", "/login")
+					}
+					w.WriteHeader(tc.layoutStatus)
+					w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+				case "/header":
+					atomic.AddInt32(&fragmentRequests, 1)
+					fragmentAfterLayout.Store(atomic.LoadInt32(&layoutDone) == 1)
+					w.Write([]byte("header"))
+				}
+			}))
+			defer server.Close()
+
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.FetchOrder = tc.fetchOrder
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/header")})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.expectedCode, w.Code)
+			assert.Equal(t, tc.expectedLocation, w.Header().Get("Location"))
+			assert.Equal(t, tc.expectedFragments, atomic.LoadInt32(&fragmentRequests))
+			if tc.expectedFragments > 0 {
+				assert.Equal(t, tc.expectedBodyOnSuccess, w.Body.String())
+				assert.Equal(t, tc.expectedAfterLayout, fragmentAfterLayout.Load())
+			}
+		})
+	}
+}
@@ -2,7 +2,9 @@ package viewproxy
 
 import (
 	"fmt"
+	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
@@ -10,6 +12,21 @@ type Fragment struct {
 	Path     string `json:"path"`
 	Url      string
 	Metadata map[string]string `json:"metadata"`
+	// Optional fragments that fail to fetch render Fallback instead of
+	// failing the page.
+	Optional bool   `json:"optional"`
+	Fallback string `json:"fallback"`
+	// The fragment is requested with the inbound request's method and body,
+	// e.g. to handle a form submission. Other fragments are always GETs.
+	ReceivesBody bool `json:"receives_body"`
+	// Decides which response statuses are successful, e.g. to render a 404
+	// as empty content instead of failing the page. When nil, only 2xx
+	// statuses are successful.
+	SuccessStatus func(statusCode int) bool `json:"-"`
+	// Headers sent with every request for the fragment, replacing the
+	// inbound request's headers with the same names, e.g. `Accept:
+	// application/json`.
+	Headers http.Header `json:"headers"`
 }
 
 func NewFragment(path string) *Fragment {
@@ -26,14 +43,118 @@ func NewFragmentWithMetadata(path string, metadata map[string]string) *Fragment
 	}
 }
 
+// Name returns the name used to refer to the fragment, set via the `name`
+// metadata key. Fragments without one use their path without leading and
+// trailing slashes, e.g. `widgets/header`.
+func (f *Fragment) Name() string {
+	if name := f.Metadata["name"]; name != "" {
+		return name
+	}
+
+	return strings.Trim(f.Path, "/")
+}
+
+// Slot returns the name of the layout content slot the fragment is rendered
+// into, set via the `slot` metadata key. An empty slot uses the default
+// content placeholder.
+func (f *Fragment) Slot() string {
+	return f.Metadata["slot"]
+}
+
+// Order returns the fragment's position relative to the other fragments in
+// its slot, set via the `order` metadata key. Fragments are rendered by
+// ascending order and fragments with the same order, or without a valid one,
+// keep the order they were registered in.
+func (f *Fragment) Order() int {
+	order, err := strconv.Atoi(f.Metadata["order"])
+	if err != nil {
+		return 0
+	}
+
+	return order
+}
+
+// TitlePriority returns the precedence of the page title the fragment sets
+// with the `X-View-Proxy-Title` header, set via the `title_priority` metadata
+// key. The title from the fragment with the highest priority is used, and
+// fragments without a valid priority use 0.
+func (f *Fragment) TitlePriority() int {
+	priority, err := strconv.Atoi(f.Metadata["title_priority"])
+	if err != nil {
+		return 0
+	}
+
+	return priority
+}
+
+// UrlWithParams returns the fragment's URL with each `:param` segment of its
+// path replaced by the matching parameter, e.g. `/widgets/:id/header`, and
+// the remaining parameters added as the query.
 func (f *Fragment) UrlWithParams(parameters url.Values) string {
 	// This is already parsed before constructing the url in server.go, so we ignore errors
 	targetUrl, _ := url.Parse(f.Url)
+
+	if names := f.pathParameters(); len(names) > 0 {
+		query := make(url.Values, len(parameters))
+		for name, values := range parameters {
+			query[name] = values
+		}
+
+		segments := strings.Split(targetUrl.EscapedPath(), "/")
+		for i, segment := range segments {
+			if !strings.HasPrefix(segment, ":") {
+				continue
+			}
+
+			if _, ok := query[segment[1:]]; ok {
+				segments[i] = url.PathEscape(query.Get(segment[1:]))
+				query.Del(segment[1:])
+			}
+		}
+
+		targetUrl.RawPath = strings.Join(segments, "/")
+		targetUrl.Path, _ = url.PathUnescape(targetUrl.RawPath)
+		parameters = query
+	}
+
 	targetUrl.RawQuery = parameters.Encode()
 
 	return targetUrl.String()
 }
 
+// checkPathParameters returns an error when one of the fragment's `:param`
+// segments isn't a route parameter, or would become a `.` or `..` segment.
+// Path parameters are only filled from route parameters so the query string
+// can't change which path is requested.
+func (f *Fragment) checkPathParameters(parameters map[string]string) error {
+	for _, name := range f.pathParameters() {
+		value, ok := parameters[name]
+		if !ok {
+			return fmt.Errorf("fragment %q uses parameter %q not defined by the route", f.Path, name)
+		}
+
+		if value == "." || hasPathTraversal(value) {
+			return fmt.Errorf("%w: fragment %q parameter %q is %q", errPathTraversal, f.Path, name, value)
+		}
+	}
+
+	return nil
+}
+
+// pathParameters returns the names of the `:param` segments in the
+// fragment's path.
+func (f *Fragment) pathParameters() []string {
+	var names []string
+
+	for _, segment := range strings.Split(f.Path, "/") {
+		if strings.HasPrefix(segment, ":") {
+			names = append(names, segment[1:])
+		}
+	}
+
+	return names
+}
+
 func (f *Fragment) PreloadUrl(target string) {
 	targetUrl, err := url.Parse(
 		fmt.Sprintf("%s/%s", strings.TrimRight(target, "/"), strings.TrimLeft(f.Path, "/")),
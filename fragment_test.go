@@ -0,0 +1,98 @@
+package viewproxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFragmentUrlWithParams(t *testing.T) {
+	tests := map[string]struct {
+		path       string
+		parameters url.Values
+		want       string
+	}{
+		"query only":     {path: "/widgets/header", parameters: url.Values{"id": {"123"}}, want: "http://localhost:3000/widgets/header?id=123"},
+		"path only":      {path: "/widgets/:id/header", parameters: url.Values{"id": {"123"}}, want: "http://localhost:3000/widgets/123/header"},
+		"path and query": {path: "/users/:user/widgets/:id", parameters: url.Values{"user": {"blake"}, "id": {"123"}, "page": {"2"}}, want: "http://localhost:3000/users/blake/widgets/123?page=2"},
+		"escaped":        {path: "/widgets/:id/header", parameters: url.Values{"id": {"a b/c"}}, want: "http://localhost:3000/widgets/a%20b%2Fc/header"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			fragment := NewFragment(tc.path)
+			fragment.PreloadUrl("http://localhost:3000")
+
+			assert.Equal(t, tc.want, fragment.UrlWithParams(tc.parameters))
+		})
+	}
+}
+
+func TestFragmentCheckPathParameters(t *testing.T) {
+	tests := map[string]struct {
+		parameters map[string]string
+		wantError  string
+		wantStatus int
+	}{
+		"route parameter": {parameters: map[string]string{"id": "42"}},
+		"missing":         {parameters: map[string]string{}, wantError: `fragment "/comments/:id" uses parameter "id" not defined by the route`, wantStatus: http.StatusBadGateway},
+		"dot":             {parameters: map[string]string{"id": "."}, wantError: `path traversal: fragment "/comments/:id" parameter "id" is "."`, wantStatus: http.StatusBadRequest},
+		"parent":          {parameters: map[string]string{"id": ".."}, wantError: `path traversal: fragment "/comments/:id" parameter "id" is ".."`, wantStatus: http.StatusBadRequest},
+		"nested parent":   {parameters: map[string]string{"id": "a/.."}, wantError: `path traversal: fragment "/comments/:id" parameter "id" is "a/.."`, wantStatus: http.StatusBadRequest},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := NewFragment("/comments/:id").checkPathParameters(tc.parameters)
+
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+				assert.Equal(t, tc.wantStatus, errorStatus(err))
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestFragmentOrder(t *testing.T) {
+	tests := map[string]struct {
+		metadata map[string]string
+		want     int
+	}{
+		"missing":  {metadata: map[string]string{}, want: 0},
+		"positive": {metadata: map[string]string{"order": "2"}, want: 2},
+		"negative": {metadata: map[string]string{"order": "-1"}, want: -1},
+		"invalid":  {metadata: map[string]string{"order": "first"}, want: 0},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			fragment := NewFragmentWithMetadata("/widgets", tc.metadata)
+
+			assert.Equal(t, tc.want, fragment.Order())
+		})
+	}
+}
+
+func TestFragmentTitlePriority(t *testing.T) {
+	tests := map[string]struct {
+		metadata map[string]string
+		want     int
+	}{
+		"missing":  {metadata: map[string]string{}, want: 0},
+		"positive": {metadata: map[string]string{"title_priority": "10"}, want: 10},
+		"negative": {metadata: map[string]string{"title_priority": "-1"}, want: -1},
+		"invalid":  {metadata: map[string]string{"title_priority": "high"}, want: 0},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			fragment := NewFragmentWithMetadata("/widgets", tc.metadata)
+
+			assert.Equal(t, tc.want, fragment.TitlePriority())
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package viewproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// RouteGroup registers routes that share a path prefix and options, e.g. for
+// every route under `/admin`.
+type RouteGroup struct {
+	server  *Server
+	prefix  string
+	options RouteOptions
+}
+
+// Group returns a RouteGroup for registering routes under prefix, e.g.
+// `server.Group("/admin").Get("/users", ...)` matches `/admin/users`.
+func (s *Server) Group(prefix string) *RouteGroup {
+	return s.GroupWithOptions(prefix, RouteOptions{})
+}
+
+// GroupWithOptions returns a RouteGroup whose routes use options unless the
+// route sets its own. Middleware from the group runs before the route's.
+func (s *Server) GroupWithOptions(prefix string, options RouteOptions) *RouteGroup {
+	return &RouteGroup{server: s, prefix: prefix, options: options}
+}
+
+// Group returns a nested RouteGroup under the group's prefix that inherits its
+// options.
+func (g *RouteGroup) Group(prefix string) *RouteGroup {
+	return g.GroupWithOptions(prefix, RouteOptions{})
+}
+
+func (g *RouteGroup) GroupWithOptions(prefix string, options RouteOptions) *RouteGroup {
+	return &RouteGroup{server: g.server, prefix: joinPaths(g.prefix, prefix), options: mergeRouteOptions(g.options, options)}
+}
+
+// Use adds middleware that wraps every route registered on the group after
+// it's called.
+func (g *RouteGroup) Use(middleware func(http.Handler) http.Handler) {
+	g.options.Middleware = append(g.options.Middleware, middleware)
+}
+
+func (g *RouteGroup) Get(path string, layout *Fragment, fragments []*Fragment) {
+	g.GetWithOptions(path, layout, fragments, RouteOptions{})
+}
+
+func (g *RouteGroup) GetWithOptions(path string, layout *Fragment, fragments []*Fragment, options RouteOptions) {
+	g.handle(http.MethodGet, path, layout, fragments, options)
+}
+
+func (g *RouteGroup) Post(path string, layout *Fragment, fragments []*Fragment) {
+	g.PostWithOptions(path, layout, fragments, RouteOptions{})
+}
+
+func (g *RouteGroup) PostWithOptions(path string, layout *Fragment, fragments []*Fragment, options RouteOptions) {
+	g.handle(http.MethodPost, path, layout, fragments, options)
+}
+
+func (g *RouteGroup) Put(path string, layout *Fragment, fragments []*Fragment) {
+	g.PutWithOptions(path, layout, fragments, RouteOptions{})
+}
+
+func (g *RouteGroup) PutWithOptions(path string, layout *Fragment, fragments []*Fragment, options RouteOptions) {
+	g.handle(http.MethodPut, path, layout, fragments, options)
+}
+
+func (g *RouteGroup) Patch(path string, layout *Fragment, fragments []*Fragment) {
+	g.PatchWithOptions(path, layout, fragments, RouteOptions{})
+}
+
+func (g *RouteGroup) PatchWithOptions(path string, layout *Fragment, fragments []*Fragment, options RouteOptions) {
+	g.handle(http.MethodPatch, path, layout, fragments, options)
+}
+
+func (g *RouteGroup) Delete(path string, layout *Fragment, fragments []*Fragment) {
+	g.DeleteWithOptions(path, layout, fragments, RouteOptions{})
+}
+
+func (g *RouteGroup) DeleteWithOptions(path string, layout *Fragment, fragments []*Fragment, options RouteOptions) {
+	g.handle(http.MethodDelete, path, layout, fragments, options)
+}
+
+func (g *RouteGroup) handle(method string, path string, layout *Fragment, fragments []*Fragment, options RouteOptions) {
+	g.server.handle(method, joinPaths(g.prefix, path), layout, fragments, mergeRouteOptions(g.options, options))
+}
+
+// joinPaths appends path to prefix with a single `/` between them. An empty or
+// `/` path refers to the prefix itself, so `/admin` and `/` join to `/admin`.
+func joinPaths(prefix string, path string) string {
+	prefix = strings.TrimRight(prefix, "/")
+	path = strings.TrimLeft(path, "/")
+
+	if path == "" {
+		if prefix == "" {
+			return "/"
+		}
+
+		return prefix
+	}
+
+	return prefix + "/" + path
+}
+
+// mergeRouteOptions returns base with each option set in overrides replacing
+// it, except for middleware which is appended to base's. Names identify a
+// single route, so base's name isn't inherited.
+func mergeRouteOptions(base RouteOptions, overrides RouteOptions) RouteOptions {
+	merged := base
+	merged.Name = overrides.Name
+	merged.Middleware = append(append([]func(http.Handler) http.Handler(nil), base.Middleware...), overrides.Middleware...)
+
+	if overrides.Timeout > 0 {
+		merged.Timeout = overrides.Timeout
+	}
+
+	if overrides.HmacSecret != "" {
+		merged.HmacSecret = overrides.HmacSecret
+	}
+
+	if overrides.Host != "" {
+		merged.Host = overrides.Host
+	}
+
+	if overrides.DynamicFragments {
+		merged.DynamicFragments = true
+	}
+
+	return merged
+}
@@ -0,0 +1,103 @@
+package viewproxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteGroups(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	var calls []string
+	middleware := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+
+	admin := viewProxyServer.GroupWithOptions("/admin/", RouteOptions{Timeout: 10 * time.Millisecond})
+	admin.Use(middleware("admin"))
+	admin.Get("/", NewFragment("/index"), []*Fragment{})
+	admin.Get("/users/:id", NewFragment("/user"), []*Fragment{})
+	admin.Get("/slow", NewFragment("/slow"), []*Fragment{})
+	admin.GetWithOptions("/reports", NewFragment("/slow"), []*Fragment{}, RouteOptions{
+		Timeout:    time.Second,
+		Middleware: []func(http.Handler) http.Handler{middleware("reports")},
+	})
+	admin.Group("settings").Post("/", NewFragment("/settings"), []*Fragment{})
+
+	tests := map[string]struct {
+		method        string
+		url           string
+		expectedCode  int
+		expectedBody  string
+		expectedCalls []string
+	}{
+		"index":          {method: "GET", url: "/admin", expectedCode: 200, expectedBody: "/index", expectedCalls: []string{"admin"}},
+		"parameter":      {method: "GET", url: "/admin/users/1", expectedCode: 200, expectedBody: "/user", expectedCalls: []string{"admin"}},
+		"without prefix": {method: "GET", url: "/users/1", expectedCode: 404, expectedBody: "404 not found"},
+		"group timeout":  {method: "GET", url: "/admin/slow", expectedCode: 504, expectedBody: "504 gateway timeout", expectedCalls: []string{"admin"}},
+		"route options":  {method: "GET", url: "/admin/reports", expectedCode: 200, expectedBody: "/slow", expectedCalls: []string{"admin", "reports"}},
+		"nested group":   {method: "POST", url: "/admin/settings", expectedCode: 200, expectedBody: "/settings", expectedCalls: []string{"admin"}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			calls = nil
+
+			r := httptest.NewRequest(tc.method, tc.url, nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.expectedCode, resp.StatusCode)
+			assert.Equal(t, tc.expectedBody, strings.TrimSpace(string(body)))
+			assert.Equal(t, tc.expectedCalls, calls)
+		})
+	}
+}
+
+func TestJoinPaths(t *testing.T) {
+	tests := map[string]struct {
+		prefix string
+		path   string
+		want   string
+	}{
+		"simple":         {prefix: "/admin", path: "/users", want: "/admin/users"},
+		"trailing slash": {prefix: "/admin/", path: "/users", want: "/admin/users"},
+		"no leading":     {prefix: "/admin", path: "users", want: "/admin/users"},
+		"root path":      {prefix: "/admin", path: "/", want: "/admin"},
+		"empty path":     {prefix: "/admin", path: "", want: "/admin"},
+		"root prefix":    {prefix: "/", path: "/users", want: "/users"},
+		"root and root":  {prefix: "/", path: "/", want: "/"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, joinPaths(tc.prefix, tc.path))
+		})
+	}
+}
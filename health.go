@@ -0,0 +1,46 @@
+package viewproxy
+
+import (
+	"net/http"
+)
+
+// serveProbe responds to requests for HealthPath and ReadyPath, returning
+// false when the request is for neither.
+func (s *Server) serveProbe(w http.ResponseWriter, r *http.Request) bool {
+	switch {
+	case s.HealthPath != "" && r.URL.Path == s.HealthPath:
+	case s.ReadyPath != "" && r.URL.Path == s.ReadyPath:
+		if s.ReadyProbesTarget {
+			if err := s.probeTarget(r); err != nil {
+				s.Logger.Warnf("Readiness probe of %s failed: %v", s.target, err)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte("503 service unavailable"))
+				return true
+			}
+		}
+	default:
+		return false
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+
+	return true
+}
+
+// probeTarget makes a HEAD request to the target, returning an error when it
+// can't be reached. Any response, regardless of status, counts as reachable.
+func (s *Server) probeTarget(r *http.Request) error {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodHead, s.target, nil)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Transport: s.HttpTransport, Timeout: s.ProxyTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
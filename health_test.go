@@ -0,0 +1,62 @@
+package viewproxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbes(t *testing.T) {
+	tests := map[string]struct {
+		target            string
+		readyProbesTarget bool
+		path              string
+		expectedCode      int
+		expectedBody      string
+	}{
+		"health":                {target: targetServer.URL, path: "/healthz", expectedCode: http.StatusOK, expectedBody: "ok"},
+		"ready":                 {target: targetServer.URL, path: "/readyz", expectedCode: http.StatusOK, expectedBody: "ok"},
+		"ready probes target":   {target: targetServer.URL, readyProbesTarget: true, path: "/readyz", expectedCode: http.StatusOK, expectedBody: "ok"},
+		"unreachable target":    {target: "http://127.0.0.1:1", readyProbesTarget: true, path: "/readyz", expectedCode: http.StatusServiceUnavailable, expectedBody: "503 service unavailable"},
+		"health ignores target": {target: "http://127.0.0.1:1", readyProbesTarget: true, path: "/healthz", expectedCode: http.StatusOK, expectedBody: "ok"},
+		"other paths":           {target: targetServer.URL, path: "/livez", expectedCode: http.StatusNotFound, expectedBody: "404 not found"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer(tc.target)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.HealthPath = "/healthz"
+			viewProxyServer.ReadyPath = "/readyz"
+			viewProxyServer.ReadyProbesTarget = tc.readyProbesTarget
+
+			r := httptest.NewRequest("GET", tc.path, nil)
+			w := httptest.NewRecorder()
+
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.expectedCode, resp.StatusCode)
+			assert.Equal(t, tc.expectedBody, string(body))
+		})
+	}
+}
+
+func TestProbesAreDisabledByDefault(t *testing.T) {
+	viewProxyServer := NewServer(targetServer.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+
+	r := httptest.NewRequest("GET", "/healthz", nil)
+	w := httptest.NewRecorder()
+
+	viewProxyServer.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
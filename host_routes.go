@@ -0,0 +1,49 @@
+package viewproxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HostRoutes registers routes that only match requests for a single host.
+// Routes registered directly on the server act as defaults for every host.
+type HostRoutes struct {
+	server *Server
+	host   string
+}
+
+// Host returns a HostRoutes for registering routes that only match requests
+// for the given host, e.g. `server.Host("admin.example.com").Get(...)`.
+func (s *Server) Host(host string) *HostRoutes {
+	return &HostRoutes{server: s, host: host}
+}
+
+func (h *HostRoutes) Get(path string, layout *Fragment, fragments []*Fragment) {
+	h.server.handle(http.MethodGet, path, layout, fragments, RouteOptions{Host: h.host})
+}
+
+func (h *HostRoutes) Post(path string, layout *Fragment, fragments []*Fragment) {
+	h.server.handle(http.MethodPost, path, layout, fragments, RouteOptions{Host: h.host})
+}
+
+func (h *HostRoutes) Put(path string, layout *Fragment, fragments []*Fragment) {
+	h.server.handle(http.MethodPut, path, layout, fragments, RouteOptions{Host: h.host})
+}
+
+func (h *HostRoutes) Patch(path string, layout *Fragment, fragments []*Fragment) {
+	h.server.handle(http.MethodPatch, path, layout, fragments, RouteOptions{Host: h.host})
+}
+
+func (h *HostRoutes) Delete(path string, layout *Fragment, fragments []*Fragment) {
+	h.server.handle(http.MethodDelete, path, layout, fragments, RouteOptions{Host: h.host})
+}
+
+// normalizeHost lowercases host and removes its port, if any.
+func normalizeHost(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	return strings.ToLower(host)
+}
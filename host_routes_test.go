@@ -0,0 +1,58 @@
+package viewproxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostRoutes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.Host("admin.example.com").Get("/dashboard", NewFragment("/admin_layout"), []*Fragment{})
+	viewProxyServer.Host("shop.example.com").Get("/dashboard", NewFragment("/shop_layout"), []*Fragment{})
+	viewProxyServer.Host("shop.example.com").Post("/cart", NewFragment("/cart_layout"), []*Fragment{})
+	viewProxyServer.Get("/dashboard", NewFragment("/default_layout"), []*Fragment{})
+	viewProxyServer.Get("/about", NewFragment("/about_layout"), []*Fragment{})
+
+	tests := map[string]struct {
+		host         string
+		url          string
+		expectedCode int
+		expectedBody string
+	}{
+		"admin host":         {host: "admin.example.com", url: "/dashboard", expectedCode: 200, expectedBody: "/admin_layout"},
+		"shop host":          {host: "shop.example.com", url: "/dashboard", expectedCode: 200, expectedBody: "/shop_layout"},
+		"host with port":     {host: "Shop.Example.com:8080", url: "/dashboard", expectedCode: 200, expectedBody: "/shop_layout"},
+		"unknown host":       {host: "example.com", url: "/dashboard", expectedCode: 200, expectedBody: "/default_layout"},
+		"falls back":         {host: "admin.example.com", url: "/about", expectedCode: 200, expectedBody: "/about_layout"},
+		"other host route":   {host: "admin.example.com", url: "/cart", expectedCode: 404, expectedBody: "404 not found"},
+		"method not allowed": {host: "shop.example.com", url: "/cart", expectedCode: 405, expectedBody: "405 method not allowed"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tc.url, nil)
+			r.Host = tc.host
+			w := httptest.NewRecorder()
+
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.expectedCode, resp.StatusCode)
+			assert.Equal(t, tc.expectedBody, string(body))
+		})
+	}
+}
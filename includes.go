@@ -0,0 +1,138 @@
+package viewproxy
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+// maxIncludeDepth is how deeply fragment includes can nest. A fragment
+// included by the layout or a route's fragment is at depth 1, a fragment it
+// includes is at depth 2, and so on.
+const maxIncludeDepth = 5
+
+// IncludeFragments registers fragments that layouts and fragments can include
+// with a `{{{VIEW_PROXY_FRAGMENT:name}}}` placeholder, where name is the
+// fragment's Name. Included fragments can include other fragments, up to 5
+// levels deep. Their paths can use route parameters, e.g. `/comments/:id`, as
+// long as every route defines them; IncludeFragments panics when a route
+// that's already registered doesn't.
+func (s *Server) IncludeFragments(fragments []*Fragment) {
+	if s.includes == nil {
+		s.includes = make(map[string]*Fragment)
+	}
+
+	for _, fragment := range fragments {
+		fragment.PreloadUrl(joinPaths(s.target, s.UpstreamPathPrefix))
+		s.includes[fragment.Name()] = fragment
+	}
+
+	for _, route := range s.routes {
+		if err := route.validate(s.includes); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// ResolveIncludes replaces each fragment include placeholder in the body with
+// the included fragment, fetched with fetch, after resolving the includes in
+// its own body. Placeholders for unregistered fragments are removed. An error
+// is returned when includes form a cycle or are nested more than
+// maxIncludeDepth deep.
+func (rb *responseBuilder) ResolveIncludes(fetch func(fragments []*Fragment) ([]*multiplexer.Result, error)) error {
+	body, err := rb.resolveIncludes(rb.body, nil, fetch)
+	if err != nil {
+		return err
+	}
+
+	rb.body = body
+	return nil
+}
+
+// resolveIncludes resolves the includes in body, which was included through
+// the fragments named in ancestors.
+func (rb *responseBuilder) resolveIncludes(body []byte, ancestors []string, fetch func(fragments []*Fragment) ([]*multiplexer.Result, error)) ([]byte, error) {
+	names := rb.includeNames(body)
+	if len(names) == 0 {
+		return body, nil
+	}
+
+	if len(ancestors) >= maxIncludeDepth {
+		return nil, fmt.Errorf("fragment includes are nested more than %d deep: %s", maxIncludeDepth, strings.Join(ancestors, " -> "))
+	}
+
+	fragments := make([]*Fragment, 0, len(names))
+	for _, name := range names {
+		for _, ancestor := range ancestors {
+			if ancestor == name {
+				return nil, fmt.Errorf("fragment include cycle: %s -> %s", strings.Join(ancestors, " -> "), name)
+			}
+		}
+
+		fragment, ok := rb.server.includes[name]
+		if !ok {
+			rb.server.Logger.Warnf("No fragment named %q to include, removing its placeholder", name)
+			continue
+		}
+
+		fragments = append(fragments, fragment)
+	}
+
+	content := make(map[string][]byte, len(fragments))
+	if len(fragments) > 0 {
+		results, err := fetch(fragments)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, result := range results {
+			fragmentBody := result.Body
+			if result.Err != nil {
+				rb.server.Logger.Warnf("Optional fragment %s failed, rendering fallback: %v", result.Url, result.Err)
+				fragmentBody = []byte(fragments[i].Fallback)
+			}
+
+			name := fragments[i].Name()
+			resolved, err := rb.resolveIncludes(fragmentBody, append(ancestors[:len(ancestors):len(ancestors)], name), fetch)
+			if err != nil {
+				return nil, err
+			}
+
+			content[name] = resolved
+		}
+	}
+
+	return rb.replaceNamedPlaceholders(body, "VIEW_PROXY_FRAGMENT", content), nil
+}
+
+// includeNames returns the names of the fragments included by body, in the
+// order they're first included.
+func (rb *responseBuilder) includeNames(body []byte) []string {
+	prefix := []byte(rb.server.LeftDelimiter + "VIEW_PROXY_FRAGMENT:")
+	suffix := []byte(rb.server.RightDelimiter)
+
+	var names []string
+	seen := make(map[string]bool)
+	for {
+		start := bytes.Index(body, prefix)
+		if start == -1 {
+			break
+		}
+
+		nameStart := start + len(prefix)
+		nameLength := bytes.Index(body[nameStart:], suffix)
+		if nameLength == -1 {
+			break
+		}
+
+		if name := string(body[nameStart : nameStart+nameLength]); !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+		body = body[nameStart+nameLength+len(suffix):]
+	}
+
+	return names
+}
@@ -0,0 +1,155 @@
+package viewproxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer/multiplexertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFragmentIncludes(t *testing.T) {
+	transport := multiplexertest.NewTransport()
+	transport.Add("http://views.internal/layout", multiplexertest.Response{Body: "<body>{{{VIEW_PROXY_CONTENT}}}</body>"})
+	transport.Add("http://views.internal/post", multiplexertest.Response{Body: "<article>{{{VIEW_PROXY_FRAGMENT:comments}}}</article>"})
+	transport.Add("http://views.internal/comments", multiplexertest.Response{Body: "<ul>{{{VIEW_PROXY_FRAGMENT:avatar}}}{{{VIEW_PROXY_FRAGMENT:avatar}}}</ul>"})
+	transport.Add("http://views.internal/avatar", multiplexertest.Response{Body: "<img>"})
+	transport.Add("http://views.internal/unknown", multiplexertest.Response{Body: "<p>{{{VIEW_PROXY_FRAGMENT:missing}}}</p>"})
+	transport.Add("http://views.internal/ping", multiplexertest.Response{Body: "{{{VIEW_PROXY_FRAGMENT:pong}}}"})
+	transport.Add("http://views.internal/pong", multiplexertest.Response{Body: "{{{VIEW_PROXY_FRAGMENT:ping}}}"})
+	for i := 0; i < 6; i++ {
+		transport.Add(fmt.Sprintf("http://views.internal/level/%d", i), multiplexertest.Response{Body: fmt.Sprintf("{{{VIEW_PROXY_FRAGMENT:level/%d}}}", i+1)})
+	}
+	transport.Add("http://views.internal/level/6", multiplexertest.Response{Body: "bottom"})
+
+	tests := map[string]struct {
+		fragment     string
+		expectedCode int
+		expectedBody string
+	}{
+		"nested includes":      {fragment: "/post", expectedCode: http.StatusOK, expectedBody: "<body><article><ul><img><img></ul></article></body>"},
+		"unregistered include": {fragment: "/unknown", expectedCode: http.StatusOK, expectedBody: "<body><p></p></body>"},
+		"cycle":                {fragment: "/ping", expectedCode: http.StatusBadGateway, expectedBody: "502 bad gateway"},
+		"too deep":             {fragment: "/level/0", expectedCode: http.StatusBadGateway, expectedBody: "502 bad gateway"},
+		"deepest allowed":      {fragment: "/level/1", expectedCode: http.StatusOK, expectedBody: "<body>bottom</body>"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer("http://views.internal")
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.HttpTransport = transport
+			viewProxyServer.IncludeFragments([]*Fragment{NewFragment("/comments"), NewFragment("/avatar"), NewFragment("/ping"), NewFragment("/pong")})
+			for i := 1; i <= 6; i++ {
+				viewProxyServer.IncludeFragments([]*Fragment{NewFragment(fmt.Sprintf("/level/%d", i))})
+			}
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment(tc.fragment)})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.expectedCode, w.Code)
+			assert.Equal(t, tc.expectedBody, w.Body.String())
+		})
+	}
+}
+
+func TestFragmentIncludeCycleError(t *testing.T) {
+	server := NewServer("http://views.internal")
+	server.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	server.includes = map[string]*Fragment{"ping": NewFragment("/ping"), "pong": NewFragment("/pong")}
+
+	rb := newResponseBuilder(*server, httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	rb.body = []byte("{{{VIEW_PROXY_FRAGMENT:ping}}}")
+
+	transport := multiplexertest.NewTransport()
+	transport.Add("http://views.internal/ping", multiplexertest.Response{Body: "{{{VIEW_PROXY_FRAGMENT:pong}}}"})
+	transport.Add("http://views.internal/pong", multiplexertest.Response{Body: "{{{VIEW_PROXY_FRAGMENT:ping}}}"})
+
+	err := rb.ResolveIncludes(func(fragments []*Fragment) ([]*multiplexer.Result, error) {
+		req := multiplexer.NewRequest()
+		req.Transport = transport
+		for _, fragment := range fragments {
+			req.WithFragment("http://views.internal"+fragment.Path, fragment.Metadata)
+		}
+
+		return req.Do(context.Background())
+	})
+
+	assert.EqualError(t, err, "fragment include cycle: ping -> pong -> ping")
+}
+
+func TestIncludeParametersComeFromRoute(t *testing.T) {
+	transport := multiplexertest.NewTransport()
+	transport.Add("http://views.internal/layout", multiplexertest.Response{Body: "<body>{{{VIEW_PROXY_CONTENT}}}</body>"})
+	transport.Add("http://views.internal/post", multiplexertest.Response{Body: "<article>{{{VIEW_PROXY_FRAGMENT:comments}}}</article>"})
+	transport.Add("http://views.internal/comments/42", multiplexertest.Response{Body: "<ul></ul>"})
+
+	viewProxyServer := NewServer("http://views.internal")
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.HttpTransport = transport
+	viewProxyServer.IncludeFragments([]*Fragment{{Path: "/comments/:id", Metadata: map[string]string{"name": "comments"}}})
+	viewProxyServer.Get("/posts/:id", NewFragment("/layout"), []*Fragment{NewFragment("/post")})
+
+	r := httptest.NewRequest("GET", "/posts/42?id=..", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "<body><article><ul></ul></article></body>", w.Body.String())
+
+	paths := make([]string, 0)
+	for _, req := range transport.Requests() {
+		paths = append(paths, req.URL.Path)
+	}
+	assert.ElementsMatch(t, []string{"/layout", "/post", "/comments/42"}, paths)
+}
+
+func TestIncludeParametersMustBeRouteParameters(t *testing.T) {
+	server := NewServer("http://views.internal")
+	server.IncludeFragments([]*Fragment{NewFragment("/comments/:id")})
+
+	err := server.addRoute(http.MethodGet, "/about", NewFragment("/layout"), []*Fragment{}, RouteOptions{})
+	assert.EqualError(t, err, `included fragment "/comments/:id" uses parameter "id" not defined by route "/about"`)
+
+	server = NewServer("http://views.internal")
+	server.Get("/about", NewFragment("/layout"), []*Fragment{})
+
+	assert.PanicsWithError(t, `included fragment "/comments/:id" uses parameter "id" not defined by route "/about"`, func() {
+		server.IncludeFragments([]*Fragment{NewFragment("/comments/:id")})
+	})
+}
+
+func TestNestedIncludesShareProxyTimeout(t *testing.T) {
+	transport := multiplexertest.NewTransport()
+	transport.Add("http://views.internal/layout", multiplexertest.Response{Body: "<body>{{{VIEW_PROXY_CONTENT}}}</body>"})
+	transport.Add("http://views.internal/post", multiplexertest.Response{Body: "{{{VIEW_PROXY_FRAGMENT:level/1}}}"})
+	for i := 1; i <= 3; i++ {
+		transport.Add(fmt.Sprintf("http://views.internal/level/%d", i), multiplexertest.Response{Body: fmt.Sprintf("{{{VIEW_PROXY_FRAGMENT:level/%d}}}", i+1), Latency: 60 * time.Millisecond})
+	}
+	transport.Add("http://views.internal/level/4", multiplexertest.Response{Body: "bottom"})
+
+	viewProxyServer := NewServer("http://views.internal")
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.HttpTransport = transport
+	viewProxyServer.ProxyTimeout = 100 * time.Millisecond
+	for i := 1; i <= 4; i++ {
+		viewProxyServer.IncludeFragments([]*Fragment{NewFragment(fmt.Sprintf("/level/%d", i))})
+	}
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/post")})
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Equal(t, "504 gateway timeout", w.Body.String())
+}
@@ -22,15 +22,8 @@ type TracingConfig struct {
 }
 
 type logger interface {
-	Fatal(v ...interface{})
-	Fatalf(format string, v ...interface{})
-	Fatalln(v ...interface{})
-	Panic(v ...interface{})
-	Panicf(format string, v ...interface{})
-	Panicln(v ...interface{})
-	Print(v ...interface{})
-	Printf(format string, v ...interface{})
-	Println(v ...interface{})
+	Infof(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
 }
 
 func Instrument(config TracingConfig, l logger) (func(), error) {
@@ -83,12 +76,12 @@ func Instrument(config TracingConfig, l logger) (func(), error) {
 		return func() {
 			err := tracerProvider.Shutdown(ctx)
 			if err != nil {
-				l.Fatalln("failed to stop tracer", err)
+				l.Errorf("failed to stop tracer: %v", err)
 			}
 		}, nil
 	}
 
-	l.Println("Tracing disabled, configuring noop tracing provider")
+	l.Infof("Tracing disabled, configuring noop tracing provider")
 	otel.SetTracerProvider(trace.NewNoopTracerProvider())
 	return func() {}, nil
 }
@@ -99,6 +92,6 @@ type ErrorHandler struct {
 
 func (eh ErrorHandler) Handle(err error) {
 	if err != nil {
-		eh.logger.Fatalln("encountered a problem during tracing", err)
+		eh.logger.Errorf("encountered a problem during tracing: %v", err)
 	}
 }
@@ -0,0 +1,73 @@
+package viewproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+// isJSON returns true when contentType is application/json or a JSON based
+// type like application/problem+json.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// hasJSONFragments returns true when any successful result is JSON.
+func hasJSONFragments(results []*multiplexer.Result) bool {
+	for _, result := range results {
+		if result.Err == nil && isJSON(result.Header().Get("Content-Type")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setJSONFragments merges JSON fragment bodies into a single JSON object keyed
+// by fragment name, e.g. `{"header": {...}, "sidebar": {...}}`. Failed
+// optional fragments use their fallback, or null without one. An error is
+// returned when a fragment isn't JSON, its body is malformed, or two
+// fragments share a name.
+func (rb *responseBuilder) setJSONFragments(fragments []*Fragment, results []*multiplexer.Result) error {
+	merged := make(map[string]json.RawMessage, len(results))
+
+	for i, result := range results {
+		name := fragments[i].Name()
+		if _, ok := merged[name]; ok {
+			return fmt.Errorf("multiple JSON fragments are named %q", name)
+		}
+
+		body := result.Body
+		if result.Err != nil {
+			rb.server.Logger.Warnf("Optional fragment %s failed, rendering fallback: %v", result.Url, result.Err)
+
+			body = []byte(fragments[i].Fallback)
+			if len(body) == 0 {
+				body = []byte("null")
+			}
+		} else if contentType := result.Header().Get("Content-Type"); !isJSON(contentType) {
+			return fmt.Errorf("fragment %s has content type %q, but other fragments are JSON", result.Url, contentType)
+		}
+
+		if !json.Valid(body) {
+			return fmt.Errorf("fragment %s returned malformed JSON", result.Url)
+		}
+
+		merged[name] = body
+	}
+
+	body, err := json.Marshal(merged)
+	if err != nil {
+		return fmt.Errorf("could not merge JSON fragments: %w", err)
+	}
+
+	rb.body = body
+	rb.writer.Header().Set("Content-Type", "application/json")
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package viewproxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer/multiplexertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONFragments(t *testing.T) {
+	jsonHeader := http.Header{"Content-Type": []string{"application/json; charset=utf-8"}}
+
+	transport := multiplexertest.NewTransport()
+	transport.Add("http://views.internal/user", multiplexertest.Response{Header: jsonHeader, Body: `{"login": "octocat"}`})
+	transport.Add("http://views.internal/repos", multiplexertest.Response{Header: jsonHeader, Body: `[{"name": "hello-world"}]`})
+	transport.Add("http://views.internal/malformed", multiplexertest.Response{Header: jsonHeader, Body: `{"login":`})
+	transport.Add("http://views.internal/html", multiplexertest.Response{Header: http.Header{"Content-Type": []string{"text/html"}}, Body: "<p>hi</p>"})
+	transport.Add("http://views.internal/broken", multiplexertest.Response{StatusCode: http.StatusInternalServerError})
+
+	tests := map[string]struct {
+		fragments    []*Fragment
+		expectedCode int
+		expectedBody string
+	}{
+		"merged by name": {
+			fragments:    []*Fragment{NewFragment("/user"), NewFragmentWithMetadata("/repos", map[string]string{"name": "repositories"})},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"repositories":[{"name":"hello-world"}],"user":{"login":"octocat"}}`,
+		},
+		"optional fragment fallback": {
+			fragments: []*Fragment{
+				NewFragment("/user"),
+				func() *Fragment {
+					f := NewFragment("/broken")
+					f.Optional = true
+					return f
+				}(),
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"broken":null,"user":{"login":"octocat"}}`,
+		},
+		"malformed JSON": {
+			fragments:    []*Fragment{NewFragment("/user"), NewFragment("/malformed")},
+			expectedCode: http.StatusBadGateway,
+		},
+		"mixed content types": {
+			fragments:    []*Fragment{NewFragment("/user"), NewFragment("/html")},
+			expectedCode: http.StatusBadGateway,
+		},
+		"duplicate names": {
+			fragments:    []*Fragment{NewFragment("/user"), NewFragmentWithMetadata("/repos", map[string]string{"name": "user"})},
+			expectedCode: http.StatusBadGateway,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer("http://views.internal")
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.HttpTransport = transport
+			viewProxyServer.MergeJSONFragments = true
+			viewProxyServer.Get("/api", nil, tc.fragments)
+
+			r := httptest.NewRequest("GET", "/api", nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.expectedCode, w.Code)
+			if tc.expectedCode == http.StatusOK {
+				assert.Equal(t, tc.expectedBody, w.Body.String())
+				assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestHTMLFragmentsWithoutLayoutAreConcatenated(t *testing.T) {
+	transport := multiplexertest.NewTransport()
+	transport.Add("http://views.internal/header", multiplexertest.Response{Body: "<header>"})
+	transport.Add("http://views.internal/footer", multiplexertest.Response{Body: "<footer>"})
+
+	viewProxyServer := NewServer("http://views.internal")
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.HttpTransport = transport
+	viewProxyServer.MergeJSONFragments = true
+	viewProxyServer.Get("/page", nil, []*Fragment{NewFragment("/header"), NewFragment("/footer")})
+
+	r := httptest.NewRequest("GET", "/page", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "<header><footer>", w.Body.String())
+}
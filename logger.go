@@ -0,0 +1,40 @@
+package viewproxy
+
+import (
+	"log"
+)
+
+// Logger is the leveled logger used by the server. Implement it to adapt
+// structured loggers like zap or zerolog.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+type stdLogger struct {
+	logger *log.Logger
+}
+
+// NewStdLogger adapts a standard library logger to Logger. Every level is
+// written to the underlying logger.
+func NewStdLogger(l *log.Logger) Logger {
+	return &stdLogger{logger: l}
+}
+
+func (l *stdLogger) Debugf(format string, v ...interface{}) {
+	l.logger.Printf(format, v...)
+}
+
+func (l *stdLogger) Infof(format string, v ...interface{}) {
+	l.logger.Printf(format, v...)
+}
+
+func (l *stdLogger) Warnf(format string, v ...interface{}) {
+	l.logger.Printf(format, v...)
+}
+
+func (l *stdLogger) Errorf(format string, v ...interface{}) {
+	l.logger.Printf(format, v...)
+}
@@ -0,0 +1,21 @@
+package viewproxy
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStdLogger(t *testing.T) {
+	var logs bytes.Buffer
+	logger := NewStdLogger(log.New(&logs, "", 0))
+
+	logger.Debugf("debug %d", 1)
+	logger.Infof("info %d", 2)
+	logger.Warnf("warn %d", 3)
+	logger.Errorf("error %d", 4)
+
+	assert.Equal(t, "debug 1\ninfo 2\nwarn 3\nerror 4\n", logs.String())
+}
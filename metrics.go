@@ -0,0 +1,149 @@
+package viewproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+// The histogram buckets, in seconds, used for request and fragment latency.
+var metricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Metrics collects request and fragment metrics for a server and exposes them
+// in the Prometheus text format via Server.MetricsHandler. Requests are
+// labeled by route pattern and fragments by path to keep cardinality bounded.
+type Metrics struct {
+	mu        sync.Mutex
+	inFlight  int64
+	requests  map[string]*histogram
+	fragments map[string]*histogram
+}
+
+type histogram struct {
+	labels  string
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[string]*histogram),
+		fragments: make(map[string]*histogram),
+	}
+}
+
+func (m *Metrics) requestStarted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.inFlight++
+}
+
+func (m *Metrics) requestFinished(route string, method string, statusCode int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.inFlight--
+	m.observe(m.requests, duration, "route", route, "method", method, "status", strconv.Itoa(statusCode))
+}
+
+// fragmentFetched records a layout or fragment fetch. Failures without a
+// response are recorded with an `error` status.
+func (m *Metrics) fragmentFetched(path string, result *multiplexer.Result, err error) {
+	status := "error"
+	var duration time.Duration
+
+	var resultErr *multiplexer.ResultError
+	if err == nil {
+		status = strconv.Itoa(result.StatusCode)
+		duration = result.Duration
+	} else if errors.As(err, &resultErr) {
+		status = strconv.Itoa(resultErr.StatusCode())
+		duration = resultErr.Result.Duration
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.observe(m.fragments, duration, "fragment", path, "status", status)
+}
+
+func (m *Metrics) observe(histograms map[string]*histogram, duration time.Duration, labelPairs ...string) {
+	labels := make([]string, 0, len(labelPairs)/2)
+	for i := 0; i < len(labelPairs); i += 2 {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, labelPairs[i], labelValueEscaper.Replace(labelPairs[i+1])))
+	}
+	key := strings.Join(labels, ",")
+
+	h, ok := histograms[key]
+	if !ok {
+		h = &histogram{labels: key, buckets: make([]uint64, len(metricsBuckets))}
+		histograms[key] = h
+	}
+
+	seconds := duration.Seconds()
+	for i, bound := range metricsBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// MetricsHandler returns a handler that writes the server's metrics in the
+// Prometheus text format. Nothing is written when Metrics isn't set.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		if s.Metrics != nil {
+			s.Metrics.write(w)
+		}
+	})
+}
+
+func (m *Metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP viewproxy_requests_in_flight Requests currently being served.")
+	fmt.Fprintln(w, "# TYPE viewproxy_requests_in_flight gauge")
+	fmt.Fprintf(w, "viewproxy_requests_in_flight %d\n", m.inFlight)
+
+	writeHistograms(w, "viewproxy_request_duration_seconds", "Request latency by route, method, and status.", m.requests)
+	writeHistograms(w, "viewproxy_fragment_duration_seconds", "Layout and fragment fetch latency by fragment path and status.", m.fragments)
+}
+
+func writeHistograms(w io.Writer, name string, help string, histograms map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+
+	keys := make([]string, 0, len(histograms))
+	for key := range histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		h := histograms[key]
+
+		for i, bound := range metricsBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, h.labels, strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, h.labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, h.labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, h.labels, h.count)
+	}
+}
@@ -0,0 +1,45 @@
+package viewproxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	viewProxyServer := NewServer(targetServer.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.Metrics = NewMetrics()
+	viewProxyServer.Get("/hello/:name", NewFragment("/layouts/test_layout"), []*Fragment{NewFragment("/body"), NewFragment("/body")})
+	viewProxyServer.Get("/broken/:name", NewFragment("/layouts/test_layout"), []*Fragment{NewFragment("/oops")})
+
+	for _, path := range []string{"/hello/world", "/hello/you", "/broken/world", "/missing"} {
+		viewProxyServer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	viewProxyServer.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	assert.Contains(t, body, "viewproxy_requests_in_flight 0\n")
+	assert.Contains(t, body, "# TYPE viewproxy_request_duration_seconds histogram\n")
+	assert.Contains(t, body, `viewproxy_request_duration_seconds_count{route="/hello/:name",method="GET",status="200"} 2`)
+	assert.Contains(t, body, `viewproxy_request_duration_seconds_count{route="/broken/:name",method="GET",status="500"} 1`)
+	assert.Contains(t, body, `viewproxy_request_duration_seconds_count{route="",method="GET",status="404"} 1`)
+	assert.Contains(t, body, `viewproxy_request_duration_seconds_bucket{route="/hello/:name",method="GET",status="200",le="+Inf"} 2`)
+	assert.Contains(t, body, `viewproxy_fragment_duration_seconds_count{fragment="/body",status="200"} 2`)
+	assert.Contains(t, body, `viewproxy_fragment_duration_seconds_count{fragment="/oops",status="500"} 1`)
+	assert.NotContains(t, body, "/hello/world")
+}
+
+func TestMetricsHandlerWithoutMetrics(t *testing.T) {
+	viewProxyServer := NewServer(targetServer.URL)
+
+	w := httptest.NewRecorder()
+	viewProxyServer.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, "", w.Body.String())
+}
@@ -0,0 +1,66 @@
+package viewproxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// Use adds middleware that wraps the server's request handling. Middleware is
+// applied in the order it is added, so the first middleware added sees the
+// request first and can short-circuit it before any fragments are fetched.
+func (s *Server) Use(middleware func(http.Handler) http.Handler) {
+	s.middleware = append(s.middleware, middleware)
+}
+
+// handler returns the server wrapped in its middleware. The request context
+// gets a placeholder for the matched route first so middleware can read it
+// with RouteFromContext once the request has been served.
+func (s *Server) handler() http.Handler {
+	var handler http.Handler = s
+
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		handler = s.middleware[i](handler)
+	}
+
+	if len(s.middleware) == 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, _ := withRouteMatch(r.Context())
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestLogger returns middleware that logs the method, path, status, and
+// duration of every request.
+func RequestLogger(l Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+
+			next.ServeHTTP(recorder, r)
+
+			l.Infof("%s %s %d in %v", r.Method, r.URL.Path, recorder.statusCode, time.Since(start))
+		})
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (sr *statusRecorder) WriteHeader(statusCode int) {
+	sr.statusCode = statusCode
+	sr.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Flush flushes the underlying writer, if it supports flushing, so streamed
+// responses work through middleware.
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
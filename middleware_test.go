@@ -0,0 +1,83 @@
+package viewproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+	calls := make([]string, 0)
+	tracking := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, name+" before")
+				next.ServeHTTP(w, r)
+				calls = append(calls, name+" after")
+			})
+		}
+	}
+
+	viewProxyServer := NewServer(targetServer.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.PreRequest = func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "server")
+	}
+	viewProxyServer.Use(tracking("first"))
+	viewProxyServer.Use(tracking("second"))
+
+	r := httptest.NewRequest("GET", "/missing", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.handler().ServeHTTP(w, r)
+
+	assert.Equal(t, []string{"first before", "second before", "server", "second after", "first after"}, calls)
+}
+
+func TestMiddlewareCanShortCircuit(t *testing.T) {
+	requested := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{})
+	viewProxyServer.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.handler().ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+	assert.False(t, requested, "Expected fragments to not be requested")
+}
+
+func TestRequestLogger(t *testing.T) {
+	var logs bytes.Buffer
+
+	viewProxyServer := NewServer(targetServer.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.Use(RequestLogger(NewStdLogger(log.New(&logs, "", 0))))
+
+	r := httptest.NewRequest("GET", "/missing", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.handler().ServeHTTP(w, r)
+
+	assert.Regexp(t, `^GET /missing 404 in \S+\n$`, logs.String())
+}
@@ -0,0 +1,80 @@
+package viewproxy
+
+import (
+	"bytes"
+	"mime"
+)
+
+// Elements whose content is copied as-is when minifying, since whitespace
+// inside them is significant or they aren't HTML.
+var preservedElements = []string{"pre", "textarea", "script", "style"}
+
+// isHTML returns true when contentType is text/html.
+func isHTML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	return err == nil && mediaType == "text/html"
+}
+
+// minifyHTML collapses runs of whitespace into a single space and removes
+// comments, other than conditional comments, leaving the contents of
+// preserved elements untouched.
+func minifyHTML(html []byte) []byte {
+	output := make([]byte, 0, len(html))
+
+	for i := 0; i < len(html); {
+		switch {
+		case bytes.HasPrefix(html[i:], []byte("<!--")) && !bytes.HasPrefix(html[i:], []byte("<!--[if")):
+			end := bytes.Index(html[i+4:], []byte("-->"))
+			if end == -1 {
+				return append(output, html[i:]...)
+			}
+
+			i += 4 + end + 3
+		case html[i] == '<':
+			name := preservedElement(html[i+1:])
+			if name == "" {
+				output = append(output, html[i])
+				i++
+				continue
+			}
+
+			end := bytes.Index(bytes.ToLower(html[i:]), []byte("</"+name))
+			if end == -1 {
+				return append(output, html[i:]...)
+			}
+
+			output = append(output, html[i:i+end]...)
+			i += end
+		case isHTMLSpace(html[i]):
+			for i < len(html) && isHTMLSpace(html[i]) {
+				i++
+			}
+
+			output = append(output, ' ')
+		default:
+			output = append(output, html[i])
+			i++
+		}
+	}
+
+	return output
+}
+
+// preservedElement returns the name of the preserved element opened by the
+// tag starting at tag, or an empty string.
+func preservedElement(tag []byte) string {
+	for _, name := range preservedElements {
+		if len(tag) > len(name) && bytes.EqualFold(tag[:len(name)], []byte(name)) {
+			if next := tag[len(name)]; next == '>' || next == '/' || isHTMLSpace(next) {
+				return name
+			}
+		}
+	}
+
+	return ""
+}
+
+func isHTMLSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f'
+}
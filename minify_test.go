@@ -0,0 +1,71 @@
+package viewproxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMinifyHTML(t *testing.T) {
+	tests := map[string]struct {
+		html string
+		want string
+	}{
+		"whitespace":          {html: "<div>\n  <p>hello   world</p>\n</div>\n", want: "<div> <p>hello world</p> </div> "},
+		"comments":            {html: "<div><!-- secret --><!--\nmultiline\n--></div>", want: "<div></div>"},
+		"conditional comment": {html: "<!--[if IE]><p>IE</p><![endif]-->", want: "<!--[if IE]><p>IE</p><![endif]-->"},
+		"pre":                 {html: "<pre>\n  a\n    b\n</pre>  <p>\n</p>", want: "<pre>\n  a\n    b\n</pre> <p> </p>"},
+		"textarea":            {html: "<TEXTAREA name=x>  <!-- kept -->  </TEXTAREA>", want: "<TEXTAREA name=x>  <!-- kept -->  </TEXTAREA>"},
+		"script":              {html: "<script>\n  var a = '<!-- not a comment -->';\n</script>", want: "<script>\n  var a = '<!-- not a comment -->';\n</script>"},
+		"style":               {html: "<style>\n  p  { color: red }\n</style>", want: "<style>\n  p  { color: red }\n</style>"},
+		"similar tag name":    {html: "<preview>\n  a\n</preview>", want: "<preview> a </preview>"},
+		"unterminated":        {html: "<p>a</p>  <script>\n  var a;", want: "<p>a</p> <script>\n  var a;"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, string(minifyHTML([]byte(tc.html))))
+		})
+	}
+}
+
+func TestMinifyHTMLResponses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/json" {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+
+		w.Write([]byte("<p>\n  hello\n</p>"))
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		minifyHTML bool
+		layout     string
+		want       string
+	}{
+		"html":     {minifyHTML: true, layout: "/html", want: "<p> hello </p>"},
+		"not html": {minifyHTML: true, layout: "/json", want: "<p>\n  hello\n</p>"},
+		"disabled": {minifyHTML: false, layout: "/html", want: "<p>\n  hello\n</p>"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.MinifyHTML = tc.minifyHTML
+			viewProxyServer.Get("/hello/:name", NewFragment(tc.layout), []*Fragment{})
+
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, httptest.NewRequest("GET", "/hello/world", nil))
+
+			assert.Equal(t, tc.want, w.Body.String())
+		})
+	}
+}
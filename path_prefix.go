@@ -0,0 +1,46 @@
+package viewproxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// stripPathPrefix returns r with PathPrefix removed from its path, e.g.
+// `/app/users/1` becomes `/users/1`, and false when r's path isn't under
+// PathPrefix.
+func (s *Server) stripPathPrefix(r *http.Request) (*http.Request, bool) {
+	prefix := strings.TrimRight(s.PathPrefix, "/")
+	if prefix == "" {
+		return r, true
+	}
+
+	path := r.URL.Path
+	if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+		return r, false
+	}
+
+	stripped := new(http.Request)
+	*stripped = *r
+	stripped.URL = new(url.URL)
+	*stripped.URL = *r.URL
+	stripped.URL.Path = "/" + strings.TrimLeft(strings.TrimPrefix(path, prefix), "/")
+	stripped.URL.RawPath = ""
+	if r.URL.RawPath != "" {
+		if rawPath := strings.TrimPrefix(r.URL.RawPath, prefix); rawPath != r.URL.RawPath {
+			stripped.URL.RawPath = "/" + strings.TrimLeft(rawPath, "/")
+		}
+	}
+
+	return stripped, true
+}
+
+// withPathPrefix returns path under PathPrefix, for paths sent back to the
+// client like redirects.
+func (s *Server) withPathPrefix(path string) string {
+	if strings.TrimRight(s.PathPrefix, "/") == "" {
+		return path
+	}
+
+	return joinPaths(s.PathPrefix, path)
+}
@@ -0,0 +1,68 @@
+package viewproxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer/multiplexertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathPrefix(t *testing.T) {
+	transport := multiplexertest.NewTransport()
+	transport.Add("http://views.internal/views/layout", multiplexertest.Response{Body: "<body>{{{VIEW_PROXY_CONTENT}}}</body>"})
+	transport.Add("http://views.internal/views/users/42/header", multiplexertest.Response{Body: "user 42"})
+
+	viewProxyServer := NewServer("http://views.internal")
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.HttpTransport = transport
+	viewProxyServer.PathPrefix = "/app/"
+	viewProxyServer.UpstreamPathPrefix = "/views"
+	viewProxyServer.TrailingSlash = TrailingSlashRedirect
+	viewProxyServer.GetWithOptions("/users/:id", NewFragment("/layout"), []*Fragment{NewFragment("/users/:id/header")}, RouteOptions{Name: "user"})
+
+	tests := map[string]struct {
+		path             string
+		expectedCode     int
+		expectedBody     string
+		expectedLocation string
+	}{
+		"prefixed route":          {path: "/app/users/42?tab=repos", expectedCode: http.StatusOK, expectedBody: "<body>user 42</body>"},
+		"unprefixed route":        {path: "/users/42", expectedCode: http.StatusNotFound, expectedBody: "404 not found"},
+		"partial prefix":          {path: "/apple/users/42", expectedCode: http.StatusNotFound, expectedBody: "404 not found"},
+		"prefix only":             {path: "/app", expectedCode: http.StatusNotFound, expectedBody: "404 not found"},
+		"trailing slash redirect": {path: "/app/users/42/", expectedCode: http.StatusMovedPermanently, expectedLocation: "/app/users/42"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tc.path, nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.expectedCode, w.Code)
+			if tc.expectedBody != "" {
+				assert.Equal(t, tc.expectedBody, w.Body.String())
+			}
+			assert.Equal(t, tc.expectedLocation, w.Header().Get("Location"))
+		})
+	}
+
+	requests := make(map[string]*http.Request)
+	for _, req := range transport.Requests() {
+		requests[req.URL.Path] = req
+	}
+	assert.Len(t, requests, 2)
+	assert.Contains(t, requests, "/views/users/42/header")
+	if assert.Contains(t, requests, "/views/layout") {
+		assert.Equal(t, "42", requests["/views/layout"].URL.Query().Get("id"))
+		assert.Equal(t, "repos", requests["/views/layout"].URL.Query().Get("tab"))
+	}
+
+	url, err := viewProxyServer.URLFor("user", map[string]string{"id": "7"})
+	assert.Nil(t, err)
+	assert.Equal(t, "/app/users/7", url)
+}
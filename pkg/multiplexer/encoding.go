@@ -0,0 +1,100 @@
+package multiplexer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+)
+
+// acceptEncoding is the Accept-Encoding header sent with every request,
+// listing the content codings decodeBody supports. Setting it explicitly also
+// disables the transport's transparent gzip handling, so bodies are only ever
+// decoded once, here, whichever coding the target picks.
+const acceptEncoding = "gzip, deflate"
+
+// contentEncodings returns the content codings listed in a Content-Encoding
+// header value in the order they were applied. Codings are lowercased and
+// no-op values like `identity` are omitted.
+func contentEncodings(value string) []string {
+	encodings := make([]string, 0)
+
+	for _, encoding := range strings.Split(value, ",") {
+		encoding = strings.ToLower(strings.TrimSpace(encoding))
+
+		switch encoding {
+		case "", "identity", "chunked":
+			continue
+		case "x-gzip":
+			encoding = "gzip"
+		}
+
+		encodings = append(encodings, encoding)
+	}
+
+	return encodings
+}
+
+// CanDecode returns true when every content coding in the given
+// Content-Encoding header value can be decoded by the multiplexer, meaning
+// result bodies using it are returned decoded.
+func CanDecode(value string) bool {
+	encodings := contentEncodings(value)
+	if len(encodings) == 0 {
+		return false
+	}
+
+	for _, encoding := range encodings {
+		if encoding != "gzip" && encoding != "deflate" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// decodeBody wraps body with a decoder for each content coding in the given
+// Content-Encoding header value, in the reverse order they were applied.
+// Bodies using unsupported codings are returned as-is.
+func decodeBody(body io.Reader, value string) (io.Reader, error) {
+	if !CanDecode(value) {
+		return body, nil
+	}
+
+	encodings := contentEncodings(value)
+	reader := body
+
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var err error
+
+		switch encodings[i] {
+		case "gzip":
+			reader, err = gzip.NewReader(reader)
+		case "deflate":
+			reader, err = zlib.NewReader(reader)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return reader, nil
+}
+
+// gzipBody returns body compressed with gzip.
+func gzipBody(body []byte) ([]byte, error) {
+	var b bytes.Buffer
+	writer := gzip.NewWriter(&b)
+
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
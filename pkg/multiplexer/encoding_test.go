@@ -0,0 +1,102 @@
+package multiplexer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentEncodingDecoding(t *testing.T) {
+	tests := map[string]struct {
+		contentEncoding string
+		encode          func([]byte) []byte
+	}{
+		"gzip":          {contentEncoding: "gzip", encode: gzipBytes},
+		"uppercase":     {contentEncoding: "GZIP", encode: gzipBytes},
+		"padded":        {contentEncoding: " gzip ", encode: gzipBytes},
+		"x-gzip":        {contentEncoding: "x-gzip", encode: gzipBytes},
+		"with identity": {contentEncoding: "identity, gzip", encode: gzipBytes},
+		"deflate":       {contentEncoding: "deflate", encode: deflateBytes},
+		"layered": {
+			contentEncoding: "deflate, Gzip",
+			encode:          func(b []byte) []byte { return gzipBytes(deflateBytes(b)) },
+		},
+		"unsupported": {
+			contentEncoding: "br",
+			encode:          func(b []byte) []byte { return b },
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var acceptEncoding string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				acceptEncoding = r.Header.Get("Accept-Encoding")
+				w.Header().Set("Content-Encoding", tc.contentEncoding)
+				w.Write(tc.encode([]byte("hello world")))
+			}))
+			defer server.Close()
+
+			r := NewRequest()
+			// Forwarded from a client that accepts codings we can't decode
+			r.Header.Set("Accept-Encoding", "br, gzip")
+			r.WithFragment(server.URL, make(map[string]string))
+			results, err := r.Do(context.Background())
+
+			assert.Nil(t, err)
+			assert.Equal(t, "gzip, deflate", acceptEncoding)
+			assert.Equal(t, "hello world", string(results[0].Body))
+		})
+	}
+}
+
+func TestEncodedResponsesWithoutBodies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gzipBytes([]byte("hello world")))
+	}))
+	defer server.Close()
+
+	r := NewRequest()
+	r.WithFragment(server.URL, make(map[string]string))
+	r.WithFragmentBody(0, http.MethodHead, nil)
+	results, err := r.Do(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, "gzip", results[0].Header().Get("Content-Encoding"))
+	assert.Equal(t, "", string(results[0].Body))
+}
+
+func TestCanDecode(t *testing.T) {
+	assert.True(t, CanDecode("gzip"))
+	assert.True(t, CanDecode("GZIP"))
+	assert.True(t, CanDecode("deflate, gzip"))
+	assert.False(t, CanDecode(""))
+	assert.False(t, CanDecode("identity"))
+	assert.False(t, CanDecode("br"))
+	assert.False(t, CanDecode("gzip, br"))
+}
+
+func gzipBytes(b []byte) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write(b)
+	writer.Close()
+
+	return buffer.Bytes()
+}
+
+func deflateBytes(b []byte) []byte {
+	var buffer bytes.Buffer
+	writer := zlib.NewWriter(&buffer)
+	writer.Write(b)
+	writer.Close()
+
+	return buffer.Bytes()
+}
@@ -0,0 +1,66 @@
+package multiplexer
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ErrorKind classifies why a fetch failed.
+type ErrorKind int
+
+const (
+	// The connection to the target failed, e.g. it was refused or the TLS
+	// handshake failed.
+	KindConnection ErrorKind = iota
+	// The fetch didn't finish before Timeout or the context's deadline.
+	KindTimeout
+	// The target responded with an unsuccessful status. The FetchError wraps
+	// a ResultError with the response.
+	KindHTTP
+	// The response body couldn't be read or decoded, or the request body
+	// couldn't be compressed.
+	KindBody
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case KindTimeout:
+		return "timeout"
+	case KindHTTP:
+		return "http"
+	case KindBody:
+		return "body"
+	default:
+		return "connection"
+	}
+}
+
+// FetchError is returned when a layout or fragment can't be fetched, with
+// Kind classifying why so callers can tell a timeout from a refused
+// connection or an unsuccessful status. The underlying error is available
+// through errors.Is and errors.As.
+type FetchError struct {
+	Kind ErrorKind
+	Url  string
+	Err  error
+}
+
+func (fe *FetchError) Error() string {
+	return fe.Err.Error()
+}
+
+func (fe *FetchError) Unwrap() error {
+	return fe.Err
+}
+
+// newFetchError returns a FetchError for err fetching url, classified as kind
+// unless err is a timeout.
+func newFetchError(kind ErrorKind, url string, err error) *FetchError {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		kind = KindTimeout
+	}
+
+	return &FetchError{Kind: kind, Url: url, Err: err}
+}
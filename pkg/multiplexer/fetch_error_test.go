@@ -0,0 +1,76 @@
+package multiplexer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchErrorKinds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		case "/broken":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/corrupt":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write([]byte("not gzip"))
+		}
+	}))
+	defer server.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	refusedURL := "http://" + listener.Addr().String() + "/refused"
+	listener.Close()
+
+	tests := map[string]struct {
+		url          string
+		expectedKind ErrorKind
+	}{
+		"timeout":    {url: server.URL + "/slow", expectedKind: KindTimeout},
+		"connection": {url: refusedURL, expectedKind: KindConnection},
+		"http":       {url: server.URL + "/broken", expectedKind: KindHTTP},
+		"body":       {url: server.URL + "/corrupt", expectedKind: KindBody},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := NewRequest()
+			r.Timeout = 20 * time.Millisecond
+			r.WithFragment(tc.url, make(map[string]string))
+
+			_, err := r.Do(context.Background())
+
+			var fetchErr *FetchError
+			if assert.True(t, errors.As(err, &fetchErr), "expected a FetchError, got %v", err) {
+				assert.Equal(t, tc.expectedKind, fetchErr.Kind, fetchErr.Kind.String())
+			}
+		})
+	}
+}
+
+func TestFetchErrorWrapsResultError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	r := NewRequest()
+	r.Timeout = defaultTimeout
+	r.WithFragment(server.URL+"/missing", make(map[string]string))
+
+	_, err := r.Do(context.Background())
+
+	var resultErr *ResultError
+	assert.True(t, errors.As(err, &resultErr))
+	assert.Equal(t, http.StatusNotFound, resultErr.StatusCode())
+	assert.EqualError(t, err, "status: 404 url: "+server.URL+"/missing")
+}
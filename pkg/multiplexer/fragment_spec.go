@@ -0,0 +1,106 @@
+package multiplexer
+
+import "net/http"
+
+// FragmentSpec describes a fragment added with WithFragments, combining the
+// options of WithFragment, WithOptionalFragment, WithFragmentBody,
+// WithFragmentSuccessStatus, and WithFragmentHeader.
+type FragmentSpec struct {
+	Url      string
+	Metadata map[string]string
+	// Doesn't fail the request when the fragment can't be fetched, like
+	// WithOptionalFragment.
+	Optional bool
+	// The method and body the fragment is fetched with. Defaults to a GET
+	// without a body when Method is empty.
+	Method string
+	Body   []byte
+	// Overrides Request.SuccessStatus for this fragment when set.
+	SuccessStatus func(statusCode int) bool
+	// Sent with this fragment, replacing Request.Header values of the same
+	// name.
+	Header http.Header
+}
+
+// WithFragments adds a fragment for each spec, in order, so the index of a
+// spec is its index in the results after any previously added fragments.
+func (r *Request) WithFragments(specs []FragmentSpec) {
+	for _, spec := range specs {
+		r.fragments = append(r.fragments, fragment{
+			url:           spec.Url,
+			metadata:      spec.Metadata,
+			optional:      spec.Optional,
+			method:        spec.Method,
+			body:          spec.Body,
+			successStatus: spec.SuccessStatus,
+			header:        spec.Header,
+		})
+	}
+}
+
+// FragmentBatch builds specs for WithFragments that share metadata and
+// headers, e.g.
+// `NewFragmentBatch().Metadata(shared).Add(header).Add(footer).Specs()`.
+type FragmentBatch struct {
+	metadata map[string]string
+	header   http.Header
+	specs    []FragmentSpec
+}
+
+func NewFragmentBatch() *FragmentBatch {
+	return &FragmentBatch{}
+}
+
+// Metadata is added to every spec in the batch. A spec's own metadata takes
+// precedence over it.
+func (b *FragmentBatch) Metadata(metadata map[string]string) *FragmentBatch {
+	b.metadata = metadata
+	return b
+}
+
+// Header is sent with every spec in the batch. A spec's own header values
+// replace values of the same name.
+func (b *FragmentBatch) Header(header http.Header) *FragmentBatch {
+	b.header = header
+	return b
+}
+
+// Add appends spec to the batch.
+func (b *FragmentBatch) Add(spec FragmentSpec) *FragmentBatch {
+	b.specs = append(b.specs, spec)
+	return b
+}
+
+// Specs returns the batch's specs in the order they were added, with the
+// shared metadata and headers applied.
+func (b *FragmentBatch) Specs() []FragmentSpec {
+	specs := make([]FragmentSpec, len(b.specs))
+
+	for i, spec := range b.specs {
+		if len(b.metadata) > 0 {
+			metadata := make(map[string]string, len(b.metadata)+len(spec.Metadata))
+			for key, value := range b.metadata {
+				metadata[key] = value
+			}
+			for key, value := range spec.Metadata {
+				metadata[key] = value
+			}
+			spec.Metadata = metadata
+		}
+
+		if len(b.header) > 0 {
+			header := b.header.Clone()
+			for name, values := range spec.Header {
+				header.Del(name)
+				for _, value := range values {
+					header.Add(name, value)
+				}
+			}
+			spec.Header = header
+		}
+
+		specs[i] = spec
+	}
+
+	return specs
+}
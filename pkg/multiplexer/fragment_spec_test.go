@@ -0,0 +1,67 @@
+package multiplexer
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer/multiplexertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithFragmentsPreservesOrder(t *testing.T) {
+	transport := multiplexertest.NewTransport()
+	transport.Add("http://views.internal/header", multiplexertest.Response{Body: "header"})
+	transport.Add("http://views.internal/form", multiplexertest.Response{Body: "form"})
+	transport.Add("http://views.internal/missing", multiplexertest.Response{StatusCode: http.StatusNotFound})
+	transport.Add("http://views.internal/footer", multiplexertest.Response{Body: "footer"})
+
+	r := NewRequest()
+	r.Timeout = defaultTimeout
+	r.Transport = transport
+	r.WithFragment("http://views.internal/header", map[string]string{})
+	r.WithFragments([]FragmentSpec{
+		{Url: "http://views.internal/form", Method: http.MethodPost, Body: []byte("name=world")},
+		{Url: "http://views.internal/missing", Optional: true},
+		{Url: "http://views.internal/footer", Header: http.Header{"Accept": []string{"text/plain"}}},
+	})
+
+	results, err := r.Do(context.Background())
+	assert.Nil(t, err)
+
+	bodies := make([]string, len(results))
+	for i, result := range results {
+		bodies[i] = string(result.Body)
+	}
+	assert.Equal(t, []string{"header", "form", "", "footer"}, bodies)
+	assert.NotNil(t, results[2].Err)
+
+	requests := make(map[string]*http.Request)
+	for _, req := range transport.Requests() {
+		requests[req.URL.Path] = req
+	}
+
+	assert.Equal(t, http.MethodPost, requests["/form"].Method)
+	assert.Equal(t, "text/plain", requests["/footer"].Header.Get("Accept"))
+	assert.Empty(t, requests["/header"].Header.Get("Accept"))
+}
+
+func TestFragmentBatchAppliesSharedDefaults(t *testing.T) {
+	specs := NewFragmentBatch().
+		Metadata(map[string]string{"team": "views", "name": "default"}).
+		Header(http.Header{"Accept": []string{"text/html"}, "X-Shared": []string{"1"}}).
+		Add(FragmentSpec{Url: "/header", Metadata: map[string]string{"name": "header"}}).
+		Add(FragmentSpec{Url: "/data", Header: http.Header{"accept": []string{"application/json"}}}).
+		Specs()
+
+	assert.Len(t, specs, 2)
+
+	assert.Equal(t, "/header", specs[0].Url)
+	assert.Equal(t, map[string]string{"team": "views", "name": "header"}, specs[0].Metadata)
+	assert.Equal(t, "text/html", specs[0].Header.Get("Accept"))
+
+	assert.Equal(t, "/data", specs[1].Url)
+	assert.Equal(t, map[string]string{"team": "views", "name": "default"}, specs[1].Metadata)
+	assert.Equal(t, []string{"application/json"}, specs[1].Header.Values("Accept"))
+	assert.Equal(t, "1", specs[1].Header.Get("X-Shared"))
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 )
 
 // Hop-by-hop headers defined here: https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers
@@ -13,12 +14,12 @@ var HopByHopHeaders []string = []string{
 	"Proxy-Authenticate",
 	"Proxy-Authorization",
 	"TE",
+	"Trailer",
 	"Trailers",
 	"Transfer-Encoding",
 	"Upgrade",
 }
 
-// TODO remove headers listed in the Connection header
 func HeadersFromRequest(req *http.Request) http.Header {
 	newHeaders := make(http.Header)
 
@@ -26,9 +27,7 @@ func HeadersFromRequest(req *http.Request) http.Header {
 		newHeaders[name] = values
 	}
 
-	for _, hopByHopHeader := range HopByHopHeaders {
-		newHeaders.Del(hopByHopHeader)
-	}
+	RemoveHopByHopHeaders(newHeaders)
 
 	// Set Forwarded-For headers since we act as a proxy
 	host := forwardedForFromRequest(req)
@@ -48,6 +47,49 @@ func HeadersFromRequest(req *http.Request) http.Header {
 	return newHeaders
 }
 
+// RemoveHopByHopHeaders deletes the standard hop-by-hop headers from header,
+// along with any headers named in its Connection header.
+func RemoveHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+
+	for _, hopByHopHeader := range HopByHopHeaders {
+		header.Del(hopByHopHeader)
+	}
+}
+
+// FilterCookies removes cookies from the Cookie header that aren't in names,
+// deleting the header entirely when no cookies remain.
+func FilterCookies(header http.Header, names []string) {
+	allowed := make(map[string]bool, len(names))
+	for _, name := range names {
+		allowed[name] = true
+	}
+
+	var cookies []string
+	for _, value := range header.Values("Cookie") {
+		for _, cookie := range strings.Split(value, ";") {
+			cookie = strings.TrimSpace(cookie)
+			name := strings.SplitN(cookie, "=", 2)[0]
+
+			if allowed[name] {
+				cookies = append(cookies, cookie)
+			}
+		}
+	}
+
+	if len(cookies) == 0 {
+		header.Del("Cookie")
+	} else {
+		header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+}
+
 func forwardedForFromRequest(req *http.Request) string {
 	host, _, err := net.SplitHostPort(req.RemoteAddr)
 
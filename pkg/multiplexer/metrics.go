@@ -0,0 +1,113 @@
+package multiplexer
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/unit"
+)
+
+// fetchMetrics records OpenTelemetry metrics for layout and fragment fetches
+// using the global meter provider. Until a meter provider is set the
+// instruments are no-ops.
+type fetchMetrics struct {
+	duration metric.Float64ValueRecorder
+	requests metric.Int64Counter
+	inFlight metric.Int64UpDownCounter
+}
+
+var (
+	sharedFetchMetricsOnce sync.Once
+	sharedFetchMetrics     *fetchMetrics
+)
+
+// loadFetchMetrics returns the multiplexer's instruments, creating them the
+// first time it's called. Instruments created before a meter provider is set
+// forward to it once it's set, so they only need to be created once.
+func loadFetchMetrics() *fetchMetrics {
+	sharedFetchMetricsOnce.Do(func() {
+		sharedFetchMetrics = createFetchMetrics(global.Meter("multiplexer"))
+	})
+
+	return sharedFetchMetrics
+}
+
+// createFetchMetrics creates the multiplexer's instruments with meter,
+// reporting an error to the OpenTelemetry error handler and returning nil
+// when they can't be created, in which case fetches aren't recorded.
+func createFetchMetrics(meter metric.Meter) *fetchMetrics {
+	metrics, err := newFetchMetrics(meter)
+	if err != nil {
+		otel.Handle(err)
+	}
+
+	return metrics
+}
+
+// newFetchMetrics creates the multiplexer's instruments with meter.
+func newFetchMetrics(meter metric.Meter) (*fetchMetrics, error) {
+	duration, err := meter.NewFloat64ValueRecorder(
+		"viewproxy.fetch.duration",
+		metric.WithDescription("The time taken to fetch a layout or fragment"),
+		metric.WithUnit(unit.Milliseconds),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not create fetch duration recorder: %w", err)
+	}
+
+	requests, err := meter.NewInt64Counter(
+		"viewproxy.fetch.requests",
+		metric.WithDescription("The number of layout and fragment fetches"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not create fetch requests counter: %w", err)
+	}
+
+	inFlight, err := meter.NewInt64UpDownCounter(
+		"viewproxy.fetch.in_flight",
+		metric.WithDescription("The number of layout and fragment fetches in progress"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not create fetch in flight counter: %w", err)
+	}
+
+	return &fetchMetrics{duration: duration, requests: requests, inFlight: inFlight}, nil
+}
+
+// started records the start of a fetch from target, returning a function
+// that records its outcome with the response's status code, or 0 when the
+// request failed. Nothing is recorded when m is nil.
+func (m *fetchMetrics) started(ctx context.Context, target *url.URL) func(statusCode int) {
+	if m == nil {
+		return func(int) {}
+	}
+
+	start := time.Now()
+	host := attribute.String("host", target.Host)
+	m.inFlight.Add(ctx, 1, host)
+
+	return func(statusCode int) {
+		status := attribute.String("status_class", statusClass(statusCode))
+
+		m.inFlight.Add(ctx, -1, host)
+		m.requests.Add(ctx, 1, host, status)
+		m.duration.Record(ctx, float64(time.Since(start))/float64(time.Millisecond), host, status)
+	}
+}
+
+// statusClass returns the class of statusCode, like `2xx`, or `error` when
+// there's no response, keeping the number of label values bounded.
+func statusClass(statusCode int) string {
+	if statusCode < 100 || statusCode > 599 {
+		return "error"
+	}
+
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
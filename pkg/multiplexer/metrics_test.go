@@ -0,0 +1,127 @@
+package multiplexer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/oteltest"
+)
+
+// Runs before TestFetchRecordsMetrics sets the global meter provider.
+func TestFetchMetricsAreNoopsWithoutMeterProvider(t *testing.T) {
+	metrics := loadFetchMetrics()
+	assert.NotNil(t, metrics)
+
+	finished := metrics.started(context.Background(), &url.URL{Host: "views.internal"})
+
+	assert.NotPanics(t, func() { finished(http.StatusOK) })
+}
+
+func TestFetchMetricsAreCreatedOnce(t *testing.T) {
+	assert.Same(t, loadFetchMetrics(), loadFetchMetrics())
+}
+
+func TestFetchMetricsReportInstrumentErrors(t *testing.T) {
+	meter := metric.WrapMeterImpl(failingMeterImpl{}, "multiplexer")
+
+	metrics, err := newFetchMetrics(meter)
+	assert.Nil(t, metrics)
+	assert.EqualError(t, err, "could not create fetch duration recorder: instruments unavailable")
+
+	otel.SetErrorHandler(testErrorHandler)
+
+	assert.Nil(t, createFetchMetrics(meter))
+	select {
+	case err := <-handledErrors:
+		assert.EqualError(t, err, "could not create fetch duration recorder: instruments unavailable")
+	default:
+		assert.Fail(t, "Expected the error to be reported to the OpenTelemetry error handler")
+	}
+
+	var nilMetrics *fetchMetrics
+	assert.NotPanics(t, func() { nilMetrics.started(context.Background(), &url.URL{Host: "views.internal"})(http.StatusOK) })
+}
+
+// The OpenTelemetry error handler can only be set once, so every run of
+// TestFetchMetricsReportInstrumentErrors uses the same handler.
+var handledErrors = make(chan error, 1)
+var testErrorHandler = errorHandlerFunc(func(err error) { handledErrors <- err })
+
+type errorHandlerFunc func(error)
+
+func (f errorHandlerFunc) Handle(err error) {
+	f(err)
+}
+
+type failingMeterImpl struct{}
+
+func (failingMeterImpl) RecordBatch(context.Context, []attribute.KeyValue, ...metric.Measurement) {}
+
+func (failingMeterImpl) NewSyncInstrument(metric.Descriptor) (metric.SyncImpl, error) {
+	return nil, errors.New("instruments unavailable")
+}
+
+func (failingMeterImpl) NewAsyncInstrument(metric.Descriptor, metric.AsyncRunner) (metric.AsyncImpl, error) {
+	return nil, errors.New("instruments unavailable")
+}
+
+// The fetch instruments are only created once, so every run of
+// TestFetchRecordsMetrics uses the same meter provider.
+var testMeter, testMeterProvider = oteltest.NewMeterProvider()
+
+func TestFetchRecordsMetrics(t *testing.T) {
+	global.SetMeterProvider(testMeterProvider)
+	recorded := len(testMeter.MeasurementBatches)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	host := attribute.String("host", server.Listener.Addr().String())
+
+	r := NewRequest()
+	r.Timeout = defaultTimeout
+	r.WithFragment(server.URL+"/layout", make(map[string]string))
+	r.WithOptionalFragment(server.URL+"/missing", make(map[string]string))
+	_, err := r.Do(context.Background())
+	assert.Nil(t, err)
+
+	counts := make(map[string]int64)
+	inFlight := int64(0)
+	durations := 0
+	for _, measured := range oteltest.AsStructs(testMeter.MeasurementBatches[recorded:]) {
+		assert.Equal(t, "multiplexer", measured.InstrumentationName)
+		assert.Equal(t, host.Value, measured.Labels[host.Key])
+
+		switch measured.Name {
+		case "viewproxy.fetch.requests":
+			counts[measured.Labels["status_class"].AsString()] += measured.Number.AsInt64()
+		case "viewproxy.fetch.in_flight":
+			inFlight += measured.Number.AsInt64()
+		case "viewproxy.fetch.duration":
+			durations++
+		}
+	}
+
+	assert.Equal(t, map[string]int64{"2xx": 1, "4xx": 1}, counts)
+	assert.Equal(t, int64(0), inFlight)
+	assert.Equal(t, 2, durations)
+}
+
+func TestStatusClass(t *testing.T) {
+	assert.Equal(t, "2xx", statusClass(http.StatusOK))
+	assert.Equal(t, "3xx", statusClass(http.StatusFound))
+	assert.Equal(t, "5xx", statusClass(http.StatusBadGateway))
+	assert.Equal(t, "error", statusClass(0))
+}
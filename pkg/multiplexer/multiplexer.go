@@ -1,28 +1,39 @@
 package multiplexer
 
 import (
-	"compress/gzip"
+	"bytes"
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
 )
 
 type fragment struct {
 	url      string
 	metadata map[string]string
+	optional bool
+	method   string
+	body     []byte
+	// Overrides Request.SuccessStatus for this fragment.
+	successStatus func(statusCode int) bool
+	// Sent with this fragment, replacing Request.Header values of the same
+	// name.
+	header http.Header
 }
 
 type Request struct {
@@ -34,8 +45,81 @@ type Request struct {
 	HmacSecret   string
 	Non2xxErrors bool
 	Transport    http.RoundTripper
+	// Close the connection after each request instead of reusing it, so
+	// requests are spread across targets behind connection-pinning load
+	// balancers.
+	DisableKeepAlives bool
+	// Called with the index of a fragment and its outgoing request before it's
+	// sent, so headers and the URL can be modified. Requests are signed after
+	// BeforeFetch returns. Fragments are fetched in parallel so BeforeFetch is
+	// called concurrently.
+	BeforeFetch func(index int, req *http.Request)
+	// Called with the index of a fragment and its result after it's
+	// successfully fetched. Like BeforeFetch, it's called concurrently.
+	// Fragments with the same URL are fetched once, so it's only called with
+	// the index of the first of them. See FetchedWith.
+	AfterFetch func(index int, result *Result)
+	// Called with the index of a fragment and the error when it can't be
+	// fetched, including optional fragments. Like AfterFetch, it's called
+	// concurrently and once for fragments with the same URL.
+	FetchFailed func(index int, err error)
+	// Compress fragment bodies set with WithFragmentBody using gzip, unless the
+	// request already has a Content-Encoding. HMAC signatures only cover the
+	// path and timestamp, so they're the same either way.
+	CompressBodies bool
+	// Whether redirects are followed. Defaults to RedirectNever, returning the
+	// redirect response itself.
+	FollowRedirects RedirectPolicy
+	// The most redirects followed for a single fetch before the last redirect
+	// response is returned. Defaults to 10 when zero.
+	MaxRedirects int
+	// The hosts layouts, fragments, and redirects may be fetched from, e.g.
+	// `views.internal:3000` or `https://views.internal`. Entries without a
+	// port match any port and entries without a scheme allow http and https.
+	// Requests to other hosts fail with ErrHostNotAllowed. When empty, any
+	// host is allowed.
+	AllowedHosts []string
+	// Return the results of fragments that finished when Timeout is reached
+	// instead of failing the request. Fragments that didn't finish have Err
+	// set to context.DeadlineExceeded, like an optional fragment that failed.
+	// Their fetches are canceled and have returned by the time Do returns.
+	PartialResults bool
+	// Attributes added to every `fetch_url` span, e.g. the deploy version or
+	// region. A fragment's metadata takes precedence over these.
+	DefaultMetadata map[string]string
+	// Decides which response statuses are successful when Non2xxErrors is
+	// set, e.g. to allow a 404 to render an empty slot. When nil, only 2xx
+	// statuses are successful.
+	SuccessStatus func(statusCode int) bool
+	// The most retries shared by all fragments fetched by a single call to
+	// Do, so a failing origin can't multiply the requests for a page. GET and
+	// HEAD fragments that fail with a network error or a 5xx are retried
+	// until the budget is used up. Retries are disabled when zero.
+	RetryBudget int
+	// The client used to fetch the layout and fragments, e.g. to share a
+	// cookie jar between requests. Its Transport is used instead of
+	// Transport, unless it's nil, and its CheckRedirect replaces
+	// FollowRedirects and the AllowedHosts check for redirects, unless it's
+	// nil. When nil, a client using Transport is created for each fetch.
+	Client *http.Client
 }
 
+// ErrHostNotAllowed is returned when a request's URL isn't in AllowedHosts.
+var ErrHostNotAllowed = errors.New("host not allowed")
+
+// RedirectPolicy determines which redirects are followed when fetching.
+type RedirectPolicy int
+
+const (
+	// Never follow redirects.
+	RedirectNever RedirectPolicy = iota
+	// Follow redirects to any host.
+	RedirectFollow
+	// Only follow redirects to the same host and port as the original
+	// request, so a fragment can't redirect requests to arbitrary hosts.
+	RedirectFollowSameHost
+)
+
 func NewRequest() *Request {
 	return &Request{
 		ctx:          context.TODO(),
@@ -61,8 +145,49 @@ func (r *Request) WithFragment(fragmentURL string, metadata map[string]string) {
 	r.fragments = append(r.fragments, fragment{url: fragmentURL, metadata: metadata})
 }
 
+// WithOptionalFragment adds a fragment that doesn't fail the request when it
+// can't be fetched. Instead its result has Err set and an empty body.
+func (r *Request) WithOptionalFragment(fragmentURL string, metadata map[string]string) {
+	r.fragments = append(r.fragments, fragment{url: fragmentURL, metadata: metadata, optional: true})
+}
+
+// WithFragmentBody fetches the fragment at index with method and body instead
+// of a GET without a body, e.g. to forward a form submission to it. The body
+// is buffered so the request can be signed and resent.
+func (r *Request) WithFragmentBody(index int, method string, body []byte) {
+	r.fragments[index].method = method
+	r.fragments[index].body = body
+}
+
+// WithFragmentSuccessStatus decides which response statuses are successful
+// for the fragment at index, overriding SuccessStatus.
+func (r *Request) WithFragmentSuccessStatus(index int, successStatus func(statusCode int) bool) {
+	r.fragments[index].successStatus = successStatus
+}
+
+// WithFragmentHeader sends header with the fragment at index, replacing the
+// request's headers with the same names, e.g. `Accept: application/json` for
+// a fragment that renders JSON.
+func (r *Request) WithFragmentHeader(index int, header http.Header) {
+	r.fragments[index].header = header
+}
+
+// DoSingle fetches url with method and body in a `fetch_url` span, signing the
+// request when HmacSecret is set like fragments fetched by Do.
 func (r *Request) DoSingle(ctx context.Context, method string, url string, body io.ReadCloser) (*Result, error) {
-	return r.fetchUrl(ctx, method, url, r.Header, body)
+	var span trace.Span
+	ctx, span = otel.Tracer("multiplexer").Start(ctx, "fetch_url")
+	span.SetAttributes(r.spanAttributes(url, nil)...)
+	defer span.End()
+
+	result, err := r.fetchUrl(ctx, method, url, r.Header, body, nil, func(req *http.Request) {
+		if r.HmacSecret != "" {
+			r.signRequest(req)
+		}
+	})
+	recordOutcome(span, 0, err)
+
+	return result, err
 }
 
 func (r *Request) Do(ctx context.Context) ([]*Result, error) {
@@ -75,40 +200,86 @@ func (r *Request) Do(ctx context.Context) ([]*Result, error) {
 	defer cancel()
 
 	wg := sync.WaitGroup{}
-	errCh := make(chan error)
-	resultsCh := make(chan *Result, len(r.fragments))
+	// Buffered so each fetch can send its error without a receiver.
+	errCh := make(chan error, len(r.fragments))
+	results := make([]*Result, len(r.fragments))
+	var resultsMu sync.Mutex
+	budget := newRetryBudget(r.RetryBudget)
 
-	for _, f := range r.fragments {
+	for _, indexes := range r.fragmentGroups() {
 		wg.Add(1)
-		go func(ctx context.Context, f fragment, resultsCh chan *Result, wg *sync.WaitGroup) {
+		go func(ctx context.Context, indexes []int, wg *sync.WaitGroup) {
 			defer wg.Done()
+			i, f := indexes[0], r.fragments[indexes[0]]
 			var span trace.Span
 			ctx, span = tracer.Start(ctx, "fetch_url")
-			span.SetAttributes(attribute.KeyValue{
-				Key:   "url",
-				Value: attribute.StringValue(f.url),
-			})
-			for key, value := range f.metadata {
-				span.SetAttributes(attribute.KeyValue{
-					Key:   attribute.Key(key),
-					Value: attribute.StringValue(value),
-				})
-			}
+			span.SetAttributes(r.spanAttributes(f.url, f.metadata)...)
 			defer span.End()
 
-			headersForRequest := r.Header
-			if r.HmacSecret != "" {
-				headersForRequest = r.headersWithHmac(f.url)
+			method := http.MethodGet
+			if f.method != "" {
+				method = f.method
 			}
 
-			result, err := r.fetchUrl(ctx, "GET", f.url, headersForRequest, nil)
+			payload := f.body
+			compressed := false
+			if payload != nil && r.CompressBodies && len(payload) > 0 && r.Header.Get("Content-Encoding") == "" {
+				var err error
+				if payload, err = gzipBody(payload); err != nil {
+					errCh <- newFetchError(KindBody, f.url, err)
+					return
+				}
+				compressed = true
+			}
+
+			fetch := func() (*Result, error) {
+				var body io.Reader
+				if payload != nil {
+					body = bytes.NewReader(payload)
+				}
+
+				return r.fetchUrl(ctx, method, f.url, r.fragmentHeader(f), body, f.successStatus, func(req *http.Request) {
+					if compressed {
+						req.Header.Set("Content-Encoding", "gzip")
+					}
+
+					if r.BeforeFetch != nil {
+						r.BeforeFetch(i, req)
+					}
+
+					if r.HmacSecret != "" {
+						r.signRequest(req)
+					}
+				})
+			}
 
-			if err != nil {
+			result, err := fetch()
+			retries := 0
+			for err != nil && isRetryable(ctx, method, err) && budget.take() {
+				span.AddEvent("retry", trace.WithAttributes(attribute.String("error", err.Error())))
+				retries++
+				result, err = fetch()
+			}
+			recordOutcome(span, retries, err)
+
+			if err != nil && f.optional {
+				result = &Result{Url: f.url, Err: err}
+			} else if err != nil {
 				errCh <- err
 			}
 
-			resultsCh <- result
-		}(ctx, f, resultsCh, &wg)
+			if err != nil && r.FetchFailed != nil {
+				r.FetchFailed(i, err)
+			} else if err == nil && r.AfterFetch != nil {
+				r.AfterFetch(i, result)
+			}
+
+			resultsMu.Lock()
+			for _, index := range indexes {
+				results[index] = result
+			}
+			resultsMu.Unlock()
+		}(ctx, indexes, &wg)
 	}
 
 	// wait for all responses to complete
@@ -118,34 +289,192 @@ func (r *Request) Do(ctx context.Context) ([]*Result, error) {
 		wg.Wait()
 	})(&wg)
 
+	// stop cancels the remaining fetches and waits for them to return, so
+	// their hooks aren't called and results aren't written after Do returns.
+	stop := func() {
+		cancel()
+		<-done
+	}
+
 	select {
 	case err := <-errCh:
-		cancel()
+		stop()
 		return make([]*Result, 0), err
 	case <-done:
-		results := make([]*Result, len(r.fragments))
+		select {
+		case err := <-errCh:
+			return make([]*Result, 0), err
+		default:
+			return results, nil
+		}
+	case <-ctx.Done():
+		err := ctx.Err()
+
+		if r.PartialResults && err == context.DeadlineExceeded {
+			select {
+			case fetchErr := <-errCh:
+				stop()
+				return make([]*Result, 0), fetchErr
+			default:
+				partial := r.partialResults(results, &resultsMu, err)
+				stop()
+				return partial, nil
+			}
+		}
+
+		stop()
+		if err == context.DeadlineExceeded {
+			return make([]*Result, 0), newFetchError(KindTimeout, "", err)
+		}
+
+		return make([]*Result, 0), err
+	}
+}
 
-		for i := 0; i < len(r.fragments); i++ {
-			results[i] = <-resultsCh
+// fragmentHeader returns the request's headers with f's headers replacing
+// those with the same names.
+func (r *Request) fragmentHeader(f fragment) http.Header {
+	if len(f.header) == 0 {
+		return r.Header
+	}
+
+	header := r.Header.Clone()
+	for name, values := range f.header {
+		header.Del(name)
+		for _, value := range values {
+			header.Add(name, value)
 		}
+	}
+
+	return header
+}
+
+// recordOutcome sets the `outcome` attribute of a `fetch_url` span to
+// success, retried when it succeeded after retries, timeout, or error, and
+// sets the span's status to an error when err is non-nil.
+func recordOutcome(span trace.Span, retries int, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+
+		var fetchErr *FetchError
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &fetchErr) && fetchErr.Kind == KindTimeout) {
+			outcome = "timeout"
+		}
+
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if retries > 0 {
+		outcome = "retried"
+	}
 
-		sort.SliceStable(results, func(i int, j int) bool {
-			return indexOfResult(r.fragments, results[i]) < indexOfResult(r.fragments, results[j])
+	span.SetAttributes(attribute.String("outcome", outcome), attribute.Int("retries", retries))
+}
+
+// partialResults returns a copy of the results that finished, with a result
+// with Err set to err for each fragment that didn't.
+func (r *Request) partialResults(results []*Result, mu *sync.Mutex, err error) []*Result {
+	mu.Lock()
+	defer mu.Unlock()
+
+	partial := make([]*Result, len(results))
+	for i, result := range results {
+		if result == nil {
+			result = &Result{Url: r.fragments[i].url, Err: err}
+		}
+
+		partial[i] = result
+	}
+
+	return partial
+}
+
+// spanAttributes returns the attributes for a `fetch_url` span fetching url:
+// the url, followed by DefaultMetadata merged with metadata.
+func (r *Request) spanAttributes(url string, metadata map[string]string) []attribute.KeyValue {
+	merged := make(map[string]string, len(r.DefaultMetadata)+len(metadata))
+	for key, value := range r.DefaultMetadata {
+		merged[key] = value
+	}
+	for key, value := range metadata {
+		merged[key] = value
+	}
+
+	attributes := []attribute.KeyValue{{
+		Key:   "url",
+		Value: attribute.StringValue(url),
+	}}
+	for key, value := range merged {
+		attributes = append(attributes, attribute.KeyValue{
+			Key:   attribute.Key(key),
+			Value: attribute.StringValue(value),
 		})
+	}
 
-		return results, nil
-	case <-ctx.Done():
-		return make([]*Result, 0), ctx.Err()
+	return attributes
+}
+
+// fragmentGroups returns the indexes of the request's fragments grouped so
+// each group is fetched once, in the order each group first appears.
+// GET fragments with the same URL are grouped unless BeforeFetch is set,
+// since it can change each fragment's request, or they have their own
+// success status or headers.
+func (r *Request) fragmentGroups() [][]int {
+	type groupKey struct {
+		url      string
+		optional bool
+	}
+
+	var groups [][]int
+	groupIndexes := make(map[groupKey]int)
+
+	for i, f := range r.fragments {
+		key := groupKey{url: f.url, optional: f.optional}
+		if f.method != "" || f.successStatus != nil || len(f.header) > 0 {
+			groups = append(groups, []int{i})
+			continue
+		}
+
+		if groupIndex, ok := groupIndexes[key]; ok && r.BeforeFetch == nil {
+			groups[groupIndex] = append(groups[groupIndex], i)
+			continue
+		}
+
+		groupIndexes[key] = len(groups)
+		groups = append(groups, []int{i})
 	}
+
+	return groups
 }
 
-func (r *Request) fetchUrl(ctx context.Context, method string, url string, headers http.Header, body io.ReadCloser) (*Result, error) {
+// FetchedWith returns the indexes of the fragments fetched together with the
+// fragment at index, including index itself. AfterFetch and FetchFailed are
+// only called with the first of them, so callers tracking every fragment can
+// use it to find the others.
+func (r *Request) FetchedWith(index int) []int {
+	for _, indexes := range r.fragmentGroups() {
+		for _, i := range indexes {
+			if i == index {
+				return indexes
+			}
+		}
+	}
+
+	return nil
+}
+
+// fetchUrl requests url and reads the response body, decoding it when it uses
+// a supported content coding. Unsuccessful statuses are checked with
+// successStatus when it's non-nil. When prepare is non-nil it's called with
+// the request after headers are set, just before it's sent.
+func (r *Request) fetchUrl(ctx context.Context, method string, url string, headers http.Header, body io.Reader, successStatus func(int) bool, prepare func(*http.Request)) (*Result, error) {
 	start := time.Now()
 
 	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, err
 	}
+	req.Close = r.DisableKeepAlives
 
 	for name, values := range headers {
 		for _, value := range values {
@@ -153,37 +482,48 @@ func (r *Request) fetchUrl(ctx context.Context, method string, url string, heade
 		}
 	}
 
-	client := &http.Client{
-		Transport: r.Transport,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
+	// The client's Accept-Encoding may list codings that can't be decoded,
+	// like br, so only advertise the ones that can.
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+
+	if prepare != nil {
+		prepare(req)
+	}
+
+	if !r.isAllowedURL(req.URL) {
+		return nil, fmt.Errorf("%w: %s", ErrHostNotAllowed, req.URL.Redacted())
 	}
+
+	client := r.client()
+	finished := loadFetchMetrics().started(ctx, req.URL)
 	resp, err := client.Do(req)
 
 	if err != nil {
-		return nil, err
+		finished(0)
+		if errors.Is(err, ErrHostNotAllowed) {
+			return nil, err
+		}
+
+		return nil, newFetchError(KindConnection, url, err)
 	}
+	finished(resp.StatusCode)
 
-	defer resp.Body.Close()
+	defer drainAndClose(resp.Body)
 	duration := time.Since(start)
 
-	var responseBody []byte
-
-	if resp.Header.Get("Content-Encoding") == "gzip" {
-		gzipReader, err := gzip.NewReader(resp.Body)
+	// Responses without a body, like those to HEAD requests, can still have a
+	// Content-Encoding but there's nothing to decode.
+	var bodyReader io.Reader = resp.Body
+	if resp.Body != http.NoBody {
+		bodyReader, err = decodeBody(resp.Body, resp.Header.Get("Content-Encoding"))
 		if err != nil {
-			return nil, err
+			return nil, newFetchError(KindBody, url, err)
 		}
-		defer gzipReader.Close()
-
-		responseBody, err = ioutil.ReadAll(gzipReader)
-	} else {
-		responseBody, err = ioutil.ReadAll(resp.Body)
 	}
 
+	responseBody, err := ioutil.ReadAll(bodyReader)
 	if err != nil {
-		return nil, err
+		return nil, newFetchError(KindBody, url, err)
 	}
 
 	result := &Result{
@@ -194,52 +534,167 @@ func (r *Request) fetchUrl(ctx context.Context, method string, url string, heade
 		StatusCode:   resp.StatusCode,
 	}
 
-	if r.Non2xxErrors && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+	if successStatus == nil {
+		successStatus = r.successStatus
+	}
+
+	if r.Non2xxErrors && !successStatus(resp.StatusCode) {
 		err := &ResultError{
 			Result: result,
 		}
 
-		return nil, err
+		return nil, &FetchError{Kind: KindHTTP, Url: url, Err: err}
 	}
 
 	return result, nil
 }
 
-func (r *Request) headersWithHmac(url string) http.Header {
-	newHeaders := http.Header{}
-	for name, value := range r.Header {
-		newHeaders[name] = value
+// client returns a copy of Client, or a new client when it's nil, defaulting
+// to Transport and the request's redirect policy.
+func (r *Request) client() *http.Client {
+	client := &http.Client{}
+	if r.Client != nil {
+		*client = *r.Client
 	}
 
-	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+	if client.Transport == nil {
+		client.Transport = r.Transport
+	}
 
-	mac := hmac.New(sha256.New, []byte(r.HmacSecret))
-	mac.Write(
-		[]byte(fmt.Sprintf("%s,%s", pathFromFullUrl(url), timestamp)),
-	)
+	if client.CheckRedirect == nil {
+		client.CheckRedirect = r.checkRedirect
+	}
 
-	newHeaders.Set("Authorization", hex.EncodeToString(mac.Sum(nil)))
-	newHeaders.Set("X-Authorization-Time", timestamp)
+	return client
+}
 
-	return newHeaders
+// maxDrainSize is the most unread response body discarded before closing it
+// so the connection can be reused. Larger bodies are closed without reading
+// the rest, which closes the connection instead.
+const maxDrainSize = 256 << 10
+
+// drainAndClose discards what's left of body, up to maxDrainSize, and closes
+// it. Closing a body that hasn't been read to EOF, like when it fails to
+// decode, prevents the transport from reusing its keep-alive connection.
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(ioutil.Discard, io.LimitReader(body, maxDrainSize))
+	body.Close()
 }
 
-func pathFromFullUrl(fullUrl string) string {
-	targetUrl, _ := url.Parse(fullUrl)
+// successStatus returns true when statusCode is successful according to
+// SuccessStatus, or is a 2xx when it's nil.
+func (r *Request) successStatus(statusCode int) bool {
+	if r.SuccessStatus != nil {
+		return r.SuccessStatus(statusCode)
+	}
 
-	if targetUrl.RawQuery != "" {
-		return fmt.Sprintf("%s?%s", targetUrl.Path, targetUrl.RawQuery)
-	} else {
-		return targetUrl.Path
+	return statusCode >= 200 && statusCode <= 299
+}
+
+// checkRedirect returns http.ErrUseLastResponse for redirects that shouldn't
+// be followed. Redirects to the same host are re-signed since the path
+// changes, but signatures are never sent to other hosts.
+func (r *Request) checkRedirect(req *http.Request, via []*http.Request) error {
+	maxRedirects := r.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = 10
+	}
+
+	switch {
+	case r.FollowRedirects == RedirectNever, len(via) > maxRedirects:
+		return http.ErrUseLastResponse
+	case r.FollowRedirects == RedirectFollowSameHost && req.URL.Host != via[0].URL.Host:
+		return http.ErrUseLastResponse
+	case !r.isAllowedURL(req.URL):
+		return fmt.Errorf("%w: %s", ErrHostNotAllowed, req.URL.Redacted())
+	}
+
+	if r.HmacSecret != "" && req.URL.Host == via[0].URL.Host {
+		r.signRequest(req)
+	} else if r.HmacSecret != "" {
+		req.Header.Del("Authorization")
+		req.Header.Del("X-Authorization-Time")
 	}
+
+	return nil
 }
 
-func indexOfResult(fragments []fragment, result *Result) int {
-	for i, fragment := range fragments {
-		if fragment.url == result.Url {
-			return i
+// isAllowedURL returns true when AllowedHosts is empty or has an entry
+// matching target's scheme and host.
+func (r *Request) isAllowedURL(target *url.URL) bool {
+	if len(r.AllowedHosts) == 0 {
+		return true
+	}
+
+	for _, allowed := range r.AllowedHosts {
+		schemes := []string{"http", "https"}
+		if allowedUrl, err := url.Parse(allowed); err == nil && strings.Contains(allowed, "://") {
+			schemes = []string{allowedUrl.Scheme}
+			allowed = allowedUrl.Host
+		}
+
+		host := target.Host
+		if !strings.Contains(allowed, ":") {
+			host = target.Hostname()
+		}
+
+		for _, scheme := range schemes {
+			if strings.EqualFold(target.Scheme, scheme) && strings.EqualFold(host, allowed) {
+				return true
+			}
 		}
 	}
 
-	return -1
+	return false
+}
+
+// signRequest sets the Authorization and X-Authorization-Time headers used by
+// the target to verify the request came from viewproxy.
+func (r *Request) signRequest(req *http.Request) {
+	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+
+	req.Header.Set("Authorization", hex.EncodeToString(hmacSum(r.HmacSecret, req.Method, pathFromUrl(req.URL), timestamp)))
+	req.Header.Set("X-Authorization-Time", timestamp)
+}
+
+// hmacSum returns the HMAC-SHA256 of `<method>,<path>,<timestamp>` using
+// secret.
+func hmacSum(secret string, method string, path string, timestamp string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%s,%s,%s", method, path, timestamp)))
+
+	return mac.Sum(nil)
+}
+
+// VerifyHmac returns true when providedMAC, the hex encoded `Authorization`
+// header of a signed request, is the signature of method, path, including its
+// query, and timestamp, the `X-Authorization-Time` header, using secret. The
+// MAC is compared in constant time. maxAge is how far the timestamp may be
+// from now, in either direction, before the request is rejected to limit
+// replays, e.g. a minute.
+func VerifyHmac(secret string, method string, path string, timestamp string, providedMAC string, maxAge time.Duration) bool {
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	age := time.Since(time.Unix(signedAt, 0))
+	if age > maxAge || age < -maxAge {
+		return false
+	}
+
+	provided, err := hex.DecodeString(providedMAC)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(provided, hmacSum(secret, method, path, timestamp))
+}
+
+func pathFromUrl(targetUrl *url.URL) string {
+	if targetUrl.RawQuery != "" {
+		return fmt.Sprintf("%s?%s", targetUrl.Path, targetUrl.RawQuery)
+	} else {
+		return targetUrl.Path
+	}
 }
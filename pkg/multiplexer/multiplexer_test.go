@@ -2,12 +2,32 @@ package multiplexer
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer/multiplexertest"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var defaultTimeout = time.Duration(5) * time.Second
@@ -59,6 +79,148 @@ func TestRequestDoForwardsHeaders(t *testing.T) {
 	server.Close()
 }
 
+func TestRequestDoCallsFetchHooks(t *testing.T) {
+	server := startServer()
+	var afterIndexes []int
+	var mu sync.Mutex
+
+	r := NewRequest()
+	r.WithFragment("http://localhost:9990?fragment=header", make(map[string]string))
+	r.WithFragment("http://localhost:9990?fragment=oops", make(map[string]string))
+	r.Timeout = defaultTimeout
+	r.BeforeFetch = func(index int, req *http.Request) {
+		req.Header.Set("X-Index", fmt.Sprintf("%d", index))
+
+		if index == 1 {
+			req.URL.RawQuery = "fragment=echo_headers"
+		}
+	}
+	r.AfterFetch = func(index int, result *Result) {
+		mu.Lock()
+		defer mu.Unlock()
+		afterIndexes = append(afterIndexes, index)
+	}
+	results, err := r.Do(context.TODO())
+
+	assert.Nil(t, err)
+	assert.Equal(t, "<body>", string(results[0].Body))
+	assert.Contains(t, string(results[1].Body), "X-Index:1")
+	assert.ElementsMatch(t, []int{0, 1}, afterIndexes)
+
+	server.Close()
+}
+
+func TestRequestDoFetchesDuplicateUrlsOnce(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte(r.URL.Query().Get("fragment")))
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		beforeFetch         func(int, *http.Request)
+		expectedHits        int32
+		expectedIndexes     []int
+		expectedFetchedWith []int
+	}{
+		"deduplicated":      {expectedHits: 2, expectedIndexes: []int{0, 1}, expectedFetchedWith: []int{0, 2}},
+		"with before fetch": {beforeFetch: func(int, *http.Request) {}, expectedHits: 3, expectedIndexes: []int{0, 1, 2}, expectedFetchedWith: []int{2}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			atomic.StoreInt32(&hits, 0)
+			var afterIndexes []int
+			var mu sync.Mutex
+
+			r := NewRequest()
+			r.WithFragment(server.URL+"?fragment=header", make(map[string]string))
+			r.WithFragment(server.URL+"?fragment=body", make(map[string]string))
+			r.WithFragment(server.URL+"?fragment=header", make(map[string]string))
+			r.Timeout = defaultTimeout
+			r.BeforeFetch = tc.beforeFetch
+			r.AfterFetch = func(index int, result *Result) {
+				mu.Lock()
+				defer mu.Unlock()
+				afterIndexes = append(afterIndexes, index)
+			}
+			results, err := r.Do(context.TODO())
+
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expectedHits, atomic.LoadInt32(&hits))
+			assert.Equal(t, "header", string(results[0].Body))
+			assert.Equal(t, "body", string(results[1].Body))
+			assert.Equal(t, "header", string(results[2].Body))
+			assert.ElementsMatch(t, tc.expectedIndexes, afterIndexes)
+			assert.Equal(t, tc.expectedFetchedWith, r.FetchedWith(2))
+		})
+	}
+}
+
+func TestRequestDoCompressesFragmentBodies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := decodeBody(r.Body, r.Header.Get("Content-Encoding"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		decoded, _ := ioutil.ReadAll(body)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.Header.Get("Content-Encoding"), decoded)
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		compress        bool
+		contentEncoding string
+		expected        string
+	}{
+		"compressed":      {compress: true, expected: "POST gzip name=viewproxy"},
+		"uncompressed":    {compress: false, expected: "POST  name=viewproxy"},
+		"already encoded": {compress: true, contentEncoding: "identity", expected: "POST identity name=viewproxy"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := NewRequest()
+			r.WithFragment(server.URL, make(map[string]string))
+			r.WithFragmentBody(0, http.MethodPost, []byte("name=viewproxy"))
+			r.Timeout = defaultTimeout
+			r.CompressBodies = tc.compress
+			if tc.contentEncoding != "" {
+				r.Header.Set("Content-Encoding", tc.contentEncoding)
+			}
+			results, err := r.Do(context.TODO())
+
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, string(results[0].Body))
+		})
+	}
+}
+
+func TestOptionalFragmentErrorIsReturnedInResult(t *testing.T) {
+	server := startServer()
+
+	r := NewRequest()
+	r.WithFragment("http://localhost:9990?fragment=header", make(map[string]string))
+	r.WithOptionalFragment("http://localhost:9990?fragment=oops", make(map[string]string))
+	r.Timeout = defaultTimeout
+	results, err := r.Do(context.TODO())
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(results))
+	assert.Nil(t, results[0].Err)
+
+	var resultErr *ResultError
+	assert.ErrorAs(t, results[1].Err, &resultErr)
+	assert.Equal(t, 500, resultErr.Result.StatusCode)
+	assert.Equal(t, "http://localhost:9990?fragment=oops", results[1].Url)
+	assert.Equal(t, 0, len(results[1].Body))
+
+	server.Close()
+}
+
 func TestFetch404ReturnsError(t *testing.T) {
 	server := startServer()
 
@@ -76,6 +238,78 @@ func TestFetch404ReturnsError(t *testing.T) {
 	server.Close()
 }
 
+func TestResultErrorExposesStatusAndBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("no such widget"))
+	}))
+	defer server.Close()
+
+	r := NewRequest()
+	r.WithFragment(server.URL+"/widgets/1", make(map[string]string))
+	r.Timeout = defaultTimeout
+	_, err := r.Do(context.TODO())
+
+	var resultErr *ResultError
+	assert.True(t, errors.As(fmt.Errorf("rendering page: %w", err), &resultErr))
+	assert.Equal(t, http.StatusNotFound, resultErr.StatusCode())
+	assert.Equal(t, "no such widget", string(resultErr.Body()))
+	assert.EqualError(t, resultErr, "status: 404 url: "+server.URL+"/widgets/1")
+}
+
+func TestSuccessStatus(t *testing.T) {
+	transport := multiplexertest.NewTransport()
+	transport.Add("http://views.internal/missing", multiplexertest.Response{StatusCode: http.StatusNotFound})
+	transport.Add("http://views.internal/moved", multiplexertest.Response{StatusCode: http.StatusNotModified})
+
+	allow404 := func(statusCode int) bool {
+		return statusCode == http.StatusNotFound || (statusCode >= 200 && statusCode <= 299)
+	}
+
+	tests := map[string]struct {
+		requestStatus  func(int) bool
+		fragmentStatus func(int) bool
+		// Fragments are fetched in parallel, so either failing fragment's
+		// error can be returned when both fail.
+		wantErrors []string
+	}{
+		"default":            {wantErrors: []string{"status: 404 url: http://views.internal/missing", "status: 304 url: http://views.internal/moved"}},
+		"request predicate":  {requestStatus: allow404, wantErrors: []string{"status: 304 url: http://views.internal/moved"}},
+		"fragment predicate": {fragmentStatus: allow404, wantErrors: []string{"status: 304 url: http://views.internal/moved"}},
+		"fragment overrides request": {
+			requestStatus:  func(statusCode int) bool { return statusCode != http.StatusNotFound },
+			fragmentStatus: allow404,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := NewRequest()
+			r.Timeout = defaultTimeout
+			r.Transport = transport
+			r.SuccessStatus = tc.requestStatus
+			r.WithFragment("http://views.internal/missing", make(map[string]string))
+			r.WithFragment("http://views.internal/moved", make(map[string]string))
+			if tc.fragmentStatus != nil {
+				r.WithFragmentSuccessStatus(0, tc.fragmentStatus)
+			}
+
+			results, err := r.Do(context.Background())
+
+			if len(tc.wantErrors) > 0 {
+				if assert.Error(t, err) {
+					assert.Contains(t, tc.wantErrors, err.Error())
+				}
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusNotFound, results[0].StatusCode)
+			assert.Equal(t, http.StatusNotModified, results[1].StatusCode)
+		})
+	}
+}
+
 func TestFetch500ReturnsError(t *testing.T) {
 	server := startServer()
 	start := time.Now()
@@ -114,6 +348,79 @@ func TestFetchTimeout(t *testing.T) {
 	server.Close()
 }
 
+func TestPartialResultsOnTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hang" {
+			<-release
+		}
+
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	tests := map[string]struct {
+		partial   bool
+		wantError string
+	}{
+		"partial":     {partial: true},
+		"not partial": {partial: false, wantError: "context deadline exceeded"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := NewRequest()
+			r.WithFragment(server.URL+"/fast", make(map[string]string))
+			r.WithFragment(server.URL+"/hang", make(map[string]string))
+			r.Timeout = time.Duration(100) * time.Millisecond
+			r.PartialResults = tc.partial
+			results, err := r.Do(context.Background())
+
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+				assert.Equal(t, 0, len(results))
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, 2, len(results))
+			assert.Nil(t, results[0].Err)
+			assert.Equal(t, "/fast", string(results[0].Body))
+			assert.Equal(t, server.URL+"/hang", results[1].Url)
+			assert.Equal(t, context.DeadlineExceeded, results[1].Err)
+		})
+	}
+}
+
+func TestPartialResultsWaitForRemainingFetches(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hang" {
+			<-release
+		}
+
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	var failed int32
+	r := NewRequest()
+	r.WithFragment(server.URL+"/fast", make(map[string]string))
+	r.WithFragment(server.URL+"/hang", make(map[string]string))
+	r.Timeout = time.Duration(50) * time.Millisecond
+	r.PartialResults = true
+	r.FetchFailed = func(index int, err error) {
+		atomic.AddInt32(&failed, 1)
+	}
+	results, err := r.Do(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&failed), "Expected the hanging fetch to return before Do")
+	assert.Equal(t, context.DeadlineExceeded, results[1].Err)
+}
+
 func TestCanIgnoreNon2xxErrors(t *testing.T) {
 	server := startServer()
 
@@ -132,6 +439,138 @@ func TestCanIgnoreNon2xxErrors(t *testing.T) {
 	server.Close()
 }
 
+type trackedBody struct {
+	io.Reader
+	drained bool
+	closed  bool
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		b.drained = true
+	}
+
+	return n, err
+}
+
+func (b *trackedBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+type trackingTransport struct {
+	body *trackedBody
+	err  error
+}
+
+func (t *trackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	header := http.Header{}
+	body := "hello world"
+
+	switch req.URL.Path {
+	case "/not_found":
+		return t.respond(req, http.StatusNotFound, header, strings.NewReader(body)), nil
+	case "/bad_gzip":
+		header.Set("Content-Encoding", "gzip")
+		return t.respond(req, http.StatusOK, header, strings.NewReader(body)), nil
+	case "/read_error":
+		return t.respond(req, http.StatusOK, header, io.MultiReader(strings.NewReader(body), &errorReader{t.err})), nil
+	default:
+		return t.respond(req, http.StatusOK, header, strings.NewReader(body)), nil
+	}
+}
+
+func (t *trackingTransport) respond(req *http.Request, status int, header http.Header, body io.Reader) *http.Response {
+	t.body = &trackedBody{Reader: body}
+
+	return &http.Response{StatusCode: status, Header: header, Body: t.body, Request: req}
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestFetchDrainsAndClosesResponseBodies(t *testing.T) {
+	readErr := errors.New("connection reset")
+
+	tests := map[string]struct {
+		path        string
+		wantError   string
+		wantDrained bool
+	}{
+		"success":    {path: "/", wantDrained: true},
+		"non-2xx":    {path: "/not_found", wantError: "status: 404 url: http://views.internal/not_found", wantDrained: true},
+		"bad gzip":   {path: "/bad_gzip", wantError: "gzip: invalid header", wantDrained: true},
+		"read error": {path: "/read_error", wantError: "connection reset", wantDrained: false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			transport := &trackingTransport{err: readErr}
+
+			r := NewRequest()
+			r.Timeout = defaultTimeout
+			r.Transport = transport
+			r.WithFragment("http://views.internal"+tc.path, make(map[string]string))
+			_, err := r.Do(context.Background())
+
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+			} else {
+				assert.Nil(t, err)
+			}
+
+			assert.True(t, transport.body.closed)
+			assert.Equal(t, tc.wantDrained, transport.body.drained)
+		})
+	}
+}
+
+func TestDisableKeepAlives(t *testing.T) {
+	tests := map[string]struct {
+		disableKeepAlives bool
+		expected          int32
+	}{
+		"keep-alives enabled":  {disableKeepAlives: false, expected: 1},
+		"keep-alives disabled": {disableKeepAlives: true, expected: 3},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var connections int32
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("hello"))
+			}))
+			server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					atomic.AddInt32(&connections, 1)
+				}
+			}
+			server.Start()
+			defer server.Close()
+
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			defer transport.CloseIdleConnections()
+
+			for i := 0; i < 3; i++ {
+				r := NewRequest()
+				r.Transport = transport
+				r.DisableKeepAlives = tc.disableKeepAlives
+				r.WithFragment(server.URL, make(map[string]string))
+				_, err := r.Do(context.Background())
+				assert.Nil(t, err)
+			}
+
+			assert.Equal(t, tc.expected, atomic.LoadInt32(&connections))
+		})
+	}
+}
+
 func startServer() *http.Server {
 	instance := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		params := r.URL.Query()
@@ -172,3 +611,412 @@ func startServer() *http.Server {
 
 	return testServer
 }
+
+func TestHeadersFromRequestRemovesConnectionHeaders(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Connection", "X-Internal-Token")
+	req.Header.Set("X-Internal-Token", "secret")
+	req.Header.Set("X-Name", "viewproxy")
+
+	headers := HeadersFromRequest(req)
+
+	assert.Equal(t, "", headers.Get("Connection"))
+	assert.Equal(t, "", headers.Get("X-Internal-Token"))
+	assert.Equal(t, "viewproxy", headers.Get("X-Name"))
+}
+
+func TestDoSingleSignsRequestsAndStartsSpan(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s,%s", r.Header.Get("Authorization"), r.Header.Get("X-Authorization-Time"))
+	}))
+	defer server.Close()
+
+	r := NewRequest()
+	r.HmacSecret = "secret"
+	r.Timeout = defaultTimeout
+	result, err := r.DoSingle(context.TODO(), http.MethodGet, server.URL+"/hello?name=world", nil)
+	assert.Nil(t, err)
+
+	parts := strings.Split(string(result.Body), ",")
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("GET,/hello?name=world," + parts[1]))
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), parts[0])
+
+	spans := exporter.GetSpans()
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, "fetch_url", spans[0].Name)
+	assert.Contains(t, spans[0].Attributes, attribute.String("url", server.URL+"/hello?name=world"))
+}
+
+func TestDefaultMetadataIsMergedIntoSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	r := NewRequest()
+	r.Timeout = defaultTimeout
+	r.DefaultMetadata = map[string]string{"region": "us-east", "version": "abc123"}
+	r.WithFragment(server.URL+"/layout", map[string]string{})
+	r.WithFragment(server.URL+"/fragment", map[string]string{"region": "eu-west", "slot": "main"})
+	_, err := r.Do(context.Background())
+	assert.Nil(t, err)
+
+	spans := make(map[string][]attribute.KeyValue)
+	for _, span := range exporter.GetSpans() {
+		if span.Name != "fetch_url" {
+			continue
+		}
+
+		for _, attr := range span.Attributes {
+			if attr.Key == "url" {
+				spans[attr.Value.AsString()] = span.Attributes
+			}
+		}
+	}
+
+	assert.ElementsMatch(t, []attribute.KeyValue{
+		attribute.String("url", server.URL+"/layout"),
+		attribute.String("region", "us-east"),
+		attribute.String("version", "abc123"),
+		attribute.String("outcome", "success"),
+		attribute.Int("retries", 0),
+	}, spans[server.URL+"/layout"])
+	assert.ElementsMatch(t, []attribute.KeyValue{
+		attribute.String("url", server.URL+"/fragment"),
+		attribute.String("region", "eu-west"),
+		attribute.String("version", "abc123"),
+		attribute.String("slot", "main"),
+		attribute.String("outcome", "success"),
+		attribute.Int("retries", 0),
+	}, spans[server.URL+"/fragment"])
+}
+
+func TestFollowRedirectsPolicies(t *testing.T) {
+	otherHost := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("other host " + r.Header.Get("Authorization")))
+	}))
+	defer otherHost.Close()
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/internal":
+			http.Redirect(w, r, "/final", http.StatusTemporaryRedirect)
+		case "/twice":
+			http.Redirect(w, r, "/internal", http.StatusTemporaryRedirect)
+		case "/external":
+			http.Redirect(w, r, otherHost.URL+"/final", http.StatusTemporaryRedirect)
+		case "/final":
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write([]byte(r.Method + ",/final," + r.Header.Get("X-Authorization-Time")))
+			fmt.Fprintf(w, "final %t", hex.EncodeToString(mac.Sum(nil)) == r.Header.Get("Authorization"))
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		policy       RedirectPolicy
+		maxRedirects int
+		path         string
+		expectedCode int
+		expectedBody string
+	}{
+		"never":                {policy: RedirectNever, path: "/internal", expectedCode: 307},
+		"follow":               {policy: RedirectFollow, path: "/internal", expectedCode: 200, expectedBody: "final true"},
+		"follow other host":    {policy: RedirectFollow, path: "/external", expectedCode: 200, expectedBody: "other host "},
+		"follow max redirects": {policy: RedirectFollow, maxRedirects: 1, path: "/twice", expectedCode: 307},
+		"same host":            {policy: RedirectFollowSameHost, path: "/twice", expectedCode: 200, expectedBody: "final true"},
+		"same host other host": {policy: RedirectFollowSameHost, path: "/external", expectedCode: 307},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := NewRequest()
+			r.Timeout = defaultTimeout
+			r.HmacSecret = "secret"
+			r.Non2xxErrors = false
+			r.FollowRedirects = tc.policy
+			r.MaxRedirects = tc.maxRedirects
+			r.WithFragment(server.URL+tc.path, make(map[string]string))
+			results, err := r.Do(context.TODO())
+
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expectedCode, results[0].StatusCode)
+			if tc.expectedBody != "" {
+				assert.Equal(t, tc.expectedBody, string(results[0].Body))
+			}
+		})
+	}
+}
+
+func TestAllowedHosts(t *testing.T) {
+	otherHost := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("other host"))
+	}))
+	defer otherHost.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, otherHost.URL, http.StatusTemporaryRedirect)
+			return
+		}
+
+		w.Write([]byte("allowed"))
+	}))
+	defer server.Close()
+
+	serverUrl, _ := url.Parse(server.URL)
+
+	tests := map[string]struct {
+		allowedHosts []string
+		url          string
+		expectedErr  bool
+	}{
+		"no allowlist":        {url: server.URL},
+		"allowed host":        {allowedHosts: []string{"views.internal", serverUrl.Hostname()}, url: server.URL},
+		"allowed host port":   {allowedHosts: []string{serverUrl.Host}, url: server.URL},
+		"allowed scheme":      {allowedHosts: []string{"http://" + serverUrl.Host}, url: server.URL},
+		"disallowed scheme":   {allowedHosts: []string{"https://" + serverUrl.Host}, url: server.URL, expectedErr: true},
+		"disallowed port":     {allowedHosts: []string{serverUrl.Hostname() + ":1"}, url: server.URL, expectedErr: true},
+		"metadata endpoint":   {allowedHosts: []string{serverUrl.Host}, url: "http://169.254.169.254/latest/meta-data/", expectedErr: true},
+		"disallowed redirect": {allowedHosts: []string{serverUrl.Host}, url: server.URL + "/redirect", expectedErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := NewRequest()
+			r.Timeout = defaultTimeout
+			r.AllowedHosts = tc.allowedHosts
+			r.FollowRedirects = RedirectFollow
+			r.WithFragment(tc.url, make(map[string]string))
+			results, err := r.Do(context.TODO())
+
+			if tc.expectedErr {
+				assert.True(t, errors.Is(err, ErrHostNotAllowed), "expected ErrHostNotAllowed, got %v", err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, "allowed", string(results[0].Body))
+			}
+		})
+	}
+}
+
+func TestFragmentHeader(t *testing.T) {
+	transport := multiplexertest.NewTransport()
+	transport.Add("http://views.internal/json", multiplexertest.Response{})
+	transport.Add("http://views.internal/html", multiplexertest.Response{})
+
+	r := NewRequest()
+	r.Timeout = defaultTimeout
+	r.Transport = transport
+	r.Header.Set("Accept", "text/html")
+	r.Header.Set("X-Request-Id", "abc123")
+	r.WithFragment("http://views.internal/json", make(map[string]string))
+	r.WithFragmentHeader(0, http.Header{"accept": []string{"application/json"}, "X-Fragment-Name": []string{"json"}})
+	r.WithFragment("http://views.internal/html", make(map[string]string))
+
+	_, err := r.Do(context.Background())
+	assert.Nil(t, err)
+
+	requests := make(map[string]*http.Request)
+	for _, req := range transport.Requests() {
+		requests[req.URL.Path] = req
+	}
+
+	assert.Equal(t, []string{"application/json"}, requests["/json"].Header.Values("Accept"))
+	assert.Equal(t, "json", requests["/json"].Header.Get("X-Fragment-Name"))
+	assert.Equal(t, "abc123", requests["/json"].Header.Get("X-Request-Id"))
+
+	assert.Equal(t, []string{"text/html"}, requests["/html"].Header.Values("Accept"))
+	assert.Empty(t, requests["/html"].Header.Get("X-Fragment-Name"))
+	assert.Equal(t, "text/html", r.Header.Get("Accept"))
+}
+
+func TestClientCookieJarPersistsAcrossFragments(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc123", Path: "/"})
+		case "/profile":
+			if cookie, err := r.Cookie("session"); err == nil {
+				w.Write([]byte(cookie.Value))
+			}
+		}
+	}))
+	defer server.Close()
+
+	jar, err := cookiejar.New(nil)
+	assert.Nil(t, err)
+	client := &http.Client{Jar: jar}
+
+	login := NewRequest()
+	login.Timeout = defaultTimeout
+	login.Client = client
+	login.WithFragment(server.URL+"/login", make(map[string]string))
+	_, err = login.Do(context.Background())
+	assert.Nil(t, err)
+
+	profile := NewRequest()
+	profile.Timeout = defaultTimeout
+	profile.Client = client
+	profile.WithFragment(server.URL+"/profile", make(map[string]string))
+	results, err := profile.Do(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "abc123", string(results[0].Body))
+
+	withoutJar := NewRequest()
+	withoutJar.Timeout = defaultTimeout
+	withoutJar.WithFragment(server.URL+"/profile", make(map[string]string))
+	results, err = withoutJar.Do(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, results[0].Body)
+}
+
+func TestClientTransportDefaultsToRequestTransport(t *testing.T) {
+	transport := multiplexertest.NewTransport()
+	transport.Add("http://views.internal/fragment", multiplexertest.Response{Body: "fragment"})
+
+	r := NewRequest()
+	r.Timeout = defaultTimeout
+	r.Transport = transport
+	r.Client = &http.Client{}
+	r.WithFragment("http://views.internal/fragment", make(map[string]string))
+
+	results, err := r.Do(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "fragment", string(results[0].Body))
+	assert.Nil(t, r.Client.Transport)
+}
+
+func TestVerifyHmac(t *testing.T) {
+	now := fmt.Sprintf("%d", time.Now().Unix())
+	stale := fmt.Sprintf("%d", time.Now().Add(-10*time.Minute).Unix())
+	future := fmt.Sprintf("%d", time.Now().Add(10*time.Minute).Unix())
+
+	sign := func(secret string, method string, path string, timestamp string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(method + "," + path + "," + timestamp))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	valid := sign("secret", "GET", "/hello?name=world", now)
+	nearMiss := valid[:len(valid)-1] + string("0123456789abcdef"[(strings.IndexByte("0123456789abcdef", valid[len(valid)-1])+1)%16])
+
+	tests := map[string]struct {
+		method    string
+		path      string
+		timestamp string
+		mac       string
+		expected  bool
+	}{
+		"valid":            {method: "GET", path: "/hello?name=world", timestamp: now, mac: valid, expected: true},
+		"near miss":        {method: "GET", path: "/hello?name=world", timestamp: now, mac: nearMiss},
+		"truncated":        {method: "GET", path: "/hello?name=world", timestamp: now, mac: valid[:len(valid)-2]},
+		"not hex":          {method: "GET", path: "/hello?name=world", timestamp: now, mac: "not hex"},
+		"wrong secret":     {method: "GET", path: "/hello?name=world", timestamp: now, mac: sign("other", "GET", "/hello?name=world", now)},
+		"different path":   {method: "GET", path: "/hello?name=you", timestamp: now, mac: valid},
+		"different method": {method: "POST", path: "/hello?name=world", timestamp: now, mac: valid},
+		"stale":            {method: "GET", path: "/hello?name=world", timestamp: stale, mac: sign("secret", "GET", "/hello?name=world", stale)},
+		"future":           {method: "GET", path: "/hello?name=world", timestamp: future, mac: sign("secret", "GET", "/hello?name=world", future)},
+		"bad timestamp":    {method: "GET", path: "/hello?name=world", timestamp: "yesterday", mac: sign("secret", "GET", "/hello?name=world", "yesterday")},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, VerifyHmac("secret", tc.method, tc.path, tc.timestamp, tc.mac, 5*time.Minute))
+		})
+	}
+}
+
+func TestVerifyHmacAcceptsSignedRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !VerifyHmac("secret", r.Method, r.URL.RequestURI(), r.Header.Get("X-Authorization-Time"), r.Header.Get("Authorization"), time.Minute) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	r := NewRequest()
+	r.HmacSecret = "secret"
+	r.Timeout = defaultTimeout
+	r.WithFragment(server.URL+"/hello?name=world", make(map[string]string))
+	r.WithFragments([]FragmentSpec{{Url: server.URL + "/form", Method: http.MethodPost, Body: []byte("name=world")}})
+
+	_, err := r.Do(context.Background())
+	assert.Nil(t, err)
+}
+
+func TestFetchSpansRecordOutcome(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	var flakyRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/flaky":
+			if atomic.AddInt32(&flakyRequests, 1) == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	r := NewRequest()
+	r.Timeout = 50 * time.Millisecond
+	r.RetryBudget = 1
+	r.WithFragment(server.URL+"/ok", make(map[string]string))
+	r.WithFragment(server.URL+"/flaky", make(map[string]string))
+	r.WithOptionalFragment(server.URL+"/missing", make(map[string]string))
+	r.WithOptionalFragment(server.URL+"/slow", make(map[string]string))
+	r.PartialResults = true
+
+	_, err := r.Do(context.Background())
+	assert.Nil(t, err)
+
+	// Wait for the slow fragment's span to end after the timeout.
+	time.Sleep(100 * time.Millisecond)
+
+	type outcome struct {
+		status  codes.Code
+		outcome string
+	}
+	outcomes := make(map[string]outcome)
+	for _, span := range exporter.GetSpans() {
+		if span.Name != "fetch_url" {
+			continue
+		}
+
+		var url, result string
+		for _, attr := range span.Attributes {
+			switch attr.Key {
+			case "url":
+				url = attr.Value.AsString()
+			case "outcome":
+				result = attr.Value.AsString()
+			}
+		}
+
+		outcomes[strings.TrimPrefix(url, server.URL)] = outcome{status: span.StatusCode, outcome: result}
+	}
+
+	assert.Equal(t, map[string]outcome{
+		"/ok":      {status: codes.Unset, outcome: "success"},
+		"/flaky":   {status: codes.Unset, outcome: "retried"},
+		"/missing": {status: codes.Error, outcome: "error"},
+		"/slow":    {status: codes.Error, outcome: "timeout"},
+	}, outcomes)
+}
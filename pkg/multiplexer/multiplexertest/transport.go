@@ -0,0 +1,132 @@
+// Package multiplexertest provides an http.RoundTripper for testing code that
+// fetches layouts and fragments without starting servers.
+package multiplexertest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Response is a canned response returned by Transport.
+type Response struct {
+	// The response status. Defaults to 200 when zero.
+	StatusCode int
+	Header     http.Header
+	Body       string
+	// How long to wait before responding. The request fails with its
+	// context's error if it's done first, e.g. when a timeout is reached.
+	Latency time.Duration
+	// The error returned instead of a response, e.g. to simulate a refused
+	// connection.
+	Err error
+}
+
+// Transport is an http.RoundTripper that responds with the Response added for
+// each request's URL and records the requests it receives. Requests for URLs
+// without a response get a 404. It's safe for concurrent use, so it can be
+// used as a multiplexer.Request's or viewproxy.Server's transport.
+type Transport struct {
+	mu        sync.Mutex
+	responses map[string]Response
+	requests  []*http.Request
+}
+
+func NewTransport() *Transport {
+	return &Transport{responses: make(map[string]Response)}
+}
+
+// Add responds with response to requests for url. URLs without a query match
+// requests with any query, e.g. `http://views.internal/header` matches
+// `http://views.internal/header?name=world`, while URLs with a query only
+// match exactly.
+func (t *Transport) Add(url string, response Response) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.responses[url] = response
+}
+
+// Requests returns the requests received so far, in the order they arrived.
+// Their bodies have been read and can be read again.
+func (t *Transport) Requests() []*http.Request {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]*http.Request(nil), t.requests...)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorded := req.Clone(req.Context())
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		recorded.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	t.mu.Lock()
+	t.requests = append(t.requests, recorded)
+	response, ok := t.responses[req.URL.String()]
+	if !ok {
+		withoutQuery := *req.URL
+		withoutQuery.RawQuery = ""
+		response, ok = t.responses[withoutQuery.String()]
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		response = Response{StatusCode: http.StatusNotFound, Body: fmt.Sprintf("no response for %s", req.URL)}
+	}
+
+	if response.Latency > 0 {
+		timer := time.NewTimer(response.Latency)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	if response.Err != nil {
+		return nil, response.Err
+	}
+
+	statusCode := response.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+
+	header := response.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	var body io.ReadCloser = ioutil.NopCloser(strings.NewReader(response.Body))
+	if req.Method == http.MethodHead {
+		body = http.NoBody
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: int64(len(response.Body)),
+		Request:       req,
+	}, nil
+}
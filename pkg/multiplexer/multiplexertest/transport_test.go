@@ -0,0 +1,62 @@
+package multiplexertest
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransport(t *testing.T) {
+	transport := NewTransport()
+	transport.Add("http://views.internal/layout", Response{
+		Header: http.Header{"Content-Type": []string{"text/html"}},
+		Body:   "<body></body>",
+	})
+	transport.Add("http://views.internal/layout?name=admin", Response{StatusCode: http.StatusForbidden})
+	transport.Add("http://views.internal/broken", Response{Err: errors.New("connection refused")})
+	transport.Add("http://views.internal/slow", Response{Latency: time.Second})
+
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Get("http://views.internal/layout?name=world")
+	assert.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "<body></body>", string(body))
+
+	resp, err = client.Get("http://views.internal/layout?name=admin")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, err = client.Get("http://views.internal/missing")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	_, err = client.Get("http://views.internal/broken")
+	assert.EqualError(t, err, `Get "http://views.internal/broken": connection refused`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://views.internal/slow", nil)
+	_, err = client.Do(req)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	_, err = client.Post("http://views.internal/form", "text/plain", strings.NewReader("name=viewproxy"))
+	assert.Nil(t, err)
+
+	requests := transport.Requests()
+	assert.Equal(t, 6, len(requests))
+	assert.Equal(t, "/layout", requests[0].URL.Path)
+
+	posted, err := ioutil.ReadAll(requests[5].Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "name=viewproxy", string(posted))
+}
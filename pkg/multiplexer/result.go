@@ -6,6 +6,9 @@ import (
 	"time"
 )
 
+// ResultError is wrapped by the FetchError returned when a fragment responds
+// with an unsuccessful status, a non-2xx unless SuccessStatus says otherwise,
+// and Non2xxErrors is set. The response is available through Result.
 type ResultError struct {
 	Result *Result
 }
@@ -18,12 +21,25 @@ func (re *ResultError) Error() string {
 	)
 }
 
+// StatusCode returns the status code the fragment responded with.
+func (re *ResultError) StatusCode() int {
+	return re.Result.StatusCode
+}
+
+// Body returns the decoded body the fragment responded with.
+func (re *ResultError) Body() []byte {
+	return re.Result.Body
+}
+
 type Result struct {
 	Url          string
 	Duration     time.Duration
 	HttpResponse *http.Response
 	Body         []byte
 	StatusCode   int
+	// The error fetching an optional fragment. When set, the other fields
+	// besides Url are empty.
+	Err error
 }
 
 func (r *Result) Header() http.Header {
@@ -37,9 +53,7 @@ func (r *Result) HeadersWithoutProxyHeaders() http.Header {
 		headers[name] = values
 	}
 
-	for _, hopByHopHeader := range HopByHopHeaders {
-		headers.Del(hopByHopHeader)
-	}
+	RemoveHopByHopHeaders(headers)
 
 	return headers
 }
@@ -0,0 +1,39 @@
+package multiplexer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// retryBudget is the number of retries left for a single Do call, shared by
+// every fragment so a failing origin can't multiply the requests for a page.
+type retryBudget struct {
+	remaining int32
+}
+
+func newRetryBudget(retries int) *retryBudget {
+	return &retryBudget{remaining: int32(retries)}
+}
+
+// take uses one retry from the budget, returning false when none are left.
+func (b *retryBudget) take() bool {
+	return atomic.AddInt32(&b.remaining, -1) >= 0
+}
+
+// isRetryable returns true when a fetch with method that failed with err is
+// safe and worth retrying: GET and HEAD requests that failed with a network
+// error or a 5xx, while ctx is still live.
+func isRetryable(ctx context.Context, method string, err error) bool {
+	if ctx.Err() != nil || (method != http.MethodGet && method != http.MethodHead) {
+		return false
+	}
+
+	var resultErr *ResultError
+	if errors.As(err, &resultErr) {
+		return resultErr.StatusCode() >= 500
+	}
+
+	return !errors.Is(err, ErrHostNotAllowed)
+}
@@ -0,0 +1,118 @@
+package multiplexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer/multiplexertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryBudgetIsSharedAcrossFragments(t *testing.T) {
+	transport := multiplexertest.NewTransport()
+
+	r := NewRequest()
+	r.Timeout = defaultTimeout
+	r.Transport = transport
+	r.RetryBudget = 3
+	for i := 0; i < 10; i++ {
+		url := fmt.Sprintf("http://views.internal/broken/%d", i)
+		transport.Add(url, multiplexertest.Response{StatusCode: http.StatusServiceUnavailable})
+		r.WithOptionalFragment(url, make(map[string]string))
+	}
+
+	results, err := r.Do(context.Background())
+
+	assert.Nil(t, err)
+	assert.Len(t, results, 10)
+	for _, result := range results {
+		assert.Error(t, result.Err)
+	}
+	assert.Len(t, transport.Requests(), 13)
+}
+
+func TestRetriesRecoverFromTransientErrors(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	r := NewRequest()
+	r.Timeout = defaultTimeout
+	r.RetryBudget = 1
+	r.WithFragment(server.URL, make(map[string]string))
+
+	results, err := r.Do(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(results[0].Body))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestRetriesSkipUnsafeAndClientErrors(t *testing.T) {
+	transport := multiplexertest.NewTransport()
+	transport.Add("http://views.internal/form", multiplexertest.Response{StatusCode: http.StatusInternalServerError})
+	transport.Add("http://views.internal/missing", multiplexertest.Response{StatusCode: http.StatusNotFound})
+
+	r := NewRequest()
+	r.Timeout = defaultTimeout
+	r.Transport = transport
+	r.RetryBudget = 10
+	r.WithOptionalFragment("http://views.internal/form", make(map[string]string))
+	r.WithFragmentBody(0, http.MethodPost, []byte("name=octocat"))
+	r.WithOptionalFragment("http://views.internal/missing", make(map[string]string))
+
+	_, err := r.Do(context.Background())
+
+	assert.Nil(t, err)
+	assert.Len(t, transport.Requests(), 2)
+}
+
+func TestRetriesAreDisabledByDefault(t *testing.T) {
+	transport := multiplexertest.NewTransport()
+	transport.Add("http://views.internal/broken", multiplexertest.Response{StatusCode: http.StatusInternalServerError})
+
+	r := NewRequest()
+	r.Timeout = defaultTimeout
+	r.Transport = transport
+	r.WithFragment("http://views.internal/broken", make(map[string]string))
+
+	_, err := r.Do(context.Background())
+
+	assert.EqualError(t, err, "status: 500 url: http://views.internal/broken")
+	assert.Len(t, transport.Requests(), 1)
+}
+
+func TestRetriedMalformedBodiesFailWithBodyErrors(t *testing.T) {
+	transport := multiplexertest.NewTransport()
+	transport.Add("http://views.internal/corrupt", multiplexertest.Response{
+		Header: http.Header{"Content-Encoding": []string{"gzip"}},
+		Body:   "not gzip",
+	})
+
+	r := NewRequest()
+	r.Timeout = defaultTimeout
+	r.Transport = transport
+	r.RetryBudget = 2
+	r.WithFragment("http://views.internal/corrupt", make(map[string]string))
+
+	_, err := r.Do(context.Background())
+
+	var fetchErr *FetchError
+	if assert.True(t, errors.As(err, &fetchErr), "expected a FetchError, got %v", err) {
+		assert.Equal(t, KindBody, fetchErr.Kind)
+		assert.Equal(t, "http://views.internal/corrupt", fetchErr.Url)
+	}
+	assert.Len(t, transport.Requests(), 3)
+}
@@ -0,0 +1,43 @@
+package viewproxy
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// setRequestID ensures the request has an ID in the RequestIDHeader, reusing
+// the inbound one or generating one, and echoes it on the response. The ID is
+// forwarded to the layout and fragments with the rest of the request's
+// headers.
+func (s *Server) setRequestID(w http.ResponseWriter, r *http.Request) {
+	if s.RequestIDHeader == "" {
+		return
+	}
+
+	id := r.Header.Get(s.RequestIDHeader)
+	if id == "" {
+		var err error
+		if id, err = newRequestID(); err != nil {
+			s.Logger.Errorf("Could not generate request ID: %s", err)
+			return
+		}
+
+		r.Header.Set(s.RequestIDHeader, id)
+	}
+
+	w.Header().Set(s.RequestIDHeader, id)
+}
+
+// newRequestID returns a random version 4 UUID.
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,97 @@
+package viewproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIDIsPropagated(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received = append(received, r.Header.Get("X-Request-Id"))
+		mu.Unlock()
+
+		if r.URL.Path == "/layout" {
+			w.Header().Set("X-Request-Id", r.Header.Get("X-Request-Id"))
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		} else {
+			w.Write([]byte(r.URL.Path))
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		inboundID string
+	}{
+		"provided":  {inboundID: "abc-123"},
+		"generated": {inboundID: ""},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			received = nil
+			var logs bytes.Buffer
+
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(&logs, "", 0))
+			viewProxyServer.RequestIDHeader = "X-Request-Id"
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/header"), NewFragment("/footer")})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			if tc.inboundID != "" {
+				r.Header.Set("X-Request-Id", tc.inboundID)
+			}
+			w := httptest.NewRecorder()
+
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+			assert.Equal(t, "<body>/header/footer</body>", string(body))
+
+			id := resp.Header.Get("X-Request-Id")
+			if tc.inboundID != "" {
+				assert.Equal(t, tc.inboundID, id)
+			} else {
+				assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), id)
+			}
+
+			assert.Equal(t, []string{id}, resp.Header.Values("X-Request-Id"))
+			assert.Equal(t, []string{id, id, id}, received)
+			assert.Equal(t, 3, strings.Count(logs.String(), "(request "+id+")"))
+		})
+	}
+}
+
+func TestRequestIDIsDisabledByDefault(t *testing.T) {
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("X-Request-Id")
+		w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{})
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+
+	viewProxyServer.ServeHTTP(w, r)
+
+	assert.Equal(t, "", received)
+	assert.Equal(t, "", w.Result().Header.Get("X-Request-Id"))
+}
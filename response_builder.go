@@ -3,29 +3,87 @@ package viewproxy
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
 )
 
+// MissingPlaceholderPolicy determines how fragment content is handled when the
+// layout has no content placeholder for it.
+type MissingPlaceholderPolicy int
+
+const (
+	// Log a warning and drop the fragment content.
+	MissingPlaceholderWarn MissingPlaceholderPolicy = iota
+	// Fail the request, responding as if the layout couldn't be fetched.
+	MissingPlaceholderError
+	// Log a warning and append the fragment content to the end of the layout.
+	MissingPlaceholderAppend
+)
+
+var titleTagPattern = regexp.MustCompile(`(?is)(<title[^>]*>).*?(</title>)`)
+
 type responseBuilder struct {
 	writer     http.ResponseWriter
+	request    *http.Request
 	server     Server
 	body       []byte
 	StatusCode int
+	// The response's nonce, generated by the first placeholder or
+	// Content-Security-Policy that needs it.
+	nonce string
 }
 
-func newResponseBuilder(server Server, w http.ResponseWriter) *responseBuilder {
-	return &responseBuilder{server: server, writer: w, StatusCode: 200}
+func newResponseBuilder(server Server, w http.ResponseWriter, r *http.Request) *responseBuilder {
+	return &responseBuilder{server: server, writer: w, request: r, StatusCode: 200}
 }
 
 func (rb *responseBuilder) SetLayout(result *multiplexer.Result) {
 	rb.body = result.Body
+	rb.StatusCode = result.StatusCode
 }
 
+// SetHeaders copies headers to the response, excluding hop-by-hop headers and
+// the server's ignored headers. Headers beyond MaxResponseHeaders or
+// MaxResponseHeaderBytes are dropped, in order of their names.
 func (rb *responseBuilder) SetHeaders(headers http.Header) {
-	for name, values := range headers {
-		for _, value := range values {
+	headers = headers.Clone()
+	multiplexer.RemoveHopByHopHeaders(headers)
+
+	// The request ID is already set on the response.
+	if rb.server.RequestIDHeader != "" {
+		headers.Del(rb.server.RequestIDHeader)
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		if !rb.isIgnoredHeader(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	count, size := 0, 0
+	for _, name := range names {
+		for _, value := range headers[name] {
+			count++
+			size += len(name) + len(value)
+
+			if (rb.server.MaxResponseHeaders > 0 && count > rb.server.MaxResponseHeaders) ||
+				(rb.server.MaxResponseHeaderBytes > 0 && size > rb.server.MaxResponseHeaderBytes) {
+				rb.server.Logger.Warnf("Dropping response header %s for %s, exceeding the header limits", name, rb.request.URL.Path)
+				continue
+			}
+
 			rb.writer.Header().Add(name, value)
 		}
 	}
@@ -35,18 +93,158 @@ func (rb *responseBuilder) SetHeaders(headers http.Header) {
 	}
 }
 
-func (rb *responseBuilder) SetFragments(results []*multiplexer.Result) {
-	var contentHtml []byte
-	var pageTitle string
+// SetFragmentCookies adds the Set-Cookie headers from fragment results to the
+// response, skipping cookies that are already set, unless Set-Cookie is an
+// ignored header.
+func (rb *responseBuilder) SetFragmentCookies(results []*multiplexer.Result) {
+	if rb.isIgnoredHeader("Set-Cookie") {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, cookie := range rb.writer.Header().Values("Set-Cookie") {
+		seen[cookie] = true
+	}
 
 	for _, result := range results {
-		contentHtml = append(contentHtml, result.Body...)
+		if result.Err != nil {
+			continue
+		}
+
+		for _, cookie := range result.Header().Values("Set-Cookie") {
+			if !seen[cookie] {
+				seen[cookie] = true
+				rb.writer.Header().Add("Set-Cookie", cookie)
+			}
+		}
+	}
+}
+
+// SetFragmentHeaders copies the headers allowed by AllowFragmentHeaders from
+// fragment results to the response, skipping ignored headers. Later fragments
+// override the layout and earlier fragments, except for Vary, whose values are
+// combined.
+func (rb *responseBuilder) SetFragmentHeaders(results []*multiplexer.Result) {
+	header := rb.writer.Header()
+
+	for _, name := range rb.server.fragmentHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if rb.isIgnoredHeader(name) {
+			continue
+		}
+
+		for _, result := range results {
+			if result.Err != nil {
+				continue
+			}
+
+			values := result.Header().Values(name)
+			if len(values) == 0 {
+				continue
+			}
+
+			if name == "Vary" {
+				header.Set(name, mergeHeaderTokens(header.Values(name), values))
+			} else {
+				header[name] = append([]string(nil), values...)
+			}
+		}
+	}
+}
+
+// isIgnoredHeader returns true when name was passed to Server.IgnoreHeader.
+func (rb *responseBuilder) isIgnoredHeader(name string) bool {
+	for _, ignoredHeader := range rb.server.ignoreHeaders {
+		if http.CanonicalHeaderKey(ignoredHeader) == http.CanonicalHeaderKey(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mergeHeaderTokens combines the comma separated tokens from existing and
+// values, dropping case-insensitive duplicates.
+func mergeHeaderTokens(existing []string, values []string) string {
+	var tokens []string
+	seen := make(map[string]bool)
+
+	for _, value := range append(append([]string(nil), existing...), values...) {
+		for _, token := range strings.Split(value, ",") {
+			token = strings.TrimSpace(token)
+			if token == "" || seen[strings.ToLower(token)] {
+				continue
+			}
+
+			seen[strings.ToLower(token)] = true
+			tokens = append(tokens, token)
+		}
+	}
+
+	return strings.Join(tokens, ", ")
+}
+
+// SetFragments inserts the fragment results into the layout. Results are
+// matched to fragments by index, and each result is placed in the named
+// content slot its fragment declares, e.g. `{{{VIEW_PROXY_CONTENT:sidebar}}}`.
+// Results without a slot, or whose slot isn't in the layout, are placed in
+// the default `{{{VIEW_PROXY_CONTENT}}}` placeholder. Within a slot results
+// are rendered by their fragment's order metadata. The page title comes from
+// the fragment with the highest title priority, or the last one rendered when
+// priorities are equal. Failed optional fragments are replaced with their
+// fallback, and when PropagateFragmentErrors is set a 5xx from one of them
+// becomes the response status. An error is returned when the layout has no
+// content placeholder for the default slot's content and
+// MissingContentPlaceholder is MissingPlaceholderError. Without a layout, JSON
+// fragments are merged into a single JSON object when MergeJSONFragments is
+// set.
+func (rb *responseBuilder) SetFragments(fragments []*Fragment, results []*multiplexer.Result) error {
+	if rb.server.MergeJSONFragments && len(rb.body) == 0 && len(fragments) >= len(results) && hasJSONFragments(results) {
+		return rb.setJSONFragments(fragments, results)
+	}
 
-		if result.HttpResponse.Header.Get("X-View-Proxy-Title") != "" {
-			pageTitle = result.HttpResponse.Header.Get("X-View-Proxy-Title")
+	var contentHtml []byte
+	var fragmentTitle string
+	var titlePriority int
+	slotContent := make(map[string][]byte)
+
+	for _, i := range renderOrder(fragments, len(results)) {
+		result := results[i]
+		body := result.Body
+		if result.Err != nil && i < len(fragments) {
+			rb.server.Logger.Warnf("Optional fragment %s failed, rendering fallback: %v", result.Url, result.Err)
+			body = []byte(fragments[i].Fallback)
+
+			var resultErr *multiplexer.ResultError
+			if rb.server.PropagateFragmentErrors && errors.As(result.Err, &resultErr) && resultErr.StatusCode() >= 500 {
+				rb.StatusCode = resultErr.StatusCode()
+			}
+		}
+
+		contentHtml = append(contentHtml, body...)
+
+		if i < len(fragments) && fragments[i].Slot() != "" && bytes.Contains(rb.body, rb.placeholder("VIEW_PROXY_CONTENT:"+fragments[i].Slot())) {
+			slot := fragments[i].Slot()
+			slotContent[slot] = append(slotContent[slot], body...)
+		} else {
+			slotContent[""] = append(slotContent[""], body...)
+		}
+
+		if result.Err == nil && result.HttpResponse.Header.Get("X-View-Proxy-Title") != "" {
+			title := result.HttpResponse.Header.Get("X-View-Proxy-Title")
+			priority := 0
+			if i < len(fragments) {
+				priority = fragments[i].TitlePriority()
+			}
+
+			if fragmentTitle == "" || priority >= titlePriority {
+				fragmentTitle = title
+				titlePriority = priority
+			}
 		}
 	}
 
+	pageTitle := fragmentTitle
 	if pageTitle == "" {
 		pageTitle = rb.server.DefaultPageTitle
 	}
@@ -54,32 +252,389 @@ func (rb *responseBuilder) SetFragments(results []*multiplexer.Result) {
 	if len(rb.body) == 0 {
 		rb.body = contentHtml
 	} else {
-		outputHtml := bytes.Replace(rb.body, []byte("{{{VIEW_PROXY_CONTENT}}}"), contentHtml, 1)
-		outputHtml = bytes.Replace(outputHtml, []byte("{{{VIEW_PROXY_PAGE_TITLE}}}"), []byte(pageTitle), 1)
+		contentPlaceholder := rb.placeholder("VIEW_PROXY_CONTENT")
+		titlePlaceholder := rb.placeholder("VIEW_PROXY_PAGE_TITLE")
+
+		outputHtml := rb.body
+		if fragmentTitle != "" && !bytes.Contains(outputHtml, titlePlaceholder) {
+			outputHtml = rb.rewriteTitleTag(outputHtml, fragmentTitle)
+		}
+
+		if len(slotContent[""]) > 0 && !bytes.Contains(outputHtml, contentPlaceholder) {
+			switch rb.server.MissingContentPlaceholder {
+			case MissingPlaceholderError:
+				return fmt.Errorf("layout has no %s placeholder for fragment content", contentPlaceholder)
+			case MissingPlaceholderAppend:
+				rb.server.Logger.Warnf("Layout has no %s placeholder, appending fragment content", contentPlaceholder)
+				outputHtml = append(append([]byte(nil), outputHtml...), contentPlaceholder...)
+			default:
+				rb.server.Logger.Warnf("Layout has no %s placeholder, dropping fragment content", contentPlaceholder)
+			}
+		}
+
+		// Every title placeholder is replaced, e.g. in both <title> and <h1>,
+		// before content is inserted so placeholders in fragment content are
+		// left as-is.
+		outputHtml = bytes.ReplaceAll(outputHtml, titlePlaceholder, []byte(pageTitle))
+		outputHtml = rb.replaceSlotPlaceholders(outputHtml, slotContent)
+		outputHtml = bytes.Replace(outputHtml, contentPlaceholder, slotContent[""], 1)
 
 		rb.body = outputHtml
 	}
+
+	return nil
+}
+
+// renderOrder returns the indexes of count results sorted by their fragment's
+// order metadata, keeping registration order for equal orders.
+func renderOrder(fragments []*Fragment, count int) []int {
+	indexes := make([]int, count)
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	orderOf := func(i int) int {
+		if i < len(fragments) {
+			return fragments[i].Order()
+		}
+
+		return 0
+	}
+
+	sort.SliceStable(indexes, func(a, b int) bool {
+		return orderOf(indexes[a]) < orderOf(indexes[b])
+	})
+
+	return indexes
+}
+
+// placeholder returns the layout placeholder for name wrapped in the server's
+// configured delimiters.
+func (rb *responseBuilder) placeholder(name string) []byte {
+	return []byte(rb.server.LeftDelimiter + name + rb.server.RightDelimiter)
+}
+
+// replaceSlotPlaceholders replaces each named content slot placeholder in the
+// layout with the content for that slot, or nothing when the slot is empty.
+func (rb *responseBuilder) replaceSlotPlaceholders(layout []byte, slotContent map[string][]byte) []byte {
+	return rb.replaceNamedPlaceholders(layout, "VIEW_PROXY_CONTENT", slotContent)
+}
+
+// replaceNamedPlaceholders replaces each `{{{placeholder:name}}}` in layout
+// with content[name], or nothing when content has no name.
+func (rb *responseBuilder) replaceNamedPlaceholders(layout []byte, placeholder string, content map[string][]byte) []byte {
+	prefix := []byte(rb.server.LeftDelimiter + placeholder + ":")
+	suffix := []byte(rb.server.RightDelimiter)
+	output := make([]byte, 0, len(layout))
+
+	for {
+		start := bytes.Index(layout, prefix)
+		if start == -1 {
+			break
+		}
+
+		nameStart := start + len(prefix)
+		nameLength := bytes.Index(layout[nameStart:], suffix)
+		if nameLength == -1 {
+			break
+		}
+
+		output = append(output, layout[:start]...)
+		output = append(output, content[string(layout[nameStart:nameStart+nameLength])]...)
+		layout = layout[nameStart+nameLength+len(suffix):]
+	}
+
+	return append(output, layout...)
+}
+
+// rewriteTitleTag replaces the contents of the layout's <title> tag for
+// layouts without a title placeholder when RewriteTitleTag is enabled,
+// otherwise it warns that the fragment's title is being dropped.
+func (rb *responseBuilder) rewriteTitleTag(layout []byte, title string) []byte {
+	if loc := titleTagPattern.FindSubmatchIndex(layout); rb.server.RewriteTitleTag && loc != nil {
+		output := make([]byte, 0, len(layout)+len(title))
+		output = append(output, layout[:loc[3]]...)
+		output = append(output, title...)
+		output = append(output, layout[loc[4]:]...)
+
+		return output
+	}
+
+	rb.server.Logger.Warnf("Layout has no %s placeholder, dropping title %q", rb.placeholder("VIEW_PROXY_PAGE_TITLE"), title)
+
+	return layout
+}
+
+// SetNonce replaces every nonce placeholder in the body with a random nonce
+// and sets the Content-Security-Policy header with the same nonce. Nothing is
+// generated when neither uses the nonce.
+func (rb *responseBuilder) SetNonce() error {
+	placeholder := rb.placeholder("VIEW_PROXY_NONCE")
+	if rb.server.ContentSecurityPolicy == "" && !bytes.Contains(rb.body, placeholder) {
+		return nil
+	}
+
+	nonce, err := rb.responseNonce()
+	if err != nil {
+		return err
+	}
+
+	rb.body = bytes.ReplaceAll(rb.body, placeholder, []byte(nonce))
+
+	if rb.server.ContentSecurityPolicy != "" {
+		rb.writer.Header().Set(
+			"Content-Security-Policy",
+			strings.ReplaceAll(rb.server.ContentSecurityPolicy, string(placeholder), nonce),
+		)
+	}
+
+	return nil
+}
+
+// responseNonce returns the response's nonce, generating it the first time
+// it's needed so the body and Content-Security-Policy use the same nonce.
+func (rb *responseBuilder) responseNonce() (string, error) {
+	if rb.nonce != "" {
+		return rb.nonce, nil
+	}
+
+	generateNonce := rb.server.GenerateNonce
+	if generateNonce == nil {
+		generateNonce = randomNonce
+	}
+
+	nonce, err := generateNonce()
+	if err != nil {
+		return "", fmt.Errorf("could not generate nonce: %w", err)
+	}
+
+	rb.nonce = nonce
+	return nonce, nil
+}
+
+// randomNonce returns 16 random bytes, base64 encoded.
+func randomNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(nonce), nil
+}
+
+// SetTiming sets the configured timing header. Since fragments are fetched in
+// parallel, backend time is the duration of the slowest result and overhead
+// is the remaining time spent handling the request.
+func (rb *responseBuilder) SetTiming(results []*multiplexer.Result, start time.Time) {
+	if rb.server.TimingHeader == "" {
+		return
+	}
+
+	var backend time.Duration
+	for _, result := range results {
+		if result.Duration > backend {
+			backend = result.Duration
+		}
+	}
+
+	overhead := time.Since(start) - backend
+
+	rb.writer.Header().Set(
+		rb.server.TimingHeader,
+		fmt.Sprintf("backend=%dms;overhead=%dms", backend.Milliseconds(), overhead.Milliseconds()),
+	)
 }
 
 func (rb *responseBuilder) Write() {
-	rb.writer.WriteHeader(rb.StatusCode)
+	header := rb.writer.Header()
+	body := rb.body
 
-	if rb.writer.Header().Get("Content-Encoding") == "gzip" {
-		var b bytes.Buffer
-		gzipWriter := gzip.NewWriter(&b)
+	if rb.server.TransformResponse != nil {
+		body = rb.server.TransformResponse(body, rb.request)
+	}
 
-		_, err := gzipWriter.Write(rb.body)
-		if err != nil {
-			rb.server.Logger.Printf("Could not write to gzip buffer: %s", err)
+	if rb.server.MinifyHTML && isHTML(header.Get("Content-Type")) {
+		body = minifyHTML(body)
+	}
+
+	// Bodies are decoded by the multiplexer, so the layout's encoding no
+	// longer applies and the body is re-encoded only if the client accepts it.
+	relayedEncoding := multiplexer.CanDecode(header.Get("Content-Encoding"))
+	if relayedEncoding {
+		header.Del("Content-Encoding")
+	}
+
+	if rb.server.GenerateETags {
+		header.Del("ETag")
+
+		if rb.StatusCode == http.StatusOK && isCacheable(header) {
+			tag := etag(body)
+			header.Set("ETag", tag)
+
+			if (rb.request.Method == http.MethodGet || rb.request.Method == http.MethodHead) && etagMatches(rb.request.Header.Get("If-None-Match"), tag) {
+				header.Del("Content-Encoding")
+				header.Del("Content-Length")
+				rb.writer.WriteHeader(http.StatusNotModified)
+				return
+			}
 		}
+	}
 
-		gzipWriter.Close()
+	compress := relayedEncoding || (rb.server.CompressResponses && len(body) >= rb.server.CompressionMinSize)
+	if compress && acceptsGzip(rb.request) {
+		compressed, err := compressResponse(body, rb.server.CompressionLevel)
 		if err != nil {
-			rb.server.Logger.Printf("Could not closeto gzip buffer: %s", err)
+			rb.server.Logger.Errorf("Could not write to gzip buffer, sending the response uncompressed: %s", err)
+		} else {
+			header.Set("Content-Encoding", "gzip")
+			header.Add("Vary", "Accept-Encoding")
+			body = compressed
 		}
+	}
 
-		rb.writer.Write(b.Bytes())
-	} else {
-		rb.writer.Write(rb.body)
+	// The upstream Content-Length no longer applies to the assembled body.
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	rb.writer.WriteHeader(rb.StatusCode)
+	rb.writer.Write(body)
+}
+
+// compressResponse compresses response bodies, replaced in tests to simulate
+// compression failures.
+var compressResponse = gzipBytes
+
+// gzipBytes compresses body with the given gzip level, falling back to
+// gzip.DefaultCompression when the level is invalid.
+func gzipBytes(body []byte, level int) ([]byte, error) {
+	var b bytes.Buffer
+	gzipWriter, err := gzip.NewWriterLevel(&b, level)
+	if err != nil {
+		gzipWriter = gzip.NewWriter(&b)
 	}
+
+	if _, err := gzipWriter.Write(body); err != nil {
+		return b.Bytes(), err
+	}
+
+	if err := gzipWriter.Close(); err != nil {
+		return b.Bytes(), err
+	}
+
+	return b.Bytes(), nil
+}
+
+// WriteHeaders writes the status and headers without a body, for HEAD
+// requests where the assembled body isn't built. The layout's Content-Length
+// and ETag don't apply to the assembled body so they're removed.
+func (rb *responseBuilder) WriteHeaders() {
+	header := rb.writer.Header()
+	header.Del("Content-Length")
+
+	if rb.server.GenerateETags {
+		header.Del("ETag")
+	}
+
+	if multiplexer.CanDecode(header.Get("Content-Encoding")) {
+		header.Del("Content-Encoding")
+
+		if acceptsGzip(rb.request) {
+			header.Set("Content-Encoding", "gzip")
+			header.Add("Vary", "Accept-Encoding")
+		}
+	}
+
+	rb.writer.WriteHeader(rb.StatusCode)
+}
+
+// CanStream returns true when the layout has a single content placeholder and
+// no other placeholders, and the writer can be flushed.
+func (rb *responseBuilder) CanStream() bool {
+	if _, ok := rb.writer.(http.Flusher); !ok {
+		return false
+	}
+
+	return bytes.Count(rb.body, []byte(rb.server.LeftDelimiter+"VIEW_PROXY_")) == 1 &&
+		bytes.Count(rb.body, rb.placeholder("VIEW_PROXY_CONTENT")) == 1
+}
+
+// Stream writes the layout up to its content placeholder, then each fragment
+// in render order as it arrives from stream, flushing after each, followed by the
+// rest of the layout. When the request fails part way through the response
+// is aborted, since the status has already been sent.
+func (rb *responseBuilder) Stream(fragments []*Fragment, stream *fragmentStream) {
+	header := rb.writer.Header()
+	header.Del("Content-Length")
+	if multiplexer.CanDecode(header.Get("Content-Encoding")) {
+		header.Del("Content-Encoding")
+	}
+
+	flusher := rb.writer.(http.Flusher)
+	placeholder := rb.placeholder("VIEW_PROXY_CONTENT")
+	noncePlaceholder := rb.placeholder("VIEW_PROXY_NONCE")
+	index := bytes.Index(rb.body, placeholder)
+
+	rb.writer.WriteHeader(rb.StatusCode)
+	rb.writer.Write(rb.body[:index])
+	flusher.Flush()
+
+	for _, i := range renderOrder(fragments, len(fragments)) {
+		fragment := fragments[i]
+		result := stream.next(i + 1)
+		if result == nil {
+			_, err := stream.wait()
+			rb.server.Logger.Errorf("Aborting streamed response: %v", err)
+			panic(http.ErrAbortHandler)
+		}
+
+		body := result.Body
+		if result.Err != nil {
+			rb.server.Logger.Warnf("Optional fragment %s failed, rendering fallback: %v", result.Url, result.Err)
+			body = []byte(fragment.Fallback)
+		}
+
+		// Fragments are written as they arrive, so their nonce placeholders
+		// are replaced here instead of by SetNonce.
+		if bytes.Contains(body, noncePlaceholder) {
+			nonce, err := rb.responseNonce()
+			if err != nil {
+				rb.server.Logger.Errorf("Aborting streamed response: %v", err)
+				panic(http.ErrAbortHandler)
+			}
+
+			body = bytes.ReplaceAll(body, noncePlaceholder, []byte(nonce))
+		}
+
+		rb.writer.Write(body)
+		flusher.Flush()
+	}
+
+	rb.writer.Write(rb.body[index+len(placeholder):])
+}
+
+// acceptsGzip returns true when the request's Accept-Encoding header allows a
+// gzip encoded response.
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(value, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		for _, parameter := range parts[1:] {
+			nameAndValue := strings.SplitN(parameter, "=", 2)
+			if len(nameAndValue) != 2 || strings.TrimSpace(nameAndValue[0]) != "q" {
+				continue
+			}
+
+			if q, err := strconv.ParseFloat(strings.TrimSpace(nameAndValue[1]), 64); err == nil && q == 0 {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
 }
@@ -0,0 +1,205 @@
+package viewproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetHeadersStripsHopByHopHeaders(t *testing.T) {
+	server := NewServer("http://localhost:3000")
+	server.IgnoreHeader("Etag")
+
+	w := httptest.NewRecorder()
+	rb := newResponseBuilder(*server, w, httptest.NewRequest("GET", "/", nil))
+	rb.SetHeaders(http.Header{
+		"Connection":        []string{"close, X-Internal-Token"},
+		"Transfer-Encoding": []string{"chunked"},
+		"Keep-Alive":        []string{"timeout=5"},
+		"Upgrade":           []string{"websocket"},
+		"X-Internal-Token":  []string{"secret"},
+		"Etag":              []string{"abc"},
+		"Content-Type":      []string{"text/html"},
+	})
+
+	assert.Equal(t, http.Header{"Content-Type": []string{"text/html"}}, w.Header())
+}
+
+func TestExcessiveResponseHeadersAreDropped(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		for i := 0; i < 500; i++ {
+			w.Header().Set(fmt.Sprintf("X-Header-%03d", i), strings.Repeat("a", 100))
+		}
+		w.Write([]byte("hello world"))
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		maxHeaders      int
+		maxHeaderBytes  int
+		expectedHeaders int
+		expectedDropped int
+	}{
+		// Content-Length and Content-Type sort first and count towards the
+		// limits, and each X-Header-* is 112 bytes.
+		"unlimited by default": {maxHeaders: 0, maxHeaderBytes: 0, expectedHeaders: 500, expectedDropped: 0},
+		"both limits":          {maxHeaders: 100, maxHeaderBytes: 64 << 10, expectedHeaders: 98, expectedDropped: 402},
+		"count limit":          {maxHeaders: 10, maxHeaderBytes: 0, expectedHeaders: 8, expectedDropped: 492},
+		"byte limit":           {maxHeaders: 0, maxHeaderBytes: 1024, expectedHeaders: 8, expectedDropped: 492},
+		"within limits":        {maxHeaders: 1000, maxHeaderBytes: 1 << 20, expectedHeaders: 500, expectedDropped: 0},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var logs bytes.Buffer
+
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(&logs, "", 0))
+			if tc.maxHeaders > 0 {
+				viewProxyServer.MaxResponseHeaders = tc.maxHeaders
+			}
+			if tc.maxHeaderBytes > 0 {
+				viewProxyServer.MaxResponseHeaderBytes = tc.maxHeaderBytes
+			}
+			viewProxyServer.IgnoreHeader("Date")
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "hello world", w.Body.String())
+
+			relayed := 0
+			for name := range resp.Header {
+				if strings.HasPrefix(name, "X-Header-") {
+					relayed++
+				}
+			}
+			assert.Equal(t, tc.expectedHeaders, relayed)
+			assert.Equal(t, "text/html", resp.Header.Get("Content-Type"))
+			assert.Equal(t, tc.expectedDropped, strings.Count(logs.String(), "Dropping response header"))
+		})
+	}
+}
+
+func TestNonce(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layout" {
+			w.Write([]byte(`<script nonce="{{{VIEW_PROXY_NONCE}}}"></script>{{{VIEW_PROXY_CONTENT}}}<script nonce="{{{VIEW_PROXY_NONCE}}}"></script>`))
+		} else {
+			w.Write([]byte(`<script nonce="{{{VIEW_PROXY_NONCE}}}"></script>`))
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.ContentSecurityPolicy = "script-src 'nonce-{{{VIEW_PROXY_NONCE}}}'"
+	viewProxyServer.GenerateNonce = func() (string, error) {
+		return "abc123", nil
+	}
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/fragment")})
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+
+	viewProxyServer.ServeHTTP(w, r)
+
+	assert.Equal(t, "script-src 'nonce-abc123'", w.Result().Header.Get("Content-Security-Policy"))
+	assert.Equal(t, `<script nonce="abc123"></script><script nonce="abc123"></script><script nonce="abc123"></script>`, w.Body.String())
+}
+
+func TestRandomNonceIsUniquePerResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{{{VIEW_PROXY_NONCE}}}`))
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.ContentSecurityPolicy = "{{{VIEW_PROXY_NONCE}}}"
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{})
+
+	nonces := make([]string, 2)
+	for i := range nonces {
+		w := httptest.NewRecorder()
+		viewProxyServer.ServeHTTP(w, httptest.NewRequest("GET", "/hello/world", nil))
+
+		nonces[i] = w.Body.String()
+		assert.Equal(t, nonces[i], w.Result().Header.Get("Content-Security-Policy"))
+		assert.Len(t, nonces[i], 24)
+	}
+
+	assert.NotEqual(t, nonces[0], nonces[1])
+}
+
+func TestCompressionFailureSendsUncompressedBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layout" {
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		} else {
+			w.Write([]byte("hello"))
+		}
+	}))
+	defer server.Close()
+
+	compress := compressResponse
+	compressResponse = func(body []byte, level int) ([]byte, error) {
+		return body[:1], fmt.Errorf("compression failed")
+	}
+	defer func() { compressResponse = compress }()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.CompressResponses = true
+	viewProxyServer.CompressionMinSize = 0
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/fragment")})
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	viewProxyServer.ServeHTTP(w, r)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Empty(t, resp.Header.Values("Vary"))
+	assert.Equal(t, "18", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "<body>hello</body>", w.Body.String())
+}
+
+func BenchmarkCompressionLevels(b *testing.B) {
+	body := []byte(strings.Repeat(`<div class="fragment"><p>hello world</p><a href="/hello/world">link</a></div>`, 1000))
+
+	levels := map[string]int{
+		"huffman only": gzip.HuffmanOnly,
+		"best speed":   gzip.BestSpeed,
+		"default":      gzip.DefaultCompression,
+		"best":         gzip.BestCompression,
+	}
+
+	for name, level := range levels {
+		b.Run(name, func(b *testing.B) {
+			var compressed []byte
+			b.SetBytes(int64(len(body)))
+
+			for i := 0; i < b.N; i++ {
+				compressed, _ = gzipBytes(body, level)
+			}
+
+			b.ReportMetric(float64(len(compressed)), "compressed-bytes")
+		})
+	}
+}
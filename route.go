@@ -1,21 +1,104 @@
 package viewproxy
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
+	"time"
 )
 
+// RouteOptions configures behavior for a single route that would otherwise
+// come from the server.
+type RouteOptions struct {
+	// The timeout for fetching the route's layout and fragments. When zero the
+	// server's ProxyTimeout is used.
+	Timeout time.Duration
+	// The secret used to sign the route's layout and fragment requests. When
+	// empty the server's HmacSecret is used.
+	HmacSecret string
+	// The name used to generate the route's path with Server.URLFor.
+	Name string
+	// The host the route is limited to, e.g. `admin.example.com`. Routes
+	// without a host match any host.
+	Host string
+	// Middleware applied to the route after the server's middleware, in the
+	// order it's listed.
+	Middleware []func(http.Handler) http.Handler
+	// Fetch the layout before the fragments, and only fetch the fragments
+	// named in its `X-View-Proxy-Fragments` header, e.g. `header,sidebar`.
+	// All fragments are fetched when the layout doesn't set the header.
+	DynamicFragments bool
+}
+
 type Route struct {
+	Name      string
+	Host      string
+	Method    string
 	Parts     []string
 	Layout    *Fragment
 	fragments []*Fragment
+	options   RouteOptions
+	// The compiled constraint for each part, or nil when the part isn't a
+	// constrained parameter.
+	constraints []*regexp.Regexp
+	err         error
 }
 
-func newRoute(path string, layout *Fragment, fragments []*Fragment) *Route {
-	return &Route{
+// newRoute creates a route for path. Parameters can be constrained to values
+// matching a regular expression with `/users/:id(\d+)`, in which case the
+// constraint is removed from Parts and compiled once here.
+func newRoute(method string, path string, layout *Fragment, fragments []*Fragment, options RouteOptions) *Route {
+	route := &Route{
+		Name:      options.Name,
+		Host:      normalizeHost(options.Host),
+		Method:    method,
 		Parts:     strings.Split(path, "/"),
 		Layout:    layout,
 		fragments: fragments,
+		options:   options,
 	}
+
+	route.constraints = make([]*regexp.Regexp, len(route.Parts))
+	for i, part := range route.Parts {
+		open := strings.Index(part, "(")
+		if !strings.HasPrefix(part, ":") || open == -1 || !strings.HasSuffix(part, ")") {
+			continue
+		}
+
+		constraint, err := regexp.Compile("^(?:" + part[open+1:len(part)-1] + ")$")
+		if err != nil {
+			route.err = fmt.Errorf("route %q has an invalid constraint: %w", path, err)
+			continue
+		}
+
+		route.Parts[i] = part[:open]
+		route.constraints[i] = constraint
+	}
+
+	return route
+}
+
+// timeout returns the route's timeout, falling back to defaultTimeout when
+// the route doesn't set one.
+func (r *Route) timeout(defaultTimeout time.Duration) time.Duration {
+	if r.options.Timeout > 0 {
+		return r.options.Timeout
+	}
+
+	return defaultTimeout
+}
+
+// hmacSecret returns the route's HMAC secret, falling back to defaultSecret
+// when the route doesn't set one.
+func (r *Route) hmacSecret(defaultSecret string) string {
+	if r.options.HmacSecret != "" {
+		return r.options.HmacSecret
+	}
+
+	return defaultSecret
 }
 
 func (r *Route) matchParts(pathParts []string) bool {
@@ -24,7 +107,11 @@ func (r *Route) matchParts(pathParts []string) bool {
 	}
 
 	for i := 0; i < len(r.Parts); i++ {
-		if r.Parts[i] != pathParts[i] && !strings.HasPrefix(r.Parts[i], ":") {
+		if strings.HasPrefix(r.Parts[i], ":") {
+			if r.constraints[i] != nil && !r.constraints[i].MatchString(pathParts[i]) {
+				return false
+			}
+		} else if r.Parts[i] != pathParts[i] {
 			return false
 		}
 	}
@@ -32,6 +119,60 @@ func (r *Route) matchParts(pathParts []string) bool {
 	return true
 }
 
+// constraintString returns the pattern for constraint, or an empty string for
+// unconstrained parameters.
+func constraintString(constraint *regexp.Regexp) string {
+	if constraint == nil {
+		return ""
+	}
+
+	return constraint.String()
+}
+
+// pathSegments splits an escaped request path into its unescaped segments,
+// e.g. `/hello/caf%C3%A9` into `hello` and `café`. Escaped slashes, like in
+// `a%2Fb`, stay within their segment.
+func pathSegments(escapedPath string) []string {
+	segments := strings.Split(escapedPath, "/")
+	for i, segment := range segments {
+		if unescaped, err := url.PathUnescape(segment); err == nil {
+			segments[i] = unescaped
+		}
+	}
+
+	return segments
+}
+
+// cleanPath collapses repeated slashes and removes `.` segments from an
+// escaped request path, so `/hello//./world` matches `/hello/world`. A
+// trailing slash is kept so the TrailingSlash policy still applies. `..`
+// segments are left alone since those requests are rejected before matching.
+func cleanPath(escapedPath string) string {
+	segments := strings.Split(escapedPath, "/")
+	cleaned := make([]string, 0, len(segments))
+
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			unescaped = segment
+		}
+
+		if unescaped == "." {
+			segment = ""
+		}
+
+		if segment == "" && i > 0 && i < len(segments)-1 {
+			continue
+		}
+
+		cleaned = append(cleaned, segment)
+	}
+
+	return strings.Join(cleaned, "/")
+}
+
+// parametersFor returns the route's parameters from the unescaped segments of
+// a path matching it.
 func (r *Route) parametersFor(pathParts []string) map[string]string {
 	parameters := make(map[string]string)
 
@@ -45,7 +186,131 @@ func (r *Route) parametersFor(pathParts []string) map[string]string {
 	return parameters
 }
 
+// validate returns an error when the route's path doesn't start with `/`, has
+// a parameter without a name, uses the same parameter name twice, has more
+// than one fragment receiving the request body, or when its fragments or the
+// included fragments use parameters the route doesn't define.
+func (r *Route) validate(includes map[string]*Fragment) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	path := strings.Join(r.Parts, "/")
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("route %q must start with /", path)
+	}
+
+	names := make(map[string]bool)
+	for _, part := range r.Parts {
+		if !strings.HasPrefix(part, ":") {
+			continue
+		}
+
+		name := part[1:]
+		if name == "" {
+			return fmt.Errorf("route %q has a parameter without a name", path)
+		}
+
+		if names[name] {
+			return fmt.Errorf("route %q has duplicate parameter %q", path, name)
+		}
+
+		names[name] = true
+	}
+
+	bodyRecipients := 0
+	for _, fragment := range r.FragmentsToRequest() {
+		if fragment.ReceivesBody {
+			bodyRecipients++
+		}
+
+		for _, name := range fragment.pathParameters() {
+			if !names[name] {
+				return fmt.Errorf("fragment %q uses parameter %q not defined by route %q", fragment.Path, name, path)
+			}
+		}
+	}
+
+	for _, fragment := range includes {
+		for _, name := range fragment.pathParameters() {
+			if !names[name] {
+				return fmt.Errorf("included fragment %q uses parameter %q not defined by route %q", fragment.Path, name, path)
+			}
+		}
+	}
+
+	if bodyRecipients > 1 {
+		return fmt.Errorf("route %q has more than one fragment receiving the request body", path)
+	}
+
+	return nil
+}
+
+// conflictsWith returns true when both routes handle the same method for the
+// same paths, e.g. `/users/:id` and `/users/:name`.
+func (r *Route) conflictsWith(other *Route) bool {
+	if r.Method != other.Method || r.Host != other.Host || len(r.Parts) != len(other.Parts) {
+		return false
+	}
+
+	for i, part := range r.Parts {
+		otherPart := other.Parts[i]
+		isParam := strings.HasPrefix(part, ":")
+
+		if isParam != strings.HasPrefix(otherPart, ":") || (!isParam && part != otherPart) {
+			return false
+		}
+
+		if isParam && constraintString(r.constraints[i]) != constraintString(other.constraints[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// path returns the route's path with each `:param` segment replaced by its
+// escaped value, returning an error when a parameter is missing or params
+// includes names the route doesn't have.
+func (r *Route) path(params map[string]string) (string, error) {
+	parts := make([]string, len(r.Parts))
+	used := make(map[string]bool)
+
+	for i, part := range r.Parts {
+		if !strings.HasPrefix(part, ":") {
+			parts[i] = part
+			continue
+		}
+
+		value, ok := params[part[1:]]
+		if !ok {
+			return "", fmt.Errorf("missing parameter %q for route %q", part[1:], r.Name)
+		}
+
+		if r.constraints[i] != nil && !r.constraints[i].MatchString(value) {
+			return "", fmt.Errorf("parameter %q for route %q doesn't match %s", part[1:], r.Name, r.constraints[i])
+		}
+
+		parts[i] = url.PathEscape(value)
+		used[part[1:]] = true
+	}
+
+	for name := range params {
+		if !used[name] {
+			return "", fmt.Errorf("unknown parameter %q for route %q", name, r.Name)
+		}
+	}
+
+	return strings.Join(parts, "/"), nil
+}
+
+// FragmentsToRequest returns the route's layout, when it has one, followed by
+// its fragments.
 func (r *Route) FragmentsToRequest() []*Fragment {
+	if r.Layout == nil {
+		return r.fragments
+	}
+
 	fragments := make([]*Fragment, len(r.fragments)+1)
 	fragments[0] = r.Layout
 
@@ -54,3 +319,24 @@ func (r *Route) FragmentsToRequest() []*Fragment {
 	}
 	return fragments
 }
+
+// errPathTraversal is returned when a route parameter would add a `.` or `..`
+// segment to a layout or fragment path.
+var errPathTraversal = errors.New("path traversal")
+
+// hasPathTraversal returns true when the given path or parameter value
+// contains a `..` segment, which could be used to escape the target's base
+// path when constructing upstream URLs.
+func hasPathTraversal(value string) bool {
+	segments := strings.FieldsFunc(value, func(r rune) bool {
+		return r == '/' || r == '\\'
+	})
+
+	for _, segment := range segments {
+		if segment == ".." {
+			return true
+		}
+	}
+
+	return false
+}
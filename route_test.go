@@ -1,6 +1,7 @@
 package viewproxy
 
 import (
+	"net/http"
 	"reflect"
 	"strings"
 	"testing"
@@ -20,11 +21,13 @@ func TestRouteMatch(t *testing.T) {
 		"multi false":       {routePath: "/hello/world", providedUrl: "/hello/false", want: false},
 		"named param":       {routePath: "/hello/:name", providedUrl: "/hello/world", want: true},
 		"named param false": {routePath: "/hello/:name", providedUrl: "/hello/world/wow", want: false},
+		"constraint":        {routePath: "/users/:id(\\d+)", providedUrl: "/users/42", want: true},
+		"constraint false":  {routePath: "/users/:id(\\d+)", providedUrl: "/users/blake", want: false},
 	}
 
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			route := newRoute(test.routePath, NewFragment(""), []*Fragment{})
+			route := newRoute(http.MethodGet, test.routePath, NewFragment(""), []*Fragment{}, RouteOptions{})
 			providedUrlParts := strings.Split(test.providedUrl, "/")
 			got := route.matchParts(providedUrlParts)
 
@@ -47,7 +50,7 @@ func TestRouteParameters(t *testing.T) {
 
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			route := newRoute(test.routePath, NewFragment(""), []*Fragment{})
+			route := newRoute(http.MethodGet, test.routePath, NewFragment(""), []*Fragment{}, RouteOptions{})
 			providedUrlParts := strings.Split(test.providedUrl, "/")
 			got := route.parametersFor(providedUrlParts)
 
@@ -59,7 +62,7 @@ func TestRouteParameters(t *testing.T) {
 }
 
 func TestLayout(t *testing.T) {
-	route := newRoute("/", NewFragment("my_layout"), []*Fragment{})
+	route := newRoute(http.MethodGet, "/", NewFragment("my_layout"), []*Fragment{}, RouteOptions{})
 
 	assert.Equal(t, *route.Layout, Fragment{
 		Path:     "my_layout",
@@ -67,3 +70,168 @@ func TestLayout(t *testing.T) {
 		Metadata: map[string]string{},
 	})
 }
+
+func TestHasPathTraversal(t *testing.T) {
+	tests := map[string]struct {
+		value string
+		want  bool
+	}{
+		"plain":              {value: "world", want: false},
+		"dots in name":       {value: "hello..world", want: false},
+		"single dot":         {value: ".", want: false},
+		"parent":             {value: "..", want: true},
+		"leading parent":     {value: "../secret", want: true},
+		"nested parent":      {value: "/hello/../../secret", want: true},
+		"backslash parent":   {value: "..\\secret", want: true},
+		"trailing separator": {value: "hello/../", want: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.want, hasPathTraversal(test.value))
+		})
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := map[string]struct {
+		path string
+		want string
+	}{
+		"root":             {path: "/", want: "/"},
+		"clean":            {path: "/hello/world", want: "/hello/world"},
+		"double slash":     {path: "/hello//world", want: "/hello/world"},
+		"leading slashes":  {path: "//hello/world", want: "/hello/world"},
+		"trailing slashes": {path: "/hello/world//", want: "/hello/world/"},
+		"trailing slash":   {path: "/hello/world/", want: "/hello/world/"},
+		"dot":              {path: "/hello/./world", want: "/hello/world"},
+		"encoded dot":      {path: "/hello/%2E/world", want: "/hello/world"},
+		"trailing dot":     {path: "/hello/world/.", want: "/hello/world/"},
+		"only slashes":     {path: "///", want: "/"},
+		"dots in name":     {path: "/hello/.world", want: "/hello/.world"},
+		"escaped slash":    {path: "/hello/a%2F%2Fb", want: "/hello/a%2F%2Fb"},
+		"parent":           {path: "/hello/../world", want: "/hello/../world"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.want, cleanPath(test.path))
+		})
+	}
+}
+
+func TestURLFor(t *testing.T) {
+	server := NewServer("http://localhost:3000")
+	server.GetWithOptions("/users/:user/posts/:id", NewFragment("layout"), []*Fragment{}, RouteOptions{Name: "user_post"})
+	err := server.LoadRoutesFromJSON(`[{"name": "user", "url": "/users/:user", "layout": { "path": "layout" }, "fragments": []}]`)
+	assert.Nil(t, err)
+
+	tests := map[string]struct {
+		name      string
+		params    map[string]string
+		want      string
+		wantError string
+	}{
+		"all params":    {name: "user_post", params: map[string]string{"user": "blake", "id": "1"}, want: "/users/blake/posts/1"},
+		"escaped":       {name: "user_post", params: map[string]string{"user": "a b/c", "id": "1"}, want: "/users/a%20b%2Fc/posts/1"},
+		"missing param": {name: "user_post", params: map[string]string{"user": "blake"}, wantError: `missing parameter "id" for route "user_post"`},
+		"extra param":   {name: "user_post", params: map[string]string{"user": "blake", "id": "1", "page": "2"}, wantError: `unknown parameter "page" for route "user_post"`},
+		"json route":    {name: "user", params: map[string]string{"user": "blake"}, want: "/users/blake"},
+		"unknown route": {name: "nope", params: map[string]string{}, wantError: `no route named "nope"`},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := server.URLFor(tc.name, tc.params)
+
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRouteValidation(t *testing.T) {
+	tests := map[string]struct {
+		paths     []string
+		wantError string
+	}{
+		"valid":                  {paths: []string{"/users/:id", "/users/new", "/users/:id/posts"}},
+		"missing slash":          {paths: []string{"users"}, wantError: `route "users" must start with /`},
+		"unnamed param":          {paths: []string{"/users/:"}, wantError: `route "/users/:" has a parameter without a name`},
+		"duplicate param":        {paths: []string{"/users/:id/posts/:id"}, wantError: `route "/users/:id/posts/:id" has duplicate parameter "id"`},
+		"identical patterns":     {paths: []string{"/users/:id", "/users/:id"}, wantError: "route GET /users/:id conflicts with /users/:id"},
+		"renamed param":          {paths: []string{"/users/:id", "/users/:name"}, wantError: "route GET /users/:name conflicts with /users/:id"},
+		"fragment params":        {paths: []string{"/widgets/:id"}},
+		"unknown fragment param": {paths: []string{"/widgets/:widget"}, wantError: `fragment "/widgets/:id/header" uses parameter "id" not defined by route "/widgets/:widget"`},
+		"constrained param":      {paths: []string{"/users/:id(\\d+)", "/users/:name"}},
+		"same constraint":        {paths: []string{"/users/:id(\\d+)", "/users/:user(\\d+)"}, wantError: "route GET /users/:user(\\d+) conflicts with /users/:id"},
+		"two body recipients":    {paths: []string{"/forms"}, wantError: `route "/forms" has more than one fragment receiving the request body`},
+		"bad regexp":             {paths: []string{"/users/:id(*)"}, wantError: "route \"/users/:id(*)\" has an invalid constraint: error parsing regexp: missing argument to repetition operator: `*`"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := NewServer("http://localhost:3000")
+
+			var err error
+			for _, path := range tc.paths {
+				fragments := []*Fragment{}
+				if strings.HasPrefix(path, "/widgets") {
+					fragments = append(fragments, NewFragment("/widgets/:id/header"))
+				}
+				if strings.HasPrefix(path, "/forms") {
+					fragments = append(fragments, &Fragment{Path: "/form", ReceivesBody: true}, &Fragment{Path: "/other_form", ReceivesBody: true})
+				}
+
+				if err = server.addRoute(http.MethodGet, path, NewFragment("layout"), fragments, RouteOptions{}); err != nil {
+					break
+				}
+			}
+
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestInvalidRoutePanics(t *testing.T) {
+	server := NewServer("http://localhost:3000")
+	server.Get("/users/:id", NewFragment("layout"), []*Fragment{})
+
+	assert.PanicsWithError(t, "route GET /users/:id conflicts with /users/:id", func() {
+		server.Get("/users/:id", NewFragment("layout"), []*Fragment{})
+	})
+	assert.NotPanics(t, func() {
+		server.Post("/users/:id", NewFragment("layout"), []*Fragment{})
+	})
+
+	err := server.LoadRoutesFromJSON(`[{"url": "/users/:", "layout": { "path": "layout" }, "fragments": []}]`)
+	assert.EqualError(t, err, `route "/users/:" has a parameter without a name`)
+}
+
+func TestMaxFragmentsPerRoute(t *testing.T) {
+	server := NewServer("http://localhost:3000")
+	server.MaxFragmentsPerRoute = 2
+
+	assert.NotPanics(t, func() {
+		server.Get("/two", NewFragment("layout"), []*Fragment{NewFragment("/one"), NewFragment("/two")})
+	})
+	assert.PanicsWithError(t, "route GET /three has 3 fragments, more than MaxFragmentsPerRoute (2)", func() {
+		server.Get("/three", NewFragment("layout"), []*Fragment{NewFragment("/one"), NewFragment("/two"), NewFragment("/three")})
+	})
+
+	err := server.LoadRoutesFromJSON(`[{"url": "/json", "layout": { "path": "layout" }, "fragments": [{"path": "/one"}, {"path": "/two"}, {"path": "/three"}]}]`)
+	assert.EqualError(t, err, "route GET /json has 3 fragments, more than MaxFragmentsPerRoute (2)")
+
+	server.MaxFragmentsPerRoute = 0
+	assert.NotPanics(t, func() {
+		server.Get("/unlimited", NewFragment("layout"), []*Fragment{NewFragment("/one"), NewFragment("/two"), NewFragment("/three")})
+	})
+}
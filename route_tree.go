@@ -0,0 +1,173 @@
+package viewproxy
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// routeNode is a node in a tree of routes keyed on path segments. Static
+// segments are stored in children while `:param` segments share a param
+// child per constraint, since the parameter name is only needed once a route
+// has been matched. Each node stores the routes registered for its path keyed
+// by HTTP method.
+type routeNode struct {
+	children      map[string]*routeNode
+	paramChildren []*paramNode
+	routes        map[string]*Route
+}
+
+// paramNode is the child for a `:param` segment, optionally constrained to
+// values matching a regular expression.
+type paramNode struct {
+	constraint *regexp.Regexp
+	node       *routeNode
+}
+
+func newRouteNode() *routeNode {
+	return &routeNode{
+		children: make(map[string]*routeNode),
+		routes:   make(map[string]*Route),
+	}
+}
+
+func (n *routeNode) insert(route *Route) {
+	node := n
+
+	for i, part := range route.Parts {
+		if strings.HasPrefix(part, ":") {
+			node = node.paramChild(route.constraints[i])
+		} else {
+			child, ok := node.children[part]
+			if !ok {
+				child = newRouteNode()
+				node.children[part] = child
+			}
+			node = child
+		}
+	}
+
+	// The first registered route wins, matching the previous behavior of
+	// scanning routes in registration order.
+	if _, ok := node.routes[route.Method]; !ok {
+		node.routes[route.Method] = route
+	}
+}
+
+// paramChild returns the child node for parameters with the given constraint,
+// creating it if needed. Constrained parameters are kept ahead of the
+// unconstrained one so they're tried first.
+func (n *routeNode) paramChild(constraint *regexp.Regexp) *routeNode {
+	for _, child := range n.paramChildren {
+		if constraintString(child.constraint) == constraintString(constraint) {
+			return child.node
+		}
+	}
+
+	child := &paramNode{constraint: constraint, node: newRouteNode()}
+	if constraint == nil || len(n.paramChildren) == 0 || n.paramChildren[len(n.paramChildren)-1].constraint != nil {
+		n.paramChildren = append(n.paramChildren, child)
+	} else {
+		last := len(n.paramChildren) - 1
+		n.paramChildren = append(n.paramChildren[:last], child, n.paramChildren[last])
+	}
+
+	return child.node
+}
+
+// lookup returns the node matching the given path parts that has a route for
+// method, or any route when method is empty. Static segments take precedence
+// over parameters, falling back to parameters when the static branch has no
+// matching route. Parameters whose constraint doesn't match are skipped.
+func (n *routeNode) lookup(pathParts []string, method string) *routeNode {
+	return n.lookupFold(pathParts, method, false)
+}
+
+// lookupFold is lookup, but when foldCase is true static segments also match
+// path parts that only differ by case. Exact matches are tried first, then
+// segments differing by case in sorted order.
+func (n *routeNode) lookupFold(pathParts []string, method string, foldCase bool) *routeNode {
+	if len(pathParts) == 0 {
+		if (method == "" && len(n.routes) > 0) || n.routeFor(method) != nil {
+			return n
+		}
+
+		return nil
+	}
+
+	if child, ok := n.children[pathParts[0]]; ok {
+		if node := child.lookupFold(pathParts[1:], method, foldCase); node != nil {
+			return node
+		}
+	}
+
+	if foldCase {
+		for _, part := range n.foldedChildren(pathParts[0]) {
+			if node := n.children[part].lookupFold(pathParts[1:], method, foldCase); node != nil {
+				return node
+			}
+		}
+	}
+
+	for _, child := range n.paramChildren {
+		if child.constraint != nil && !child.constraint.MatchString(pathParts[0]) {
+			continue
+		}
+
+		if node := child.node.lookupFold(pathParts[1:], method, foldCase); node != nil {
+			return node
+		}
+	}
+
+	return nil
+}
+
+// foldedChildren returns the sorted static segments that only differ from
+// part by case, so routes like `/Users` and `/USERS` match in the same order
+// on every request.
+func (n *routeNode) foldedChildren(part string) []string {
+	var parts []string
+	for child := range n.children {
+		if child != part && strings.EqualFold(child, part) {
+			parts = append(parts, child)
+		}
+	}
+
+	sort.Strings(parts)
+
+	return parts
+}
+
+// routeFor returns the route registered for method. HEAD requests are served
+// by GET routes when no HEAD route is registered.
+func (n *routeNode) routeFor(method string) *Route {
+	if route, ok := n.routes[method]; ok {
+		return route
+	}
+
+	if method == http.MethodHead {
+		return n.routes[http.MethodGet]
+	}
+
+	return nil
+}
+
+// allowedMethods returns the sorted methods that can be used for this node.
+func (n *routeNode) allowedMethods() []string {
+	methods := make([]string, 0, len(n.routes)+1)
+
+	for method := range n.routes {
+		methods = append(methods, method)
+	}
+
+	if _, ok := n.routes[http.MethodGet]; ok {
+		if _, ok := n.routes[http.MethodHead]; !ok {
+			methods = append(methods, http.MethodHead)
+		}
+	}
+
+	sort.Strings(methods)
+
+	return methods
+}
@@ -0,0 +1,184 @@
+package viewproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteTreeLookup(t *testing.T) {
+	root := newRouteNode()
+	routes := map[string]*Route{
+		"/":                  newRoute(http.MethodGet, "/", NewFragment("root"), []*Fragment{}, RouteOptions{}),
+		"/hello/:name":       newRoute(http.MethodGet, "/hello/:name", NewFragment("param"), []*Fragment{}, RouteOptions{}),
+		"/hello/world":       newRoute(http.MethodGet, "/hello/world", NewFragment("static"), []*Fragment{}, RouteOptions{}),
+		"/hello/:name/posts": newRoute(http.MethodGet, "/hello/:name/posts", NewFragment("posts"), []*Fragment{}, RouteOptions{}),
+		"/hello/world/about": newRoute(http.MethodGet, "/hello/world/about", NewFragment("about"), []*Fragment{}, RouteOptions{}),
+	}
+
+	for _, route := range routes {
+		root.insert(route)
+	}
+
+	tests := map[string]struct {
+		providedUrl string
+		want        *Route
+	}{
+		"root":                         {providedUrl: "/", want: routes["/"]},
+		"static wins":                  {providedUrl: "/hello/world", want: routes["/hello/world"]},
+		"param":                        {providedUrl: "/hello/you", want: routes["/hello/:name"]},
+		"param child":                  {providedUrl: "/hello/you/posts", want: routes["/hello/:name/posts"]},
+		"falls back to param":          {providedUrl: "/hello/world/posts", want: routes["/hello/:name/posts"]},
+		"static child":                 {providedUrl: "/hello/world/about", want: routes["/hello/world/about"]},
+		"missing":                      {providedUrl: "/goodbye", want: nil},
+		"too long":                     {providedUrl: "/hello/you/posts/1", want: nil},
+		"param does not match static":  {providedUrl: "/hello/you/about", want: nil},
+		"matches empty param segments": {providedUrl: "/hello/", want: routes["/hello/:name"]},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got *Route
+			if node := root.lookup(strings.Split(test.providedUrl, "/"), http.MethodGet); node != nil {
+				got = node.routeFor(http.MethodGet)
+			}
+
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestRouteTreeConstraints(t *testing.T) {
+	root := newRouteNode()
+	routes := map[string]*Route{
+		"/users/:name":          newRoute(http.MethodGet, "/users/:name", NewFragment("name"), []*Fragment{}, RouteOptions{}),
+		"/users/:id(\\d+)":      newRoute(http.MethodGet, "/users/:id(\\d+)", NewFragment("id"), []*Fragment{}, RouteOptions{}),
+		"/posts/:slug([a-z-]+)": newRoute(http.MethodGet, "/posts/:slug([a-z-]+)", NewFragment("slug"), []*Fragment{}, RouteOptions{}),
+	}
+
+	for _, route := range []string{"/users/:name", "/users/:id(\\d+)", "/posts/:slug([a-z-]+)"} {
+		root.insert(routes[route])
+	}
+
+	tests := map[string]struct {
+		providedUrl string
+		want        *Route
+	}{
+		"numeric":             {providedUrl: "/users/42", want: routes["/users/:id(\\d+)"]},
+		"falls through":       {providedUrl: "/users/blake", want: routes["/users/:name"]},
+		"partial numeric":     {providedUrl: "/users/42abc", want: routes["/users/:name"]},
+		"slug":                {providedUrl: "/posts/hello-world", want: routes["/posts/:slug([a-z-]+)"]},
+		"slug does not match": {providedUrl: "/posts/Hello_World", want: nil},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got *Route
+			if node := root.lookup(strings.Split(test.providedUrl, "/"), http.MethodGet); node != nil {
+				got = node.routeFor(http.MethodGet)
+			}
+
+			assert.Equal(t, test.want, got)
+		})
+	}
+
+	assert.Equal(t, map[string]string{"id": "42"}, routes["/users/:id(\\d+)"].parametersFor(strings.Split("/users/42", "/")))
+}
+
+func TestRouteTreeFirstRouteWins(t *testing.T) {
+	root := newRouteNode()
+	first := newRoute(http.MethodGet, "/hello/:name", NewFragment("first"), []*Fragment{}, RouteOptions{})
+	second := newRoute(http.MethodGet, "/hello/:id", NewFragment("second"), []*Fragment{}, RouteOptions{})
+
+	root.insert(first)
+	root.insert(second)
+
+	assert.Equal(t, first, root.lookup(strings.Split("/hello/world", "/"), http.MethodGet).routeFor(http.MethodGet))
+}
+
+func TestRouteTreeMethods(t *testing.T) {
+	root := newRouteNode()
+	getRoute := newRoute(http.MethodGet, "/hello/world", NewFragment("get"), []*Fragment{}, RouteOptions{})
+	postRoute := newRoute(http.MethodPost, "/hello/:name", NewFragment("post"), []*Fragment{}, RouteOptions{})
+	root.insert(getRoute)
+	root.insert(postRoute)
+
+	parts := strings.Split("/hello/world", "/")
+
+	assert.Equal(t, getRoute, root.lookup(parts, http.MethodGet).routeFor(http.MethodGet))
+	assert.Equal(t, getRoute, root.lookup(parts, http.MethodHead).routeFor(http.MethodHead))
+	assert.Equal(t, postRoute, root.lookup(parts, http.MethodPost).routeFor(http.MethodPost))
+	assert.Nil(t, root.lookup(parts, http.MethodPut))
+	assert.Equal(t, []string{"GET", "HEAD"}, root.lookup(parts, "").allowedMethods())
+	assert.Equal(t, []string{"POST"}, root.lookup(strings.Split("/hello/you", "/"), "").allowedMethods())
+}
+
+func TestRouteTreeFoldCase(t *testing.T) {
+	root := newRouteNode()
+	lower := newRoute(http.MethodGet, "/hello/:name", NewFragment("lower"), []*Fragment{}, RouteOptions{})
+	exact := newRoute(http.MethodGet, "/Hello/world", NewFragment("exact"), []*Fragment{}, RouteOptions{})
+	root.insert(lower)
+	root.insert(exact)
+
+	assert.Nil(t, root.lookup(strings.Split("/HELLO/you", "/"), http.MethodGet))
+	assert.Equal(t, lower, root.lookupFold(strings.Split("/HELLO/you", "/"), http.MethodGet, true).routeFor(http.MethodGet))
+	assert.Equal(t, exact, root.lookupFold(strings.Split("/Hello/world", "/"), http.MethodGet, true).routeFor(http.MethodGet))
+	assert.Equal(t, map[string]string{"name": "You"}, lower.parametersFor(strings.Split("/HELLO/You", "/")))
+}
+
+func TestRouteTreeFoldCaseIsDeterministic(t *testing.T) {
+	root := newRouteNode()
+	title := newRoute(http.MethodGet, "/Users", NewFragment("title"), []*Fragment{}, RouteOptions{})
+	upper := newRoute(http.MethodGet, "/USERS", NewFragment("upper"), []*Fragment{}, RouteOptions{})
+	lower := newRoute(http.MethodGet, "/users", NewFragment("lower"), []*Fragment{}, RouteOptions{})
+	root.insert(title)
+	root.insert(upper)
+	root.insert(lower)
+
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, lower, root.lookupFold(strings.Split("/users", "/"), http.MethodGet, true).routeFor(http.MethodGet))
+		assert.Equal(t, upper, root.lookupFold(strings.Split("/uSeRs", "/"), http.MethodGet, true).routeFor(http.MethodGet))
+	}
+}
+
+func benchmarkRoutes() []*Route {
+	routes := make([]*Route, 0, 500)
+
+	for i := 0; i < 500; i++ {
+		path := fmt.Sprintf("/section%d/:name/page%d", i%50, i)
+		routes = append(routes, newRoute(http.MethodGet, path, NewFragment("layout"), []*Fragment{}, RouteOptions{}))
+	}
+
+	return routes
+}
+
+func BenchmarkLinearRouteMatching(b *testing.B) {
+	routes := benchmarkRoutes()
+	parts := strings.Split("/section49/world/page499", "/")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, route := range routes {
+			if route.matchParts(parts) {
+				route.parametersFor(parts)
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkTreeRouteMatching(b *testing.B) {
+	root := newRouteNode()
+	for _, route := range benchmarkRoutes() {
+		root.insert(route)
+	}
+	parts := strings.Split("/section49/world/page499", "/")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		root.lookup(parts, http.MethodGet).routeFor(http.MethodGet).parametersFor(parts)
+	}
+}
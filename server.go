@@ -1,12 +1,20 @@
 package viewproxy
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/blakewilliams/viewproxy/internal/tracing"
@@ -18,25 +26,19 @@ import (
 // Re-export ResultError for convenience
 type ResultError = multiplexer.ResultError
 
-type logger interface {
-	Fatal(v ...interface{})
-	Fatalf(format string, v ...interface{})
-	Fatalln(v ...interface{})
-	Panic(v ...interface{})
-	Panicf(format string, v ...interface{})
-	Panicln(v ...interface{})
-	Print(v ...interface{})
-	Printf(format string, v ...interface{})
-	Println(v ...interface{})
-}
-
 type Server struct {
-	Port             int
-	ProxyTimeout     time.Duration
-	routes           []Route
-	target           string
-	Logger           logger
-	httpServer       *http.Server
+	Port         int
+	ProxyTimeout time.Duration
+	routes       []*Route
+	routeTrees   map[string]*routeNode
+	middleware   []func(http.Handler) http.Handler
+	target       string
+	Logger       Logger
+	httpServer   *http.Server
+	// Guards httpServer, which is set by ListenAndServe while Shutdown and
+	// Close may be called from another goroutine. It's a pointer since the
+	// server is copied by response builders.
+	httpServerMu     *sync.Mutex
 	DefaultPageTitle string
 	ignoreHeaders    []string
 	PassThrough      bool
@@ -44,9 +46,11 @@ type Server struct {
 	// server to validate that a request came from viewproxy.
 	//
 	// When set, two headers are sent to the target URL for fragment and layout
-	// requests. The `X-Authorization-Timestamp` header, which is a timestamp
-	// generated at the start of the request, and `X-Authorization`, which is a
-	// hex encoded HMAC of "urlPathWithQueryParams,timestamp`.
+	// requests. The `X-Authorization-Time` header, which is a unix timestamp
+	// generated at the start of the request, and `Authorization`, which is a
+	// hex encoded HMAC-SHA256 of "method,urlPathWithQueryParams,timestamp".
+	//
+	// Routes can override the secret with RouteOptions.HmacSecret.
 	HmacSecret string
 	// The transport passed to `http.Client` when fetching fragments or proxying
 	// requests.
@@ -54,41 +58,352 @@ type Server struct {
 	// A function that is called before the request is handled by viewproxy.
 	PreRequest    func(w http.ResponseWriter, r *http.Request)
 	tracingConfig tracing.TracingConfig
-	// A function that is called when an error occurs in the viewproxy handler
+	// A function that is called when an error occurs in the viewproxy handler,
+	// including recovered panics. When nil, a 504 is returned for timeouts,
+	// the layout or fragment's status when it responded with a 4xx or 5xx, a
+	// 500 for panics, and a 502 otherwise. Fetch errors are a
+	// *multiplexer.FetchError whose Kind classifies them.
 	OnError func(w http.ResponseWriter, r *http.Request, e error)
+	// A handler that is called when no route matches the request and
+	// PassThrough is disabled. When nil, a 404 is returned.
+	NotFoundHandler http.Handler
+	// The name of a response header used to report how much time was spent
+	// fetching from the target server versus composing the response, e.g.
+	// `backend=340ms;overhead=8ms`. The header is omitted when empty.
+	TimingHeader string
+	// When a fragment sets a title but the layout has no
+	// `{{{VIEW_PROXY_PAGE_TITLE}}}` placeholder, replace the contents of the
+	// layout's <title> tag instead. When false, or the layout has no <title>
+	// tag, a warning is logged and the title is dropped.
+	RewriteTitleTag bool
+	// Forward query parameters from the inbound request to the layout and
+	// fragments. Route parameters take precedence when names collide.
+	// Defaults to true.
+	ForwardQueryParams bool
+	// Open a new connection to the target for every fragment and proxied
+	// request instead of reusing connections, spreading requests across
+	// targets behind connection-pinning load balancers.
+	DisableKeepAlives bool
+	// The delimiters wrapping layout placeholders such as
+	// `{{{VIEW_PROXY_CONTENT}}}` and `{{{VIEW_PROXY_PAGE_TITLE}}}`. Defaults to
+	// `{{{` and `}}}`, and can be changed when they collide with client-side
+	// templating.
+	LeftDelimiter  string
+	RightDelimiter string
+	// How long Shutdown waits for in-flight requests to finish before
+	// cancelling their fragment requests. When zero, Shutdown waits until its
+	// context is done.
+	DrainTimeout time.Duration
+	// The TLS configuration used by ListenAndServeTLS, e.g. to restrict cipher
+	// suites or require client certificates.
+	TLSConfig *tls.Config
+	// Gzip the assembled response when the client accepts it and the body is
+	// at least CompressionMinSize bytes.
+	CompressResponses  bool
+	CompressionMinSize int
+	// The gzip level used for compressed responses, from gzip.HuffmanOnly to
+	// gzip.BestCompression, e.g. gzip.BestSpeed to save CPU on busy servers.
+	// Defaults to gzip.DefaultCompression, which is also used for invalid
+	// levels.
+	CompressionLevel int
+	// Called before the layout and each fragment is fetched with the outgoing
+	// request, the fragment, and the route parameters. The request's headers
+	// and URL can be modified, e.g. to add a tenant header. Fragments are
+	// fetched in parallel so it's called concurrently and must not modify the
+	// fragment or parameters.
+	BeforeFragment func(req *http.Request, fragment *Fragment, parameters map[string]string)
+	// Called with each successfully fetched layout and fragment result. Like
+	// BeforeFragment, it's called concurrently.
+	AfterFragment func(result *multiplexer.Result)
+	// When an optional fragment fails with a 5xx status, respond with that
+	// status instead of the layout's while still rendering its fallback.
+	PropagateFragmentErrors bool
+	// Collects request and fragment metrics, exposed by MetricsHandler. When
+	// nil, no metrics are collected.
+	Metrics *Metrics
+	// Paths for liveness and readiness probes, e.g. `/healthz` and `/readyz`,
+	// which respond with a 200 before routes are matched. Disabled when empty.
+	HealthPath string
+	ReadyPath  string
+	// Make a HEAD request to the target for readiness probes, responding with
+	// a 503 when it can't be reached.
+	ReadyProbesTarget bool
+	// Write the layout up to its content placeholder as soon as it arrives,
+	// then each fragment in order as it completes, flushing after each so the
+	// browser can start rendering. Responses are buffered instead when the
+	// layout has other placeholders, CompressResponses or
+	// CombineCacheControl is enabled, TimingHeader or EmitServerTiming is
+	// set, or fragment headers are allowed with AllowFragmentHeaders.
+	// Fragment cookies and titles aren't applied to streamed responses, and a
+	// fragment failing after the layout is written aborts the response.
+	StreamResponses bool
+	// The Content-Security-Policy header set on composed responses. Each
+	// `{{{VIEW_PROXY_NONCE}}}` placeholder in the policy, layout, and fragments
+	// is replaced with the same random nonce, generated per response, e.g.
+	// `script-src 'nonce-{{{VIEW_PROXY_NONCE}}}'`. Omitted when empty.
+	ContentSecurityPolicy string
+	// Generates the nonce used for `{{{VIEW_PROXY_NONCE}}}` placeholders. When
+	// nil, 16 random bytes from crypto/rand are base64 encoded.
+	GenerateNonce func() (string, error)
+	// Collapse whitespace and remove comments from text/html responses,
+	// leaving <pre>, <textarea>, <script>, and <style> contents untouched.
+	// Streamed responses aren't minified.
+	MinifyHTML bool
+	// Replace the layout's Cache-Control header with one no more cacheable
+	// than the layout and any fragment: the lowest max-age, and private,
+	// no-cache, or no-store when any of them set it. Responses without a
+	// Cache-Control header are treated as no-store.
+	CombineCacheControl bool
+	// Set a strong ETag computed from the assembled body on 200 responses
+	// that aren't no-store, and respond with a 304 to GET and HEAD requests
+	// whose If-None-Match matches it. The layout's ETag is never forwarded.
+	// Streamed responses, and HEAD requests to routes with a layout, which
+	// only fetch the layout's headers, don't get an ETag.
+	GenerateETags bool
+	// The layout used by routes defined after it's set that pass a nil layout
+	// or one with an empty path. When nil, those routes have no layout and
+	// respond with their fragments' bodies concatenated.
+	DefaultLayout *Fragment
+	// How paths that only differ from a route by a trailing slash are
+	// handled. Defaults to TrailingSlashStrict.
+	TrailingSlash TrailingSlashPolicy
+	// Match static path segments regardless of case, so `/Hello/World`
+	// matches a `/hello/:name` route. Parameter values, including their case,
+	// are passed to fragments as they were requested.
+	CaseInsensitive bool
+	// Rewrites the assembled body before it's written, e.g. to inject a
+	// `<base href>` tag. It runs after placeholders are replaced and before
+	// minification, the ETag, and compression. Streamed responses aren't
+	// transformed.
+	TransformResponse func(body []byte, r *http.Request) []byte
+	// How fragment content is handled when the layout has no
+	// `{{{VIEW_PROXY_CONTENT}}}` placeholder for it. Defaults to
+	// MissingPlaceholderWarn.
+	MissingContentPlaceholder MissingPlaceholderPolicy
+	// Compress the request body sent to a fragment with ReceivesBody using
+	// gzip, setting `Content-Encoding: gzip`. Bodies the client already
+	// encoded are forwarded as-is.
+	CompressFragmentBodies bool
+	// Whether layout and fragment requests follow redirects, e.g.
+	// multiplexer.RedirectFollowSameHost. By default redirects aren't
+	// followed and a layout redirect is relayed to the client.
+	FollowRedirects multiplexer.RedirectPolicy
+	// The hosts layouts, fragments, and passed through requests may be
+	// fetched from, including after redirects, e.g. `views.internal:3000`.
+	// Requests to other hosts fail with multiplexer.ErrHostNotAllowed. When
+	// empty, any host is allowed.
+	AllowedHosts []string
+	// When ProxyTimeout is reached, render the fragments that finished and
+	// each unfinished fragment's Fallback instead of failing the page. The
+	// page still fails when the layout didn't finish.
+	RenderPartialOnTimeout bool
+	// The header used to correlate logs for a request, e.g. `X-Request-Id`.
+	// The inbound request's ID is reused, or a random UUID is generated when
+	// it doesn't have one, and the ID is sent to the layout and fragments and
+	// set on the response. Disabled when empty.
+	RequestIDHeader string
+	// Merge the fragments of routes without a layout into a single JSON
+	// object keyed by fragment name when they return JSON, instead of
+	// concatenating their bodies. The fragment name comes from the `name`
+	// metadata key, and the request fails when a fragment isn't JSON or its
+	// JSON is malformed.
+	MergeJSONFragments bool
+	// The most fragments, not counting the layout, a route can be registered
+	// with. Registering a route with more panics, or returns an error from
+	// LoadRoutesFromJSON. Unlimited when 0.
+	MaxFragmentsPerRoute int
+	// The most retries shared by a page's layout and fragments. GET and HEAD
+	// requests that fail with a network error or a 5xx are retried until
+	// it's used up. Retries are disabled when 0.
+	RetryBudget int
+	// The path viewproxy is mounted under, e.g. `/app`, which is stripped
+	// from request paths before matching routes so routes are defined without
+	// it. Requests outside of it are not found. Redirects and URLFor include
+	// it.
+	PathPrefix string
+	// A path prepended to every layout and fragment path when fetching them,
+	// e.g. `/views` fetches `/views/header` for a `/header` fragment. Set it
+	// before defining routes.
+	UpstreamPathPrefix string
+	// When fragments are fetched relative to the layout. Defaults to
+	// FetchParallel. Routes with DynamicFragments always fetch the layout
+	// first.
+	FetchOrder FetchOrder
+	// A header clients set to their remaining time budget in milliseconds,
+	// e.g. `X-Timeout-Ms`. A budget smaller than the route's timeout is used
+	// instead, so viewproxy doesn't keep fetching after the client gave up.
+	// Larger budgets are ignored. Layouts and fragments receive the header
+	// with the timeout that was used. Disabled when empty.
+	TimeoutHeader string
+	// Set a `Server-Timing` header with how long the layout and each fragment
+	// took to fetch, e.g. `layout;dur=12.3, header;dur=4.1, total;dur=20.5`,
+	// so it's shown in browser developer tools. Fragments use their Name.
+	// Disabled by default since it exposes how pages are composed.
+	EmitServerTiming bool
+	// The most response header values, and the most bytes of header names
+	// and values, copied from the layout or pass through response. Headers
+	// beyond either limit are dropped with a warning, so a misbehaving target
+	// can't send clients thousands of headers. Unlimited when zero.
+	MaxResponseHeaders     int
+	MaxResponseHeaderBytes int
+	// Requests served by ListenAndServe derive from this context, which is
+	// cancelled by Shutdown once draining is complete.
+	baseContext       context.Context
+	cancelBaseContext context.CancelFunc
+	forwardCookies    []string
+	fragmentHeaders   []string
+	initialized       bool
+	includes          map[string]*Fragment
 }
 
 func NewServer(target string) *Server {
+	baseContext, cancelBaseContext := context.WithCancel(context.Background())
+
 	return &Server{
-		DefaultPageTitle: "viewproxy",
-		HttpTransport:    http.DefaultTransport,
-		Logger:           log.Default(),
-		Port:             3005,
-		ProxyTimeout:     time.Duration(10) * time.Second,
-		PassThrough:      false,
-		PreRequest:       func(http.ResponseWriter, *http.Request) {},
-		target:           target,
-		ignoreHeaders:    make([]string, 0),
-		routes:           make([]Route, 0),
-		tracingConfig:    tracing.TracingConfig{Enabled: false},
+		DefaultPageTitle:   "viewproxy",
+		CompressionMinSize: 1024,
+		CompressionLevel:   gzip.DefaultCompression,
+		ForwardQueryParams: true,
+		HttpTransport:      http.DefaultTransport,
+		LeftDelimiter:      "{{{",
+		Logger:             NewStdLogger(log.Default()),
+		Port:               3005,
+		ProxyTimeout:       time.Duration(10) * time.Second,
+		PassThrough:        false,
+		PreRequest:         func(http.ResponseWriter, *http.Request) {},
+		RightDelimiter:     "}}}",
+		target:             target,
+		ignoreHeaders:      make([]string, 0),
+		routes:             make([]*Route, 0),
+		routeTrees:         map[string]*routeNode{"": newRouteNode()},
+		tracingConfig:      tracing.TracingConfig{Enabled: false},
+		baseContext:        baseContext,
+		httpServerMu:       &sync.Mutex{},
+		cancelBaseContext:  cancelBaseContext,
 	}
 }
 
 func (s *Server) Get(path string, layout *Fragment, fragments []*Fragment) {
-	route := newRoute(path, layout, fragments)
+	s.handle(http.MethodGet, path, layout, fragments, RouteOptions{})
+}
+
+func (s *Server) GetWithOptions(path string, layout *Fragment, fragments []*Fragment, options RouteOptions) {
+	s.handle(http.MethodGet, path, layout, fragments, options)
+}
+
+func (s *Server) Post(path string, layout *Fragment, fragments []*Fragment) {
+	s.handle(http.MethodPost, path, layout, fragments, RouteOptions{})
+}
+
+func (s *Server) PostWithOptions(path string, layout *Fragment, fragments []*Fragment, options RouteOptions) {
+	s.handle(http.MethodPost, path, layout, fragments, options)
+}
+
+func (s *Server) Put(path string, layout *Fragment, fragments []*Fragment) {
+	s.handle(http.MethodPut, path, layout, fragments, RouteOptions{})
+}
+
+func (s *Server) PutWithOptions(path string, layout *Fragment, fragments []*Fragment, options RouteOptions) {
+	s.handle(http.MethodPut, path, layout, fragments, options)
+}
+
+func (s *Server) Patch(path string, layout *Fragment, fragments []*Fragment) {
+	s.handle(http.MethodPatch, path, layout, fragments, RouteOptions{})
+}
+
+func (s *Server) PatchWithOptions(path string, layout *Fragment, fragments []*Fragment, options RouteOptions) {
+	s.handle(http.MethodPatch, path, layout, fragments, options)
+}
+
+func (s *Server) Delete(path string, layout *Fragment, fragments []*Fragment) {
+	s.handle(http.MethodDelete, path, layout, fragments, RouteOptions{})
+}
+
+func (s *Server) DeleteWithOptions(path string, layout *Fragment, fragments []*Fragment, options RouteOptions) {
+	s.handle(http.MethodDelete, path, layout, fragments, options)
+}
+
+func (s *Server) handle(method string, path string, layout *Fragment, fragments []*Fragment, options RouteOptions) {
+	if err := s.addRoute(method, path, layout, fragments, options); err != nil {
+		// Routes are defined at boot time, so invalid routes should fail loudly
+		panic(err)
+	}
+}
+
+// addRoute registers a route, returning an error when the path is malformed
+// or conflicts with an existing route.
+func (s *Server) addRoute(method string, path string, layout *Fragment, fragments []*Fragment, options RouteOptions) error {
+	if layout == nil || layout.Path == "" {
+		layout = s.DefaultLayout
+	}
+
+	route := newRoute(method, path, layout, fragments, options)
+
+	if err := route.validate(s.includes); err != nil {
+		return err
+	}
+
+	if s.MaxFragmentsPerRoute > 0 && len(route.fragments) > s.MaxFragmentsPerRoute {
+		return fmt.Errorf("route %s %s has %d fragments, more than MaxFragmentsPerRoute (%d)", method, path, len(route.fragments), s.MaxFragmentsPerRoute)
+	}
 
-	layout.PreloadUrl(s.target)
-	for _, fragment := range fragments {
-		fragment.PreloadUrl(s.target)
+	for _, existing := range s.routes {
+		if existing.conflictsWith(route) {
+			return fmt.Errorf("route %s %s conflicts with %s", method, path, strings.Join(existing.Parts, "/"))
+		}
+	}
+
+	for _, fragment := range route.FragmentsToRequest() {
+		fragment.PreloadUrl(joinPaths(s.target, s.UpstreamPathPrefix))
+	}
+
+	tree, ok := s.routeTrees[route.Host]
+	if !ok {
+		tree = newRouteNode()
+		s.routeTrees[route.Host] = tree
 	}
 
-	s.routes = append(s.routes, *route)
+	s.routes = append(s.routes, route)
+	tree.insert(route)
+
+	return nil
 }
 
 func (s *Server) IgnoreHeader(name string) {
 	s.ignoreHeaders = append(s.ignoreHeaders, name)
 }
 
+// URLFor returns the path for the route with the given name, replacing its
+// `:param` segments with the values in params.
+func (s *Server) URLFor(name string, params map[string]string) (string, error) {
+	for _, route := range s.routes {
+		if route.Name == name {
+			path, err := route.path(params)
+			if err != nil {
+				return "", err
+			}
+
+			return s.withPathPrefix(path), nil
+		}
+	}
+
+	return "", fmt.Errorf("no route named %q", name)
+}
+
+// ForwardCookies allows the named cookies from the client's request to be
+// sent with layout and fragment requests. Other cookies are removed.
+func (s *Server) ForwardCookies(names []string) {
+	s.forwardCookies = append(s.forwardCookies, names...)
+}
+
+// AllowFragmentHeaders adds headers that fragments can set on the response,
+// e.g. `Vary`. When several fragments set an allowed header the last
+// fragment's value wins, except for `Vary` which combines every fragment's
+// values with the layout's.
+func (s *Server) AllowFragmentHeaders(names []string) {
+	s.fragmentHeaders = append(s.fragmentHeaders, names...)
+}
+
 func (s *Server) LoadRoutesFromFile(filePath string) error {
 	routeEntries, err := readConfigFile(filePath)
 	if err != nil {
@@ -116,110 +431,186 @@ func (s *Server) ConfigureTracing(endpoint string, serviceName string, insecure
 
 func (s *Server) loadRoutes(routeEntries []configRouteEntry) error {
 	for _, routeEntry := range routeEntries {
-		s.Logger.Printf("Defining %s, with layout %s, for fragments %v\n", routeEntry.Url, routeEntry.Layout, routeEntry.Fragments)
-		s.Get(routeEntry.Url, routeEntry.Layout, routeEntry.Fragments)
+		method := routeEntry.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+
+		s.Logger.Infof("Defining %s %s, with layout %s, for fragments %v", method, routeEntry.Url, routeEntry.Layout, routeEntry.Fragments)
+		err := s.addRoute(strings.ToUpper(method), routeEntry.Url, routeEntry.Layout, routeEntry.Fragments, RouteOptions{Name: routeEntry.Name})
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (s *Server) Shutdown(ctx context.Context) {
-	s.httpServer.Shutdown(ctx)
+// Shutdown stops accepting new requests and waits up to DrainTimeout, or until
+// ctx is done, for in-flight requests to finish. Fragment requests that are
+// still pending after that are cancelled and remaining connections are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.DrainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.DrainTimeout)
+		defer cancel()
+	}
+
+	httpServer := s.currentHTTPServer()
+	if httpServer == nil {
+		s.cancelBaseContext()
+		return nil
+	}
+
+	err := httpServer.Shutdown(ctx)
+	s.cancelBaseContext()
+
+	if err != nil {
+		httpServer.Close()
+	}
+
+	return err
 }
 
 func (s *Server) Close() {
-	s.httpServer.Close()
+	if httpServer := s.currentHTTPServer(); httpServer != nil {
+		httpServer.Close()
+	}
 }
 
-// TODO this should probably be a tree structure for faster lookups
-func (s *Server) matchingRoute(path string) (*Route, map[string]string) {
-	parts := strings.Split(path, "/")
+// currentHTTPServer returns the server started by ListenAndServe, or nil
+// when it hasn't been started.
+func (s *Server) currentHTTPServer() *http.Server {
+	s.httpServerMu.Lock()
+	defer s.httpServerMu.Unlock()
 
-	for _, route := range s.routes {
-		if route.matchParts(parts) {
-			parameters := route.parametersFor(parts)
-			return &route, parameters
+	return s.httpServer
+}
+
+// matchingRoute returns the route and parameters matching the given method,
+// host, and escaped path. Routes for the host are tried before routes without a host.
+// When a route matches the path but not the method, the methods allowed for
+// the path are returned instead.
+func (s *Server) matchingRoute(method string, host string, escapedPath string) (*Route, map[string]string, []string) {
+	parts := pathSegments(escapedPath)
+	trees := []*routeNode{s.routeTrees[""]}
+	if tree, ok := s.routeTrees[normalizeHost(host)]; ok && host != "" {
+		trees = []*routeNode{tree, s.routeTrees[""]}
+	}
+
+	for _, tree := range trees {
+		if node := tree.lookupFold(parts, method, s.CaseInsensitive); node != nil {
+			route := node.routeFor(method)
+			return route, route.parametersFor(parts), nil
 		}
 	}
 
-	return nil, nil
+	for _, tree := range trees {
+		if node := tree.lookupFold(parts, "", s.CaseInsensitive); node != nil {
+			return nil, nil, node.allowedMethods()
+		}
+	}
+
+	return nil, nil, nil
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+	start := time.Now()
+	ctx := r.Context()
 
 	tracer := otel.Tracer("server")
 	var span trace.Span
 	ctx, span = tracer.Start(ctx, "ServeHTTP")
 	defer span.End()
 
+	var routePattern string
+	if s.Metrics != nil {
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		w = recorder
+
+		s.Metrics.requestStarted()
+		defer func() {
+			s.Metrics.requestFinished(routePattern, r.Method, recorder.statusCode, time.Since(start))
+		}()
+	}
+
+	defer s.recoverPanic(w, r)
+
+	var underPrefix bool
+	if r, underPrefix = s.stripPathPrefix(r); !underPrefix {
+		s.notFound(w, r)
+		return
+	}
+
+	if s.serveProbe(w, r) {
+		return
+	}
+
+	s.setRequestID(w, r)
 	s.PreRequest(w, r)
-	route, parameters := s.matchingRoute(r.URL.Path)
 
-	if route != nil {
-		s.Logger.Printf("Handling %s\n", r.URL.Path)
-		req := multiplexer.NewRequest()
-		req.Timeout = s.ProxyTimeout
-		req.Transport = s.HttpTransport
-		req.HmacSecret = s.HmacSecret
+	if hasPathTraversal(r.URL.Path) {
+		s.Logger.Infof("Rejecting path traversal for %s", r.URL.Path)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 bad request"))
+		return
+	}
 
-		for _, f := range route.FragmentsToRequest() {
-			query := url.Values{}
-			for name, value := range parameters {
-				query.Add(name, value)
-			}
-			for name, values := range r.URL.Query() {
-				if query.Get(name) == "" {
-					for _, value := range values {
-						query.Add(name, value)
-					}
-				}
-			}
+	path := cleanPath(r.URL.EscapedPath())
+	route, parameters, allowedMethods := s.matchingRoute(r.Method, r.Host, path)
 
-			req.WithFragment(f.UrlWithParams(query), f.Metadata)
+	if route == nil && len(allowedMethods) == 0 && s.TrailingSlash != TrailingSlashStrict && path != "/" {
+		alternatePath := toggleTrailingSlash(path)
+		alternateRoute, alternateParameters, alternateMethods := s.matchingRoute(r.Method, r.Host, alternatePath)
+
+		if (alternateRoute != nil || len(alternateMethods) > 0) && s.TrailingSlash == TrailingSlashRedirect {
+			s.redirectToPath(w, r, alternatePath)
+			return
 		}
 
-		req.WithHeadersFromRequest(r)
-		results, err := req.Do(ctx)
+		route, parameters, allowedMethods = alternateRoute, alternateParameters, alternateMethods
+	}
 
-		if err != nil {
-			if s.OnError != nil {
-				s.OnError(w, r, err)
-				return
-			} else {
-				s.Logger.Printf("Errored %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte("500 internal server error"))
-				return
-			}
-		}
+	if route != nil {
+		routePattern = strings.Join(route.Parts, "/")
+
+		var match *routeMatch
+		ctx, match = withRouteMatch(ctx)
+		match.route = route
+		match.parameters = parameters
+
+		var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.serveRoute(w, r, route, parameters, start)
+		})
 
-		s.Logger.Printf("Fetched layout %s in %v", results[0].Url, results[0].Duration)
-		for _, result := range results[1:] {
-			s.Logger.Printf("Fetched %s in %v", result.Url, result.Duration)
+		for i := len(route.options.Middleware) - 1; i >= 0; i-- {
+			handler = route.options.Middleware[i](handler)
 		}
 
-		resBuilder := newResponseBuilder(*s, w)
-		resBuilder.SetLayout(results[0])
-		resBuilder.SetHeaders(results[0].HeadersWithoutProxyHeaders())
-		resBuilder.SetFragments(results[1:])
-		resBuilder.Write()
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	} else if len(allowedMethods) > 0 {
+		s.Logger.Debugf("Rendering 405 for %s %s", r.Method, r.URL.Path)
+		w.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("405 method not allowed"))
 	} else if s.PassThrough {
 		targetUrl, err := url.Parse(
 			fmt.Sprintf("%s/%s", strings.TrimRight(s.target, "/"), strings.TrimLeft(r.URL.String(), "/")),
 		)
 
-		targetUrl.RawQuery = r.URL.Query().Encode()
-
 		if err != nil {
-			s.handleProxyError(err, w)
+			s.handleError(w, r, err)
 			return
 		}
 
+		targetUrl.RawQuery = r.URL.Query().Encode()
+
 		req := multiplexer.NewRequest()
-		req.Timeout = s.ProxyTimeout
+		req.Timeout = s.requestTimeout(r, s.ProxyTimeout)
 		req.Transport = s.HttpTransport
 		req.Non2xxErrors = false
+		req.DisableKeepAlives = s.DisableKeepAlives
+		req.AllowedHosts = s.AllowedHosts
 
 		req.WithHeadersFromRequest(r)
 		result, err := req.DoSingle(
@@ -230,48 +621,471 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		)
 
 		if err != nil {
-			s.handleProxyError(err, w)
+			s.handleError(w, r, err)
 			return
 		}
-		s.Logger.Printf("Proxied %s in %v", result.Url, result.Duration)
+		s.Logger.Debugf("Proxied %s in %v", result.Url, result.Duration)
 
-		resBuilder := newResponseBuilder(*s, w)
+		resBuilder := newResponseBuilder(*s, w, r)
 		resBuilder.StatusCode = result.StatusCode
 		resBuilder.SetHeaders(result.HeadersWithoutProxyHeaders())
-		resBuilder.SetFragments([]*multiplexer.Result{result})
+		if err := resBuilder.SetFragments(nil, []*multiplexer.Result{result}); err != nil {
+			s.handleError(w, r, err)
+			return
+		}
+		resBuilder.SetTiming([]*multiplexer.Result{result}, start)
 		resBuilder.Write()
 	} else {
-		s.Logger.Printf("Rendering 404 for %s\n", r.URL.Path)
-		w.WriteHeader(404)
-		w.Write([]byte("404 not found"))
+		s.notFound(w, r)
 	}
 }
 
-func (s *Server) handleProxyError(err error, w http.ResponseWriter) {
-	s.Logger.Printf("Pass through error: %v", err)
+// notFound renders NotFoundHandler, or a 404 when it's nil.
+func (s *Server) notFound(w http.ResponseWriter, r *http.Request) {
+	if s.NotFoundHandler != nil {
+		s.NotFoundHandler.ServeHTTP(w, r)
+		return
+	}
+
+	s.Logger.Debugf("Rendering 404 for %s", r.URL.Path)
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte("404 not found"))
+}
+
+// serveRoute fetches the layout and fragments for route and writes the
+// composed response.
+func (s *Server) serveRoute(w http.ResponseWriter, r *http.Request, route *Route, parameters map[string]string, start time.Time) {
+	ctx := r.Context()
+	s.Logger.Debugf("Handling %s", r.URL.Path)
+
+	query := s.fragmentQuery(parameters, r)
+	fragments := route.FragmentsToRequest()
+
+	// HEAD requests only need the layout's status and headers, so fragments
+	// aren't fetched. Routes with dynamic fragments fetch the layout first to
+	// find out which fragments to fetch.
+	headersOnly := r.Method == http.MethodHead && route.Layout != nil
+	dynamic := route.options.DynamicFragments && route.Layout != nil && !headersOnly
+	layoutFirst := dynamic || (s.FetchOrder == FetchLayoutFirst && route.Layout != nil && !headersOnly)
+	if headersOnly || layoutFirst {
+		fragments = fragments[:1]
+	}
+
+	req, err := s.newRouteRequest(r, route, fragments, parameters, query)
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+
+	if headersOnly {
+		req.WithFragmentBody(0, http.MethodHead, nil)
+	}
+
+	// The layout, fragments, and every level of includes share a single
+	// timeout when they're fetched one after the other.
+	if layoutFirst || len(s.includes) > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.Timeout)
+		defer cancel()
+	}
+
+	var results []*multiplexer.Result
+	if route.Layout != nil && !headersOnly && !layoutFirst && len(s.includes) == 0 && s.StreamResponses && !s.CompressResponses && s.TimingHeader == "" && !s.EmitServerTiming && !s.CombineCacheControl && len(s.fragmentHeaders) == 0 {
+		stream := startFragmentStream(ctx, req, fragments)
+
+		if layout := stream.next(0); layout != nil && layout.Err == nil {
+			resBuilder := newResponseBuilder(*s, w, r)
+			resBuilder.SetLayout(layout)
+
+			if resBuilder.CanStream() {
+				s.Logger.Debugf("Streaming layout %s", layout.Url)
+				resBuilder.SetHeaders(layout.HeadersWithoutProxyHeaders())
+				if err := resBuilder.SetNonce(); err != nil {
+					stream.wait()
+					s.handleError(w, r, err)
+					return
+				}
+
+				resBuilder.Stream(route.fragments, stream)
+				return
+			}
+		}
+
+		results, err = stream.wait()
+	} else {
+		results, err = req.Do(ctx)
+	}
+
+	if err == nil && route.Layout != nil && len(results) > 0 && results[0].Err != nil {
+		err = results[0].Err
+	}
+
+	if err == nil && route.Layout == nil {
+		results = append([]*multiplexer.Result{noLayoutResult(results)}, results...)
+	}
+
+	if err == nil && len(results) == 0 {
+		err = errors.New("no results were returned for the layout")
+	}
+
+	if err != nil {
+		var resultErr *ResultError
+		if errors.As(err, &resultErr) && isRedirect(resultErr.Result) && route.Layout != nil && resultErr.Result.Url == route.Layout.UrlWithParams(query) {
+			s.Logger.Debugf("Layout %s redirected with %d", resultErr.Result.Url, resultErr.StatusCode())
+
+			resBuilder := newResponseBuilder(*s, w, r)
+			resBuilder.StatusCode = resultErr.StatusCode()
+			resBuilder.SetLayout(resultErr.Result)
+			resBuilder.SetHeaders(resultErr.Result.HeadersWithoutProxyHeaders())
+			resBuilder.Write()
+			return
+		}
+
+		s.handleError(w, r, err)
+		return
+	}
+
+	if headersOnly {
+		s.Logger.Debugf("Fetched layout headers %s in %v", results[0].Url, results[0].Duration)
+
+		resBuilder := newResponseBuilder(*s, w, r)
+		resBuilder.SetLayout(results[0])
+		resBuilder.SetHeaders(results[0].HeadersWithoutProxyHeaders())
+		resBuilder.WriteHeaders()
+		return
+	}
+
+	renderedFragments := route.fragments
+	if dynamic {
+		renderedFragments = s.dynamicFragments(route, results[0])
+	}
+
+	if layoutFirst {
+		fragmentReq, err := s.newRouteRequest(r, route, renderedFragments, parameters, query)
+		if err != nil {
+			s.handleError(w, r, err)
+			return
+		}
+
+		fragmentResults, err := fragmentReq.Do(ctx)
+		if err != nil {
+			s.handleError(w, r, err)
+			return
+		}
+
+		results = append(results[:1], fragmentResults...)
+	}
+
+	var requestID string
+	if s.RequestIDHeader != "" {
+		requestID = fmt.Sprintf(" (request %s)", r.Header.Get(s.RequestIDHeader))
+	}
+
+	s.Logger.Debugf("Fetched layout %s in %v%s", results[0].Url, results[0].Duration, requestID)
+	for _, result := range results[1:] {
+		s.Logger.Debugf("Fetched %s in %v%s", result.Url, result.Duration, requestID)
+	}
+
+	resBuilder := newResponseBuilder(*s, w, r)
+	resBuilder.SetLayout(results[0])
+	resBuilder.SetHeaders(results[0].HeadersWithoutProxyHeaders())
+	resBuilder.SetFragmentCookies(results[1:])
+	resBuilder.SetFragmentHeaders(results[1:])
+	if s.CombineCacheControl {
+		resBuilder.SetCacheControl(results)
+	}
+	if err := resBuilder.SetFragments(renderedFragments, results[1:]); err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	if len(s.includes) > 0 {
+		err := resBuilder.ResolveIncludes(func(fragments []*Fragment) ([]*multiplexer.Result, error) {
+			includeReq, err := s.newRouteRequest(r, route, fragments, parameters, query)
+			if err != nil {
+				return nil, err
+			}
+
+			return includeReq.Do(ctx)
+		})
+		if err != nil {
+			s.handleError(w, r, err)
+			return
+		}
+	}
+	if err := resBuilder.SetNonce(); err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+
+	resBuilder.SetTiming(results, start)
+	if s.EmitServerTiming {
+		resBuilder.SetServerTiming(route.Layout != nil, renderedFragments, results, start)
+	}
+	resBuilder.Write()
+}
+
+// newRouteRequest returns a request fetching fragments for route, which are
+// the route's layout and fragments or a subset of them. The request body is
+// read for a fragment that receives it.
+func (s *Server) newRouteRequest(r *http.Request, route *Route, fragments []*Fragment, parameters map[string]string, query url.Values) (*multiplexer.Request, error) {
+	req := multiplexer.NewRequest()
+	req.Timeout = s.requestTimeout(r, route.timeout(s.ProxyTimeout))
+	req.Transport = s.HttpTransport
+	req.HmacSecret = route.hmacSecret(s.HmacSecret)
+	req.DisableKeepAlives = s.DisableKeepAlives
+	req.CompressBodies = s.CompressFragmentBodies
+	req.FollowRedirects = s.FollowRedirects
+	req.AllowedHosts = s.AllowedHosts
+	req.PartialResults = s.RenderPartialOnTimeout
+	req.RetryBudget = s.RetryBudget
+
+	specs := make([]multiplexer.FragmentSpec, len(fragments))
+	for i, f := range fragments {
+		if err := f.checkPathParameters(parameters); err != nil {
+			return nil, err
+		}
+
+		specs[i] = multiplexer.FragmentSpec{
+			Url:           f.UrlWithParams(query),
+			Metadata:      f.Metadata,
+			Optional:      f != route.Layout && f.Optional,
+			SuccessStatus: f.SuccessStatus,
+			Header:        f.Headers,
+		}
+
+		if f.ReceivesBody && r.Body != nil {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				return nil, fmt.Errorf("could not read request body: %w", err)
+			}
+
+			specs[i].Method = r.Method
+			specs[i].Body = body
+		}
+	}
+	req.WithFragments(specs)
+
+	if s.BeforeFragment != nil {
+		req.BeforeFetch = func(i int, fragmentReq *http.Request) {
+			s.BeforeFragment(fragmentReq, fragments[i], parameters)
+		}
+	}
+
+	if s.AfterFragment != nil || s.Metrics != nil {
+		req.AfterFetch = func(i int, result *multiplexer.Result) {
+			if s.Metrics != nil {
+				s.Metrics.fragmentFetched(fragments[i].Path, result, nil)
+			}
+
+			if s.AfterFragment != nil {
+				s.AfterFragment(result)
+			}
+		}
+	}
+
+	if s.Metrics != nil {
+		req.FetchFailed = func(i int, err error) {
+			s.Metrics.fragmentFetched(fragments[i].Path, nil, err)
+		}
+	}
+
+	req.WithHeadersFromRequest(r)
+	multiplexer.FilterCookies(req.Header, s.forwardCookies)
+	if s.TimeoutHeader != "" {
+		req.Header.Set(s.TimeoutHeader, strconv.FormatInt(req.Timeout.Milliseconds(), 10))
+	}
+
+	return req, nil
+}
+
+// fragmentQuery returns the query parameters sent with fragment requests. Route
+// parameters take precedence over query parameters from the inbound request,
+// which are only included when ForwardQueryParams is enabled.
+func (s *Server) fragmentQuery(parameters map[string]string, r *http.Request) url.Values {
+	query := url.Values{}
+	for name, value := range parameters {
+		query.Add(name, value)
+	}
+
+	if !s.ForwardQueryParams {
+		return query
+	}
+
+	for name, values := range r.URL.Query() {
+		if _, ok := query[name]; !ok {
+			for _, value := range values {
+				query.Add(name, value)
+			}
+		}
+	}
+
+	return query
+}
+
+// noLayoutResult returns an empty layout result for routes without a layout,
+// using the first successful fragment's headers so its content type is kept.
+func noLayoutResult(results []*multiplexer.Result) *multiplexer.Result {
+	header := make(http.Header)
+	for _, result := range results {
+		if result.Err == nil {
+			header = result.Header().Clone()
+			header.Del("Content-Length")
+			header.Del("Set-Cookie")
+			break
+		}
+	}
+
+	return &multiplexer.Result{
+		HttpResponse: &http.Response{Header: header},
+		StatusCode:   http.StatusOK,
+	}
+}
+
+func isRedirect(result *multiplexer.Result) bool {
+	return result.StatusCode >= 300 && result.StatusCode <= 399 && result.Header().Get("Location") != ""
+}
+
+// recoverPanic recovers from a panic while serving r, logging it and
+// responding with a 500 or passing it to OnError when set.
+func (s *Server) recoverPanic(w http.ResponseWriter, r *http.Request) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	if recovered == http.ErrAbortHandler {
+		panic(recovered)
+	}
+
+	err := fmt.Errorf("panic serving %s: %v", r.URL.Path, recovered)
+	s.Logger.Errorf("%v\n%s", err, debug.Stack())
+
+	if s.OnError != nil {
+		s.OnError(w, r, err)
+		return
+	}
+
 	w.WriteHeader(http.StatusInternalServerError)
-	w.Write([]byte("Internal Server Error"))
+	w.Write([]byte("500 internal server error"))
+}
+
+// handleError calls OnError when set, otherwise it responds with a 502 since
+// the target could not be used to serve the request.
+func (s *Server) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	if s.OnError != nil {
+		s.OnError(w, r, err)
+		return
+	}
+
+	s.Logger.Errorf("Errored %v", err)
+	statusCode := errorStatus(err)
+	w.WriteHeader(statusCode)
+	w.Write([]byte(fmt.Sprintf("%d %s", statusCode, strings.ToLower(http.StatusText(statusCode)))))
+}
+
+// errorStatus returns the status code for a request that failed with err: a
+// 504 for timeouts, a 400 for parameters that would traverse fragment paths,
+// the layout or fragment's status when it responded with an error status, and
+// a 502 otherwise.
+func errorStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+
+	var fetchErr *multiplexer.FetchError
+	if errors.As(err, &fetchErr) && fetchErr.Kind == multiplexer.KindTimeout {
+		return http.StatusGatewayTimeout
+	}
+
+	if errors.Is(err, errPathTraversal) {
+		return http.StatusBadRequest
+	}
+
+	var resultErr *ResultError
+	if errors.As(err, &resultErr) && resultErr.StatusCode() >= 400 && resultErr.StatusCode() <= 599 {
+		return resultErr.StatusCode()
+	}
+
+	return http.StatusBadGateway
+}
+
+// Init prepares the server to handle requests once its routes and options are
+// set. It's called by Handler and ListenAndServe, and calling it again does
+// nothing.
+func (s *Server) Init() {
+	if s.initialized {
+		return
+	}
+	s.initialized = true
+
+	s.IgnoreHeader("Content-Length")
+}
+
+// Handler returns the server's routes wrapped in its middleware as an
+// http.Handler, for mounting viewproxy in an existing mux without calling
+// ListenAndServe, e.g. `mux.Handle("/app/", http.StripPrefix("/app",
+// server.Handler()))`. Middleware added with Use after calling Handler isn't
+// applied.
+func (s *Server) Handler() http.Handler {
+	s.Init()
+
+	return s.handler()
 }
 
 func (s *Server) ListenAndServe() error {
+	return s.serve(func(httpServer *http.Server) error {
+		return httpServer.ListenAndServe()
+	})
+}
+
+// ListenAndServeTLS serves HTTPS using the given certificate and key files,
+// with HTTP/2 enabled. TLSConfig can be set for advanced configuration like
+// cipher suites or client authentication.
+func (s *Server) ListenAndServeTLS(certFile string, keyFile string) error {
+	return s.serve(func(httpServer *http.Server) error {
+		return httpServer.ListenAndServeTLS(certFile, keyFile)
+	})
+}
+
+func (s *Server) serve(listen func(httpServer *http.Server) error) error {
 	shutdownTracing, err := tracing.Instrument(s.tracingConfig, s.Logger)
 	if err != nil {
-		log.Printf("Error instrumenting tracing: %v", err)
+		s.Logger.Errorf("Error instrumenting tracing: %v", err)
 	}
 
 	defer shutdownTracing()
 
-	s.IgnoreHeader("Content-Length")
-
-	s.httpServer = &http.Server{
+	httpServer := &http.Server{
 		Addr:           fmt.Sprintf(":%d", s.Port),
-		Handler:        s,
+		Handler:        s.Handler(),
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
+		TLSConfig:      s.tlsConfig(),
+		BaseContext: func(net.Listener) context.Context {
+			return s.baseContext
+		},
+	}
+
+	s.httpServerMu.Lock()
+	s.httpServer = httpServer
+	s.httpServerMu.Unlock()
+
+	s.Logger.Infof("Listening on port %d", s.Port)
+
+	return listen(httpServer)
+}
+
+// tlsConfig returns a copy of TLSConfig that advertises HTTP/2 via ALPN.
+func (s *Server) tlsConfig() *tls.Config {
+	config := &tls.Config{}
+	if s.TLSConfig != nil {
+		config = s.TLSConfig.Clone()
 	}
 
-	s.Logger.Printf("Listening on port %d\n", s.Port)
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
 
-	return s.httpServer.ListenAndServe()
+	return config
 }
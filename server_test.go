@@ -6,18 +6,28 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer/multiplexertest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -34,7 +44,7 @@ func TestMain(m *testing.M) {
 func TestServer(t *testing.T) {
 	viewProxyServer := NewServer(targetServer.URL)
 	viewProxyServer.Port = 9998
-	viewProxyServer.Logger = log.New(ioutil.Discard, "", log.Ldate|log.Ltime)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
 
 	viewProxyServer.IgnoreHeader("etag")
 	layout := NewFragment("/layouts/test_layout")
@@ -64,7 +74,7 @@ func TestServer(t *testing.T) {
 
 	file.Close()
 
-	viewProxyServer.Logger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	viewProxyServer.Logger = NewStdLogger(log.New(os.Stdout, "", log.Ldate|log.Ltime))
 
 	err = viewProxyServer.LoadRoutesFromFile(file.Name())
 	assert.Nil(t, err)
@@ -75,6 +85,7 @@ func TestServer(t *testing.T) {
 		}
 	}()
 	defer viewProxyServer.Close()
+	waitForServer(t, "localhost:9998")
 
 	tests := map[string]struct {
 		url           string
@@ -108,7 +119,7 @@ func TestServer(t *testing.T) {
 
 func TestQueryParamForwardingServer(t *testing.T) {
 	viewProxyServer := NewServer(targetServer.URL)
-	viewProxyServer.Logger = log.New(ioutil.Discard, "", log.Ldate|log.Ltime)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
 
 	viewProxyServer.IgnoreHeader("etag")
 	layout := NewFragment("/layouts/test_layout")
@@ -135,9 +146,55 @@ func TestQueryParamForwardingServer(t *testing.T) {
 	assert.Equal(t, "", resp.Header.Get("etag"), "Expected response to have removed etag header")
 }
 
+func TestQueryParamForwarding(t *testing.T) {
+	queries := make(chan url.Values, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		forwardQueryParams bool
+		url                string
+		expected           url.Values
+	}{
+		"route parameters take precedence": {
+			forwardQueryParams: true,
+			url:                "/hello/world?name=override&page=2",
+			expected:           url.Values{"name": {"world"}, "page": {"2"}},
+		},
+		"encoded values": {
+			forwardQueryParams: true,
+			url:                "/hello/world?q=a%26b%3Dc&tags=x&tags=y%20z",
+			expected:           url.Values{"name": {"world"}, "q": {"a&b=c"}, "tags": {"x", "y z"}},
+		},
+		"disabled": {
+			forwardQueryParams: false,
+			url:                "/hello/world?page=2&sort=asc",
+			expected:           url.Values{"name": {"world"}},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.ForwardQueryParams = tc.forwardQueryParams
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{})
+
+			r := httptest.NewRequest("GET", tc.url, nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.expected, <-queries)
+		})
+	}
+}
+
 func TestPassThroughEnabled(t *testing.T) {
 	viewProxyServer := NewServer(targetServer.URL)
-	viewProxyServer.Logger = log.New(ioutil.Discard, "", log.Ldate|log.Ltime)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
 	viewProxyServer.PassThrough = true
 
 	r := httptest.NewRequest("GET", "/oops", nil)
@@ -242,7 +299,7 @@ func TestFragmentSendsVerifiableHmacWhenSet(t *testing.T) {
 		time := r.Header.Get("X-Authorization-Time")
 		assert.NotEqual(t, "", time, "Expected X-Authorization-Time header to be present")
 
-		key := fmt.Sprintf("%s?%s,%s", r.URL.Path, r.URL.RawQuery, time)
+		key := fmt.Sprintf("%s,%s?%s,%s", r.Method, r.URL.Path, r.URL.RawQuery, time)
 
 		mac := hmac.New(sha256.New, []byte(secret))
 		mac.Write(
@@ -273,6 +330,83 @@ func TestFragmentSendsVerifiableHmacWhenSet(t *testing.T) {
 	server.Close()
 }
 
+func TestRouteHmacSecretOverridesServerSecret(t *testing.T) {
+	serverSecret := "6ccd9547b7042e0f1101ce68931d6b2c"
+	routeSecret := "f1b5e4e1e3b2a0d7c6f9a8b3c2d1e0f4"
+	authorizations := make(chan string, 2)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations <- r.Header.Get("Authorization")
+		authorizations <- r.Header.Get("X-Authorization-Time")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.HmacSecret = serverSecret
+	viewProxyServer.GetWithOptions("/hello/:name", NewFragment("/foo"), []*Fragment{}, RouteOptions{HmacSecret: routeSecret})
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+
+	viewProxyServer.ServeHTTP(w, r)
+
+	authorization := <-authorizations
+	timestamp := <-authorizations
+
+	mac := hmac.New(sha256.New, []byte(routeSecret))
+	mac.Write([]byte(fmt.Sprintf("GET,/foo?name=world,%s", timestamp)))
+
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), authorization)
+}
+
+func TestFragmentHooks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		case "/acme/header":
+			w.Write([]byte("acme header for " + r.Header.Get("X-Tenant")))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	var fetched []string
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.Get("/:tenant/home", NewFragment("/layout"), []*Fragment{NewFragment("/header")})
+	viewProxyServer.BeforeFragment = func(req *http.Request, fragment *Fragment, parameters map[string]string) {
+		req.Header.Set("X-Tenant", parameters["tenant"])
+
+		if fragment.Path == "/header" {
+			req.URL.Path = "/" + parameters["tenant"] + fragment.Path
+		}
+	}
+	viewProxyServer.AfterFragment = func(result *multiplexer.Result) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetched = append(fetched, result.Url)
+	}
+
+	r := httptest.NewRequest("GET", "/acme/home", nil)
+	w := httptest.NewRecorder()
+
+	viewProxyServer.ServeHTTP(w, r)
+
+	resp := w.Result()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "<body>acme header for acme</body>", string(body))
+	assert.ElementsMatch(t, []string{server.URL + "/layout?tenant=acme", server.URL + "/header?tenant=acme"}, fetched)
+}
+
 func TestFragmentSetsCorrectHeaders(t *testing.T) {
 	layoutDone := make(chan bool)
 	fragmentDone := make(chan bool)
@@ -286,6 +420,7 @@ func TestFragmentSetsCorrectHeaders(t *testing.T) {
 		assert.Equal(t, "", r.Header.Get("Keep-Alive"), "Expected Keep-Alive to be filtered")
 		assert.NotEqual(t, "", r.Header.Get("X-Forwarded-For"))
 		assert.Equal(t, "localhost:1", r.Header.Get("X-Forwarded-Host"))
+		assert.Equal(t, "inbound", r.Header.Get("X-Inbound"), "Expected inbound headers to be forwarded")
 		w.WriteHeader(http.StatusOK)
 	}))
 
@@ -293,6 +428,7 @@ func TestFragmentSetsCorrectHeaders(t *testing.T) {
 	viewProxyServer.Get("/hello/:name", NewFragment("/foo"), []*Fragment{NewFragment("/bar")})
 
 	r := httptest.NewRequest("GET", "/hello/world", strings.NewReader("hello"))
+	r.Header.Set("X-Inbound", "inbound")
 	r.Host = "localhost:1" // go deletes the Host header and sets the Host field
 	r.RemoteAddr = "localhost:1"
 	w := httptest.NewRecorder()
@@ -305,6 +441,42 @@ func TestFragmentSetsCorrectHeaders(t *testing.T) {
 	server.Close()
 }
 
+func TestForwardCookies(t *testing.T) {
+	cookies := make(chan string, 2)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies <- r.Header.Get("Cookie")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		forwardCookies []string
+		expectedCookie string
+	}{
+		"allowlisted": {forwardCookies: []string{"session", "locale"}, expectedCookie: "session=abc; locale=en"},
+		"none":        {forwardCookies: nil, expectedCookie: ""},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.ForwardCookies(tc.forwardCookies)
+			viewProxyServer.Get("/hello/:name", NewFragment("/foo"), []*Fragment{NewFragment("/bar")})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			r.Header.Set("Cookie", "session=abc; tracking=xyz; locale=en")
+			w := httptest.NewRecorder()
+
+			viewProxyServer.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.expectedCookie, <-cookies)
+			assert.Equal(t, tc.expectedCookie, <-cookies)
+		})
+	}
+}
+
 func TestSupportsGzip(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var b bytes.Buffer
@@ -348,6 +520,126 @@ func TestSupportsGzip(t *testing.T) {
 	server.Close()
 }
 
+func TestCompressResponses(t *testing.T) {
+	largeBody := strings.Repeat("hello world ", 200)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			w.Write([]byte(largeBody))
+		} else {
+			w.Write([]byte("small"))
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		compressResponses bool
+		compressionLevel  int
+		path              string
+		acceptEncoding    string
+		expectCompressed  bool
+		expectedBody      string
+	}{
+		"large accepted":     {compressResponses: true, path: "/large", acceptEncoding: "gzip, deflate", expectCompressed: true, expectedBody: largeBody},
+		"large wildcard":     {compressResponses: true, path: "/large", acceptEncoding: "*", expectCompressed: true, expectedBody: largeBody},
+		"large not accepted": {compressResponses: true, path: "/large", acceptEncoding: "", expectCompressed: false, expectedBody: largeBody},
+		"large refused":      {compressResponses: true, path: "/large", acceptEncoding: "gzip;q=0", expectCompressed: false, expectedBody: largeBody},
+		"small accepted":     {compressResponses: true, path: "/small", acceptEncoding: "gzip", expectCompressed: false, expectedBody: "small"},
+		"disabled":           {compressResponses: false, path: "/large", acceptEncoding: "gzip", expectCompressed: false, expectedBody: largeBody},
+		"best speed":         {compressResponses: true, compressionLevel: gzip.BestSpeed, path: "/large", acceptEncoding: "gzip", expectCompressed: true, expectedBody: largeBody},
+		"invalid level":      {compressResponses: true, compressionLevel: 42, path: "/large", acceptEncoding: "gzip", expectCompressed: true, expectedBody: largeBody},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.CompressResponses = tc.compressResponses
+			if tc.compressionLevel != 0 {
+				viewProxyServer.CompressionLevel = tc.compressionLevel
+			}
+			viewProxyServer.IgnoreHeader("Content-Encoding")
+			viewProxyServer.Get("/hello/:name", NewFragment(tc.path), []*Fragment{})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			w := httptest.NewRecorder()
+
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			var reader io.Reader = resp.Body
+			if tc.expectCompressed {
+				assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+				assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+
+				gzReader, err := gzip.NewReader(resp.Body)
+				assert.Nil(t, err)
+				reader = gzReader
+			} else {
+				assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+			}
+
+			body, err := ioutil.ReadAll(reader)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expectedBody, string(body))
+		})
+	}
+}
+
+func TestContentLengthMatchesAssembledBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layout" {
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		} else {
+			w.Write([]byte("hello world"))
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/fragment")})
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+
+	viewProxyServer.ServeHTTP(w, r)
+
+	resp := w.Result()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "<body>hello world</body>", string(body))
+	assert.Equal(t, strconv.Itoa(len(body)), resp.Header.Get("Content-Length"))
+}
+
+func TestGzippedLayoutIsDecodedForClientsWithoutGzip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gzWriter := gzip.NewWriter(w)
+		gzWriter.Write([]byte("hello"))
+		gzWriter.Close()
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{})
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	r.Header.Set("Accept-Encoding", "identity")
+	w := httptest.NewRecorder()
+
+	viewProxyServer.ServeHTTP(w, r)
+
+	resp := w.Result()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "hello", string(body))
+}
+
 func TestPrerequestCallback(t *testing.T) {
 	done := make(chan struct{})
 
@@ -371,77 +663,1675 @@ func TestPrerequestCallback(t *testing.T) {
 	<-done
 }
 
-func TestOnErrorHandler(t *testing.T) {
-	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
-	defer cancel()
-	done := make(chan struct{})
+func TestDefaultErrorResponse(t *testing.T) {
+	viewProxyServer := NewServer(targetServer.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.Get("/hello/:name", NewFragment("/definitely_missing_and_not_defined"), []*Fragment{})
 
-	server := NewServer(targetServer.URL)
-	server.Get("/hello/:name", NewFragment("/definitely_missing_and_not_defined"), []*Fragment{})
-	server.PreRequest = func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("x-viewproxy", "true")
-		assert.Equal(t, "192.168.1.1", r.RemoteAddr)
-	}
-	server.OnError = func(w http.ResponseWriter, r *http.Request, e error) {
-		defer close(done)
-		var resultErr *ResultError
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
 
-		assert.ErrorAs(t, e, &resultErr)
-		assert.Equal(
-			t,
-			fmt.Sprintf("%s/definitely_missing_and_not_defined?name=world", targetServer.URL),
-			resultErr.Result.Url,
-		)
-		assert.Equal(t, 404, resultErr.Result.StatusCode)
+	viewProxyServer.ServeHTTP(w, r)
+
+	resp := w.Result()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "404 not found", string(body))
+}
+
+func TestOptionalFragmentFallback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		case "/header", "/footer":
+			w.Write([]byte(r.URL.Path))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		optional     bool
+		expectedCode int
+		expectedBody string
+	}{
+		"optional": {optional: true, expectedCode: http.StatusOK, expectedBody: "<body>/header<div></div>/footer</body>"},
+		"required": {optional: false, expectedCode: http.StatusInternalServerError, expectedBody: "500 internal server error"},
 	}
 
-	fakeWriter := httptest.NewRecorder()
-	fakeRequest := httptest.NewRequest("GET", "/hello/world", nil)
-	fakeRequest.RemoteAddr = "192.168.1.1"
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			recommendations := NewFragment("/recommendations")
+			recommendations.Optional = tc.optional
+			recommendations.Fallback = "<div></div>"
 
-	server.ServeHTTP(fakeWriter, fakeRequest)
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/header"), recommendations, NewFragment("/footer")})
 
-	assert.Equal(t, "true", fakeWriter.Header().Get("x-viewproxy"))
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
 
-	select {
-	case <-done:
-	case <-ctx.Done():
-		assert.Fail(t, ctx.Err().Error())
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.expectedCode, resp.StatusCode)
+			assert.Equal(t, tc.expectedBody, string(body))
+		})
 	}
 }
 
-func startTargetServer() *httptest.Server {
-	instance := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		params := r.URL.Query()
+func TestHeadRequestsOnlyFetchLayoutHeaders(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
 
-		w.Header().Set("EtAg", "1234")
-		w.Header().Set("X-Name", "viewproxy")
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("X-Layout", "true")
+		w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+	}))
+	defer server.Close()
 
-		if r.URL.Path == "/layouts/test_layout" {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("<html>{{{VIEW_PROXY_CONTENT}}}</html>"))
-		} else if r.URL.Path == "/header" {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("<body>"))
-		} else if r.URL.Path == "/body" {
-			w.WriteHeader(http.StatusOK)
-			if params.Get("important") != "" {
-				w.Write([]byte(fmt.Sprintf("hello %s!", params.Get("name"))))
-			} else {
-				w.Write([]byte(fmt.Sprintf("hello %s", params.Get("name"))))
-			}
-		} else if r.URL.Path == "/footer" {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("</body>"))
-		} else if r.URL.Path == "/oops" {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Something went wrong"))
-		} else {
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/header"), NewFragment("/footer")})
+
+	r := httptest.NewRequest("HEAD", "/hello/world", nil)
+	w := httptest.NewRecorder()
+
+	viewProxyServer.ServeHTTP(w, r)
+
+	resp := w.Result()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "", string(body))
+	assert.Equal(t, "true", resp.Header.Get("X-Layout"))
+	assert.Equal(t, "text/html", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "", resp.Header.Get("Content-Length"))
+	assert.Equal(t, []string{"HEAD /layout"}, requests)
+}
+
+func TestFragmentSuccessStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		case "/recommendations":
 			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte("target: 404 not found"))
+		default:
+			w.Write([]byte(r.URL.Path))
 		}
-	})
+	}))
+	defer server.Close()
 
-	testServer := httptest.NewServer(instance)
-	return testServer
+	tests := map[string]struct {
+		successStatus func(int) bool
+		expectedCode  int
+		expectedBody  string
+	}{
+		"default": {expectedCode: http.StatusNotFound, expectedBody: "404 not found"},
+		"404 is successful": {
+			successStatus: func(statusCode int) bool { return statusCode == http.StatusNotFound || statusCode == http.StatusOK },
+			expectedCode:  http.StatusOK,
+			expectedBody:  "<body>/header/footer</body>",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			recommendations := NewFragment("/recommendations")
+			recommendations.SuccessStatus = tc.successStatus
+
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/header"), recommendations, NewFragment("/footer")})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+
+			viewProxyServer.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.expectedCode, w.Code)
+			assert.Equal(t, tc.expectedBody, w.Body.String())
+		})
+	}
+}
+
+func TestRenderPartialOnTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		case "/hanging_layout", "/hanging":
+			<-release
+		default:
+			w.Write([]byte(r.URL.Path))
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	tests := map[string]struct {
+		layout       string
+		partial      bool
+		streaming    bool
+		expectedCode int
+		expectedBody string
+	}{
+		"partial":              {layout: "/layout", partial: true, expectedCode: http.StatusOK, expectedBody: "<body>/fast<div></div></body>"},
+		"partial streaming":    {layout: "/layout", partial: true, streaming: true, expectedCode: http.StatusOK, expectedBody: "<body>/fast<div></div></body>"},
+		"not partial":          {layout: "/layout", partial: false, expectedCode: http.StatusGatewayTimeout, expectedBody: "504 gateway timeout"},
+		"layout didn't finish": {layout: "/hanging_layout", partial: true, expectedCode: http.StatusGatewayTimeout, expectedBody: "504 gateway timeout"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			hanging := NewFragment("/hanging")
+			hanging.Fallback = "<div></div>"
+
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.ProxyTimeout = time.Duration(100) * time.Millisecond
+			viewProxyServer.RenderPartialOnTimeout = tc.partial
+			viewProxyServer.StreamResponses = tc.streaming
+			viewProxyServer.Get("/hello/:name", NewFragment(tc.layout), []*Fragment{NewFragment("/fast"), hanging})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.expectedCode, resp.StatusCode)
+			assert.Equal(t, tc.expectedBody, string(body))
+		})
+	}
+}
+
+func TestFragmentCookiesAreAggregated(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Header().Add("Set-Cookie", "layout=1")
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		case "/session":
+			w.Header().Add("Set-Cookie", "session=abc; HttpOnly")
+			w.Header().Add("Set-Cookie", "layout=1")
+		case "/preferences":
+			w.Header().Add("Set-Cookie", "theme=dark")
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		ignoreSetCookie bool
+		expectedCookies []string
+	}{
+		"aggregated": {expectedCookies: []string{"layout=1", "session=abc; HttpOnly", "theme=dark"}},
+		"ignored":    {ignoreSetCookie: true, expectedCookies: nil},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			if tc.ignoreSetCookie {
+				viewProxyServer.IgnoreHeader("set-cookie")
+			}
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/session"), NewFragment("/preferences")})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, tc.expectedCookies, resp.Header.Values("Set-Cookie"))
+		})
+	}
+}
+
+func TestAllowFragmentHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Header().Set("Vary", "Cookie")
+			w.Header().Set("X-Layout", "layout")
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		case "/header":
+			w.Header().Set("Vary", "Accept-Language, cookie")
+			w.Header().Set("X-Layout", "header")
+			w.Header().Set("X-Fragment", "header")
+			w.Header().Set("X-Secret", "secret")
+		case "/footer":
+			w.Header().Set("Vary", "User-Agent")
+			w.Header().Set("X-Fragment", "footer")
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		allowedHeaders []string
+		ignoredHeader  string
+		expected       http.Header
+	}{
+		"none": {
+			expected: http.Header{"Vary": {"Cookie"}, "X-Layout": {"layout"}, "X-Fragment": nil},
+		},
+		"allowlisted": {
+			allowedHeaders: []string{"vary", "X-Layout", "X-Fragment"},
+			expected:       http.Header{"Vary": {"Cookie, Accept-Language, User-Agent"}, "X-Layout": {"header"}, "X-Fragment": {"footer"}},
+		},
+		"ignored": {
+			allowedHeaders: []string{"X-Fragment"},
+			ignoredHeader:  "x-fragment",
+			expected:       http.Header{"Vary": {"Cookie"}, "X-Layout": {"layout"}, "X-Fragment": nil},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.AllowFragmentHeaders(tc.allowedHeaders)
+			if tc.ignoredHeader != "" {
+				viewProxyServer.IgnoreHeader(tc.ignoredHeader)
+			}
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/header"), NewFragment("/footer")})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			for name, values := range tc.expected {
+				assert.Equal(t, values, resp.Header.Values(name), name)
+			}
+			assert.Empty(t, resp.Header.Get("X-Secret"))
+		})
+	}
+}
+
+func TestPanicsAreRecovered(t *testing.T) {
+	tests := map[string]struct {
+		onError      func(w http.ResponseWriter, r *http.Request, err error)
+		expectedCode int
+		expectedBody string
+	}{
+		"default": {expectedCode: http.StatusInternalServerError, expectedBody: "500 internal server error"},
+		"on error": {
+			onError: func(w http.ResponseWriter, r *http.Request, err error) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(err.Error()))
+			},
+			expectedCode: http.StatusServiceUnavailable,
+			expectedBody: "panic serving /hello/world: oops",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer(targetServer.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.OnError = tc.onError
+			viewProxyServer.PreRequest = func(w http.ResponseWriter, r *http.Request) {
+				panic("oops")
+			}
+			viewProxyServer.Get("/hello/:name", NewFragment("/layouts/test_layout"), []*Fragment{})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+
+			assert.NotPanics(t, func() {
+				viewProxyServer.ServeHTTP(w, r)
+			})
+
+			resp := w.Result()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.expectedCode, resp.StatusCode)
+			assert.Equal(t, tc.expectedBody, string(body))
+		})
+	}
+}
+
+func TestLayoutStatusIsUsed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.Post("/things", NewFragment("/layout"), []*Fragment{})
+
+	r := httptest.NewRequest("POST", "/things", nil)
+	w := httptest.NewRecorder()
+
+	viewProxyServer.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusCreated, w.Result().StatusCode)
+}
+
+func TestFragmentStatusPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layout" {
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		optional                bool
+		propagateFragmentErrors bool
+		expectedCode            int
+		expectedBody            string
+	}{
+		"required fragment":   {optional: false, expectedCode: http.StatusInternalServerError, expectedBody: "500 internal server error"},
+		"optional fragment":   {optional: true, expectedCode: http.StatusOK, expectedBody: "<body>unavailable</body>"},
+		"propagated fragment": {optional: true, propagateFragmentErrors: true, expectedCode: http.StatusInternalServerError, expectedBody: "<body>unavailable</body>"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			fragment := NewFragment("/broken")
+			fragment.Optional = tc.optional
+			fragment.Fallback = "unavailable"
+
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.PropagateFragmentErrors = tc.propagateFragmentErrors
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{fragment})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.expectedCode, resp.StatusCode)
+			assert.Equal(t, tc.expectedBody, string(body))
+		})
+	}
+}
+
+func TestNotFoundHandler(t *testing.T) {
+	viewProxyServer := NewServer(targetServer.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("nothing at %s", r.URL.Path)))
+	})
+
+	r := httptest.NewRequest("GET", "/missing", nil)
+	w := httptest.NewRecorder()
+
+	viewProxyServer.ServeHTTP(w, r)
+
+	resp := w.Result()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "nothing at /missing", string(body))
+}
+
+func TestLayoutRedirectIsRelayed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layout" {
+			http.Redirect(w, r, "/new-home", http.StatusMovedPermanently)
+		} else {
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte("hello"))
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/fragment")})
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+
+	viewProxyServer.ServeHTTP(w, r)
+
+	resp := w.Result()
+
+	assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	assert.Equal(t, "/new-home", resp.Header.Get("Location"))
+}
+
+func TestOnErrorHandler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+
+	server := NewServer(targetServer.URL)
+	server.Get("/hello/:name", NewFragment("/definitely_missing_and_not_defined"), []*Fragment{})
+	server.PreRequest = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-viewproxy", "true")
+		assert.Equal(t, "192.168.1.1", r.RemoteAddr)
+	}
+	server.OnError = func(w http.ResponseWriter, r *http.Request, e error) {
+		defer close(done)
+		var resultErr *ResultError
+
+		assert.ErrorAs(t, e, &resultErr)
+		assert.Equal(
+			t,
+			fmt.Sprintf("%s/definitely_missing_and_not_defined?name=world", targetServer.URL),
+			resultErr.Result.Url,
+		)
+		assert.Equal(t, 404, resultErr.Result.StatusCode)
+	}
+
+	fakeWriter := httptest.NewRecorder()
+	fakeRequest := httptest.NewRequest("GET", "/hello/world", nil)
+	fakeRequest.RemoteAddr = "192.168.1.1"
+
+	server.ServeHTTP(fakeWriter, fakeRequest)
+
+	assert.Equal(t, "true", fakeWriter.Header().Get("x-viewproxy"))
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		assert.Fail(t, ctx.Err().Error())
+	}
+}
+
+func TestPathTraversalIsRejected(t *testing.T) {
+	tests := map[string]struct {
+		url         string
+		passThrough bool
+	}{
+		"route parameter":           {url: "/hello/..", passThrough: false},
+		"encoded route parameter":   {url: "/hello/%2e%2e", passThrough: false},
+		"pass through":              {url: "/../secret", passThrough: true},
+		"nested pass through":       {url: "/oops/../../secret", passThrough: true},
+		"backslash route parameter": {url: "/hello/..%5C", passThrough: false},
+		"encoded slash parameter":   {url: "/hello/a%2F..%2F..", passThrough: false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			requested := false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requested = true
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.PassThrough = tc.passThrough
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{})
+
+			r := httptest.NewRequest("GET", tc.url, nil)
+			w := httptest.NewRecorder()
+
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			assert.Equal(t, "400 bad request", string(body))
+			assert.False(t, requested, "Expected target server to not be requested")
+		})
+	}
+}
+
+func TestRepeatedSlashesAndDotSegmentsAreNormalized(t *testing.T) {
+	tests := map[string]struct {
+		url          string
+		expectedPath string
+	}{
+		"double slash":    {url: "/hello//world", expectedPath: "/greetings/world"},
+		"leading slashes": {url: "//hello/world", expectedPath: "/greetings/world"},
+		"dot segment":     {url: "/hello/./world", expectedPath: "/greetings/world"},
+		"encoded dot":     {url: "/hello/%2e/world", expectedPath: "/greetings/world"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			transport := multiplexertest.NewTransport()
+			transport.Add("http://views.internal/layout", multiplexertest.Response{Body: "{{{VIEW_PROXY_CONTENT}}}"})
+			transport.Add("http://views.internal/greetings/world", multiplexertest.Response{Body: "hello world"})
+
+			viewProxyServer := NewServer("http://views.internal")
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.HttpTransport = transport
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/greetings/:name")})
+
+			r := httptest.NewRequest("GET", tc.url, nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "hello world", string(body))
+
+			paths := make([]string, 0)
+			for _, req := range transport.Requests() {
+				paths = append(paths, req.URL.Path)
+			}
+			assert.ElementsMatch(t, []string{"/layout", tc.expectedPath}, paths)
+		})
+	}
+}
+
+func TestClientDisconnectCancelsFragmentRequests(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.Get("/hello/:name", NewFragment("/slow"), []*Fragment{})
+
+	proxy := httptest.NewServer(viewProxyServer)
+	defer proxy.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/hello/world", proxy.URL), nil)
+	assert.Nil(t, err)
+
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	_, err = http.DefaultClient.Do(req)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Expected fragment request to be cancelled when the client disconnected")
+	}
+}
+
+func TestTimingHeader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layout" {
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		} else {
+			time.Sleep(10 * time.Millisecond)
+			w.Write([]byte("hello"))
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/fragment")})
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.ServeHTTP(w, r)
+
+	assert.Equal(t, "", w.Result().Header.Get("X-View-Proxy-Timing"), "Expected timing header to be disabled by default")
+
+	viewProxyServer.TimingHeader = "X-View-Proxy-Timing"
+
+	r = httptest.NewRequest("GET", "/hello/world", nil)
+	w = httptest.NewRecorder()
+	viewProxyServer.ServeHTTP(w, r)
+
+	var backend, overhead int
+	_, err := fmt.Sscanf(w.Result().Header.Get("X-View-Proxy-Timing"), "backend=%dms;overhead=%dms", &backend, &overhead)
+	assert.Nil(t, err)
+
+	assert.GreaterOrEqual(t, backend, 50)
+	assert.Less(t, backend, 1000)
+	assert.GreaterOrEqual(t, overhead, 0)
+	assert.Less(t, overhead, 50)
+}
+
+func TestRouteMethods(t *testing.T) {
+	viewProxyServer := NewServer(targetServer.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.PassThrough = true
+	layout := NewFragment("/layouts/test_layout")
+	fragments := []*Fragment{NewFragment("header"), NewFragment("body"), NewFragment("footer")}
+	viewProxyServer.Get("/hello/:name", layout, fragments)
+	viewProxyServer.Post("/hello/:name", layout, fragments)
+	viewProxyServer.Delete("/goodbye/:name", layout, fragments)
+
+	err := viewProxyServer.LoadRoutesFromJSON(`[{
+		"method": "put",
+		"url": "/greetings/:name",
+		"layout": { "path": "/layouts/test_layout" },
+		"fragments": [{ "path": "header" }, { "path": "body" }, { "path": "footer" }]
+	}]`)
+	assert.Nil(t, err)
+
+	tests := map[string]struct {
+		method        string
+		url           string
+		expectedCode  int
+		expectedBody  string
+		expectedAllow string
+	}{
+		"get":          {method: "GET", url: "/hello/world", expectedCode: 200, expectedBody: "<html><body>hello world</body></html>"},
+		"post":         {method: "POST", url: "/hello/world", expectedCode: 200, expectedBody: "<html><body>hello world</body></html>"},
+		"json put":     {method: "PUT", url: "/greetings/world", expectedCode: 200, expectedBody: "<html><body>hello world</body></html>"},
+		"not allowed":  {method: "PATCH", url: "/hello/world", expectedCode: 405, expectedBody: "405 method not allowed", expectedAllow: "GET, HEAD, POST"},
+		"delete only":  {method: "GET", url: "/goodbye/world", expectedCode: 405, expectedBody: "405 method not allowed", expectedAllow: "DELETE"},
+		"json not get": {method: "GET", url: "/greetings/world", expectedCode: 405, expectedBody: "405 method not allowed", expectedAllow: "PUT"},
+		"pass through": {method: "POST", url: "/oops", expectedCode: 500, expectedBody: "Something went wrong"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.url, nil)
+			w := httptest.NewRecorder()
+
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.expectedCode, resp.StatusCode)
+			assert.Equal(t, tc.expectedBody, string(body))
+			assert.Equal(t, tc.expectedAllow, resp.Header.Get("Allow"))
+		})
+	}
+}
+
+func TestRouteTimeoutOverridesProxyTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.ProxyTimeout = 20 * time.Millisecond
+	viewProxyServer.Get("/footer", NewFragment("/layout"), []*Fragment{})
+	viewProxyServer.GetWithOptions("/search", NewFragment("/layout"), []*Fragment{}, RouteOptions{Timeout: time.Second})
+
+	tests := map[string]struct {
+		url          string
+		expectedCode int
+		expectedBody string
+	}{
+		"server timeout": {url: "/footer", expectedCode: http.StatusGatewayTimeout, expectedBody: "504 gateway timeout"},
+		"route timeout":  {url: "/search", expectedCode: http.StatusOK, expectedBody: "slow"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tc.url, nil)
+			w := httptest.NewRecorder()
+
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.expectedCode, resp.StatusCode)
+			assert.Equal(t, tc.expectedBody, string(body))
+		})
+	}
+}
+
+func TestNamedContentSlots(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layout" {
+			w.Write([]byte("<aside>{{{VIEW_PROXY_CONTENT:sidebar}}}</aside><main>{{{VIEW_PROXY_CONTENT:main}}}</main><div>{{{VIEW_PROXY_CONTENT}}}</div><nav>{{{VIEW_PROXY_CONTENT:empty}}}</nav>"))
+		} else {
+			w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{
+		NewFragmentWithMetadata("/main1", map[string]string{"slot": "main"}),
+		NewFragmentWithMetadata("/side1", map[string]string{"slot": "sidebar"}),
+		NewFragment("/default1"),
+		NewFragmentWithMetadata("/main2", map[string]string{"slot": "main"}),
+		NewFragmentWithMetadata("/missing", map[string]string{"slot": "missing"}),
+	})
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.ServeHTTP(w, r)
+
+	body, err := ioutil.ReadAll(w.Result().Body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "<aside>side1</aside><main>main1main2</main><div>default1missing</div><nav></nav>", string(body))
+}
+
+func TestFragmentOrderWithinSlots(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layout" {
+			w.Write([]byte("<main>{{{VIEW_PROXY_CONTENT:main}}}</main><div>{{{VIEW_PROXY_CONTENT}}}</div>"))
+		} else {
+			w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{
+		NewFragmentWithMetadata("/main1", map[string]string{"slot": "main", "order": "2"}),
+		NewFragmentWithMetadata("/default1", map[string]string{"order": "1"}),
+		NewFragmentWithMetadata("/main2", map[string]string{"slot": "main", "order": "1"}),
+		NewFragmentWithMetadata("/default2", map[string]string{"order": "invalid", "unknown": "ignored"}),
+		NewFragmentWithMetadata("/main3", map[string]string{"slot": "main"}),
+	})
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.ServeHTTP(w, r)
+
+	body, err := ioutil.ReadAll(w.Result().Body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "<main>main3main2main1</main><div>default2default1</div>", string(body))
+}
+
+func TestRoutesWithoutLayout(t *testing.T) {
+	var layoutRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/default_layout":
+			atomic.AddInt32(&layoutRequests, 1)
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		case "/":
+			atomic.AddInt32(&layoutRequests, 1)
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		defaultLayout       *Fragment
+		layout              *Fragment
+		expectedBody        string
+		expectedContentType string
+		expectedLayouts     int32
+	}{
+		"nil layout":     {layout: nil, expectedBody: "onetwo", expectedContentType: "application/json"},
+		"empty layout":   {layout: NewFragment(""), expectedBody: "onetwo", expectedContentType: "application/json"},
+		"default layout": {defaultLayout: NewFragment("/default_layout"), layout: NewFragment(""), expectedBody: "<body>onetwo</body>", expectedContentType: "text/html", expectedLayouts: 1},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			atomic.StoreInt32(&layoutRequests, 0)
+
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.DefaultLayout = tc.defaultLayout
+			viewProxyServer.Get("/hello/:name", tc.layout, []*Fragment{NewFragment("/one"), NewFragment("/two")})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, tc.expectedBody, string(body))
+			assert.Equal(t, tc.expectedContentType, resp.Header.Get("Content-Type"))
+			assert.Equal(t, tc.expectedLayouts, atomic.LoadInt32(&layoutRequests))
+		})
+	}
+}
+
+func TestCaseInsensitiveRouting(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path + "?" + r.URL.RawQuery))
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		caseInsensitive bool
+		expectedCode    int
+		expectedBody    string
+	}{
+		"disabled": {caseInsensitive: false, expectedCode: 404, expectedBody: "404 not found"},
+		"enabled":  {caseInsensitive: true, expectedCode: 200, expectedBody: "/hello?name=World&page=Two"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.CaseInsensitive = tc.caseInsensitive
+			viewProxyServer.Get("/hello/:name", NewFragment("/hello"), []*Fragment{})
+
+			r := httptest.NewRequest("GET", "/Hello/World?page=Two", nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.expectedCode, resp.StatusCode)
+			assert.Equal(t, tc.expectedBody, string(body))
+		})
+	}
+}
+
+func TestFragmentReceivesBody(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]string)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mu.Lock()
+		requests[r.URL.Path] = r.Method + " " + r.Header.Get("Content-Type") + " " + string(body)
+		mu.Unlock()
+
+		if r.URL.Path == "/layout" {
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		} else {
+			w.Write([]byte(r.URL.Path))
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.HmacSecret = "secret"
+	viewProxyServer.Post("/signup", NewFragment("/layout"), []*Fragment{
+		NewFragment("/header"),
+		{Path: "/signup_form", ReceivesBody: true},
+	})
+
+	r := httptest.NewRequest("POST", "/signup", strings.NewReader("name=Blake+Williams&email=blake%40example.com"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	viewProxyServer.ServeHTTP(w, r)
+
+	resp := w.Result()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "<body>/header/signup_form</body>", string(body))
+	assert.Equal(t, "POST application/x-www-form-urlencoded name=Blake+Williams&email=blake%40example.com", requests["/signup_form"])
+	assert.Equal(t, "GET application/x-www-form-urlencoded ", requests["/header"])
+	assert.Equal(t, "GET application/x-www-form-urlencoded ", requests["/layout"])
+}
+
+func TestTransformResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layout" {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><head>\n  <title>{{{VIEW_PROXY_PAGE_TITLE}}}</title>\n</head><body>{{{VIEW_PROXY_CONTENT}}}</body></html>"))
+		} else {
+			w.Write([]byte(`<img src="logo.png">`))
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.MinifyHTML = true
+	viewProxyServer.CompressResponses = true
+	viewProxyServer.CompressionMinSize = 0
+	viewProxyServer.TransformResponse = func(body []byte, r *http.Request) []byte {
+		return bytes.Replace(body, []byte("<head>"), []byte("<head>\n  <base href=\"https://assets.example.com"+r.URL.Path+"/\">"), 1)
+	}
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/logo")})
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	viewProxyServer.ServeHTTP(w, r)
+
+	resp := w.Result()
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	gzipReader, err := gzip.NewReader(resp.Body)
+	assert.Nil(t, err)
+	body, err := ioutil.ReadAll(gzipReader)
+	assert.Nil(t, err)
+
+	assert.Equal(t, `<html><head> <base href="https://assets.example.com/hello/world/"> <title>viewproxy</title> </head><body><img src="logo.png"></body></html>`, string(body))
+}
+
+func TestOnErrorCanRelayUpstreamErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("<p>widget not found</p>"))
+			return
+		}
+
+		w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.OnError = func(w http.ResponseWriter, r *http.Request, err error) {
+		var resultErr *ResultError
+		if errors.As(err, &resultErr) && resultErr.StatusCode() == http.StatusNotFound {
+			w.WriteHeader(resultErr.StatusCode())
+			w.Write(resultErr.Body())
+			return
+		}
+
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	viewProxyServer.Get("/widgets/:id", NewFragment("/layout"), []*Fragment{NewFragment("/missing")})
+
+	r := httptest.NewRequest("GET", "/widgets/1", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "<p>widget not found</p>", w.Body.String())
+}
+
+func TestAllowedHostsBlocksOtherHosts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+	}))
+	defer server.Close()
+
+	serverUrl, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+
+	var fetchErr error
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.AllowedHosts = []string{serverUrl.Host}
+	viewProxyServer.OnError = func(w http.ResponseWriter, r *http.Request, err error) {
+		fetchErr = err
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	viewProxyServer.BeforeFragment = func(req *http.Request, fragment *Fragment, parameters map[string]string) {
+		if fragment.Path == "/metadata" {
+			req.URL.Host = "169.254.169.254"
+		}
+	}
+	viewProxyServer.Get("/allowed/:name", NewFragment("/layout"), []*Fragment{NewFragment("/fragment")})
+	viewProxyServer.Get("/blocked/:name", NewFragment("/layout"), []*Fragment{NewFragment("/metadata")})
+
+	w := httptest.NewRecorder()
+	viewProxyServer.ServeHTTP(w, httptest.NewRequest("GET", "/allowed/world", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	viewProxyServer.ServeHTTP(w, httptest.NewRequest("GET", "/blocked/world", nil))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.True(t, errors.Is(fetchErr, multiplexer.ErrHostNotAllowed))
+}
+
+func TestCustomDelimiters(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layout" {
+			w.Write([]byte("<title><!--VIEW_PROXY_PAGE_TITLE--></title><aside><!--VIEW_PROXY_CONTENT:sidebar--></aside><main><!--VIEW_PROXY_CONTENT--></main>{{{VIEW_PROXY_CONTENT}}}"))
+		} else {
+			w.Header().Set("X-View-Proxy-Title", "Hello")
+			w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.LeftDelimiter = "<!--"
+	viewProxyServer.RightDelimiter = "-->"
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{
+		NewFragmentWithMetadata("/sidebar", map[string]string{"slot": "sidebar"}),
+		NewFragment("/main"),
+	})
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.ServeHTTP(w, r)
+
+	body, err := ioutil.ReadAll(w.Result().Body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "<title>Hello</title><aside>sidebar</aside><main>main</main>{{{VIEW_PROXY_CONTENT}}}", string(body))
+}
+
+func TestMissingContentPlaceholderWarns(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layout" {
+			w.Write([]byte("<html></html>"))
+		} else {
+			w.Write([]byte("hello"))
+		}
+	}))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(&logs, "", 0))
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/fragment")})
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.ServeHTTP(w, r)
+
+	assert.Contains(t, logs.String(), "Layout has no {{{VIEW_PROXY_CONTENT}}} placeholder, dropping fragment content")
+}
+
+func TestMissingContentPlaceholderPolicies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layout" {
+			w.Write([]byte("<html></html>"))
+		} else {
+			w.Write([]byte("hello"))
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		policy       MissingPlaceholderPolicy
+		expectedCode int
+		expectedBody string
+		expectedLog  string
+	}{
+		"warn":   {policy: MissingPlaceholderWarn, expectedCode: 200, expectedBody: "<html></html>", expectedLog: "dropping fragment content"},
+		"error":  {policy: MissingPlaceholderError, expectedCode: 502, expectedBody: "502 bad gateway", expectedLog: "layout has no {{{VIEW_PROXY_CONTENT}}} placeholder for fragment content"},
+		"append": {policy: MissingPlaceholderAppend, expectedCode: 200, expectedBody: "<html></html>hello", expectedLog: "appending fragment content"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var logs bytes.Buffer
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(&logs, "", 0))
+			viewProxyServer.MissingContentPlaceholder = tc.policy
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/fragment")})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.expectedCode, w.Code)
+			assert.Equal(t, tc.expectedBody, w.Body.String())
+			assert.Contains(t, logs.String(), tc.expectedLog)
+		})
+	}
+}
+
+func TestTitleWithoutPlaceholder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layout" {
+			w.Write([]byte("<html><head><title>Old title</title></head><body>{{{VIEW_PROXY_CONTENT}}}</body></html>"))
+		} else {
+			w.Header().Set("X-View-Proxy-Title", "New title")
+			w.Write([]byte("hello"))
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		rewriteTitleTag bool
+		expectedBody    string
+		expectedLog     string
+	}{
+		"rewrite title tag": {
+			rewriteTitleTag: true,
+			expectedBody:    "<html><head><title>New title</title></head><body>hello</body></html>",
+			expectedLog:     "",
+		},
+		"warn": {
+			rewriteTitleTag: false,
+			expectedBody:    "<html><head><title>Old title</title></head><body>hello</body></html>",
+			expectedLog:     `Layout has no {{{VIEW_PROXY_PAGE_TITLE}}} placeholder, dropping title "New title"`,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var logs bytes.Buffer
+
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(&logs, "", 0))
+			viewProxyServer.RewriteTitleTag = tc.rewriteTitleTag
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/fragment")})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			body, err := ioutil.ReadAll(w.Result().Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.expectedBody, string(body))
+			if tc.expectedLog == "" {
+				assert.NotContains(t, logs.String(), "placeholder")
+			} else {
+				assert.Contains(t, logs.String(), tc.expectedLog)
+			}
+		})
+	}
+}
+
+func TestTitlePriority(t *testing.T) {
+	transport := multiplexertest.NewTransport()
+	transport.Add("http://views.internal/layout", multiplexertest.Response{Body: "<title>{{{VIEW_PROXY_PAGE_TITLE}}}</title>{{{VIEW_PROXY_CONTENT}}}"})
+	transport.Add("http://views.internal/untitled", multiplexertest.Response{})
+	for _, title := range []string{"main", "header", "footer"} {
+		transport.Add("http://views.internal/"+title, multiplexertest.Response{Header: http.Header{"X-View-Proxy-Title": []string{title}}})
+	}
+
+	tests := map[string]struct {
+		fragments     []*Fragment
+		expectedTitle string
+	}{
+		"default": {
+			fragments:     []*Fragment{NewFragment("/untitled")},
+			expectedTitle: "viewproxy",
+		},
+		"last wins without priorities": {
+			fragments:     []*Fragment{NewFragment("/main"), NewFragment("/footer")},
+			expectedTitle: "footer",
+		},
+		"highest priority wins": {
+			fragments: []*Fragment{
+				NewFragmentWithMetadata("/main", map[string]string{"title_priority": "10"}),
+				NewFragment("/footer"),
+			},
+			expectedTitle: "main",
+		},
+		"negative priority": {
+			fragments: []*Fragment{
+				NewFragment("/main"),
+				NewFragmentWithMetadata("/footer", map[string]string{"title_priority": "-1"}),
+			},
+			expectedTitle: "main",
+		},
+		"empty title is skipped": {
+			fragments: []*Fragment{
+				NewFragment("/main"),
+				NewFragmentWithMetadata("/untitled", map[string]string{"title_priority": "10"}),
+			},
+			expectedTitle: "main",
+		},
+		"equal priorities use render order": {
+			fragments: []*Fragment{
+				NewFragmentWithMetadata("/main", map[string]string{"title_priority": "5", "order": "1"}),
+				NewFragmentWithMetadata("/header", map[string]string{"title_priority": "5"}),
+			},
+			expectedTitle: "main",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer("http://views.internal")
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.HttpTransport = transport
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), tc.fragments)
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			assert.Equal(t, "<title>"+tc.expectedTitle+"</title>", w.Body.String())
+		})
+	}
+}
+
+func TestEveryTitlePlaceholderIsReplaced(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layout" {
+			w.Write([]byte("<title>{{{VIEW_PROXY_PAGE_TITLE}}}</title><h1>{{{VIEW_PROXY_PAGE_TITLE}}}</h1>{{{VIEW_PROXY_CONTENT}}}"))
+		} else {
+			w.Header().Set("X-View-Proxy-Title", "Hello")
+			w.Write([]byte("<code>{{{VIEW_PROXY_PAGE_TITLE}}}</code>"))
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/fragment")})
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.ServeHTTP(w, r)
+
+	assert.Equal(t, "<title>Hello</title><h1>Hello</h1><code>{{{VIEW_PROXY_PAGE_TITLE}}}</code>", w.Body.String())
+}
+
+func TestShutdownCancelsRequestsAfterDrainTimeout(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Port = 9997
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.DrainTimeout = 100 * time.Millisecond
+	viewProxyServer.Get("/hello/:name", NewFragment("/slow"), []*Fragment{})
+
+	go func() {
+		if err := viewProxyServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+	waitForServer(t, "localhost:9997")
+
+	go http.Get("http://localhost:9997/hello/world")
+	<-started
+
+	start := time.Now()
+	err := viewProxyServer.Shutdown(context.Background())
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Expected fragment request to be cancelled after the drain timeout")
+	}
+}
+
+func TestShutdownWaitsForRequestsWithinDrainTimeout(t *testing.T) {
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Port = 9996
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.DrainTimeout = time.Second
+	viewProxyServer.Get("/hello/:name", NewFragment("/slow"), []*Fragment{})
+
+	go func() {
+		if err := viewProxyServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+	waitForServer(t, "localhost:9996")
+
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response)
+	go func() {
+		resp, err := http.Get("http://localhost:9996/hello/world")
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		responses <- response{body: string(body), err: err}
+	}()
+
+	<-started
+	err := viewProxyServer.Shutdown(context.Background())
+	assert.Nil(t, err)
+
+	resp := <-responses
+	assert.Nil(t, resp.err)
+	assert.Equal(t, "hello", resp.body)
+}
+
+func TestListenAndServeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "viewproxy-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	caCert, caKey := generateCertificate(t, nil, nil)
+	certificate, key := generateCertificate(t, caCert, caKey)
+	certFile := writePem(t, dir, "server.pem", "CERTIFICATE", certificate.Raw)
+	keyFile := writePem(t, dir, "server-key.pem", "EC PRIVATE KEY", marshalKey(t, key))
+
+	viewProxyServer := NewServer(targetServer.URL)
+	viewProxyServer.Port = 9995
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	viewProxyServer.Get("/hello/:name", NewFragment("/layouts/test_layout"), []*Fragment{
+		NewFragment("header"),
+		NewFragment("body"),
+		NewFragment("footer"),
+	})
+	viewProxyServer.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Middleware", "true")
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	go func() {
+		if err := viewProxyServer.ListenAndServeTLS(certFile, keyFile); err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+	defer viewProxyServer.Close()
+	waitForServer(t, "localhost:9995")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool},
+			ForceAttemptHTTP2: true,
+		},
+	}
+
+	resp, err := client.Get("https://127.0.0.1:9995/hello/world")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, resp.ProtoMajor, "Expected HTTP/2 to be negotiated")
+	assert.Equal(t, "true", resp.Header.Get("X-Middleware"))
+	assert.Equal(t, "<html><body>hello world</body></html>", string(body))
+}
+
+func waitForServer(t *testing.T, address string) {
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.FailNow(t, fmt.Sprintf("Expected server at %s to start", address))
+}
+
+func startTargetServer() *httptest.Server {
+	instance := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+
+		w.Header().Set("EtAg", "1234")
+		w.Header().Set("X-Name", "viewproxy")
+
+		if r.URL.Path == "/layouts/test_layout" {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("<html>{{{VIEW_PROXY_CONTENT}}}</html>"))
+		} else if r.URL.Path == "/header" {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("<body>"))
+		} else if r.URL.Path == "/body" {
+			w.WriteHeader(http.StatusOK)
+			if params.Get("important") != "" {
+				w.Write([]byte(fmt.Sprintf("hello %s!", params.Get("name"))))
+			} else {
+				w.Write([]byte(fmt.Sprintf("hello %s", params.Get("name"))))
+			}
+		} else if r.URL.Path == "/footer" {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("</body>"))
+		} else if r.URL.Path == "/oops" {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Something went wrong"))
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("target: 404 not found"))
+		}
+	})
+
+	testServer := httptest.NewServer(instance)
+	return testServer
+}
+
+func TestHandlerCanBeMountedInAnotherMux(t *testing.T) {
+	transport := multiplexertest.NewTransport()
+	transport.Add("http://views.internal/layout", multiplexertest.Response{
+		Header: http.Header{"Content-Length": []string{"24"}},
+		Body:   "{{{VIEW_PROXY_CONTENT}}}",
+	})
+	transport.Add("http://views.internal/header", multiplexertest.Response{Body: "<header>"})
+
+	viewProxyServer := NewServer("http://views.internal")
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.HttpTransport = transport
+	viewProxyServer.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Middleware", "true")
+			next.ServeHTTP(w, r)
+		})
+	})
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/header")})
+
+	mux := http.NewServeMux()
+	mux.Handle("/app/", http.StripPrefix("/app", viewProxyServer.Handler()))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("outer"))
+	})
+
+	r := httptest.NewRequest("GET", "/app/hello/world", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "<header>", w.Body.String())
+	assert.Equal(t, "true", w.Header().Get("X-Middleware"))
+	assert.Equal(t, "8", w.Header().Get("Content-Length"))
+
+	r = httptest.NewRequest("GET", "/hello/world", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	assert.Equal(t, "outer", w.Body.String())
+}
+
+func TestFragmentHeaders(t *testing.T) {
+	transport := multiplexertest.NewTransport()
+	transport.Add("http://views.internal/layout", multiplexertest.Response{Body: "{{{VIEW_PROXY_CONTENT}}}"})
+	transport.Add("http://views.internal/header", multiplexertest.Response{})
+	transport.Add("http://views.internal/footer", multiplexertest.Response{})
+
+	viewProxyServer := NewServer("http://views.internal")
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.HttpTransport = transport
+	err := viewProxyServer.LoadRoutesFromJSON(`[{
+		"url": "/hello/:name",
+		"layout": {"path": "/layout"},
+		"fragments": [
+			{"path": "/header", "headers": {"X-Fragment-Name": ["header"]}},
+			{"path": "/footer"}
+		]
+	}]`)
+	assert.Nil(t, err)
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	requests := make(map[string]*http.Request)
+	for _, req := range transport.Requests() {
+		requests[req.URL.Path] = req
+	}
+
+	assert.Equal(t, "header", requests["/header"].Header.Get("X-Fragment-Name"))
+	assert.Empty(t, requests["/layout"].Header.Get("X-Fragment-Name"))
+	assert.Empty(t, requests["/footer"].Header.Get("X-Fragment-Name"))
+}
+
+func TestErrorStatusClassification(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		case "/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	refusedTarget := "http://" + listener.Addr().String()
+	listener.Close()
+
+	tests := map[string]struct {
+		target       string
+		fragment     string
+		expectedCode int
+		expectedBody string
+	}{
+		"timeout":            {target: server.URL, fragment: "/slow", expectedCode: http.StatusGatewayTimeout, expectedBody: "504 gateway timeout"},
+		"connection refused": {target: refusedTarget, fragment: "/header", expectedCode: http.StatusBadGateway, expectedBody: "502 bad gateway"},
+		"client error":       {target: server.URL, fragment: "/forbidden", expectedCode: http.StatusForbidden, expectedBody: "403 forbidden"},
+		"server error":       {target: server.URL, fragment: "/unavailable", expectedCode: http.StatusServiceUnavailable, expectedBody: "503 service unavailable"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer(tc.target)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.ProxyTimeout = 20 * time.Millisecond
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment(tc.fragment)})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.expectedCode, w.Code)
+			assert.Equal(t, tc.expectedBody, w.Body.String())
+		})
+	}
+}
+
+func TestEncodedRouteParameters(t *testing.T) {
+	tests := map[string]struct {
+		path          string
+		expectedName  string
+		expectedQuery string
+		expectedPath  string
+	}{
+		"space":         {path: "/hello/%20world", expectedName: " world", expectedQuery: "name=+world", expectedPath: "/greetings/%20world"},
+		"unicode":       {path: "/hello/caf%C3%A9", expectedName: "café", expectedQuery: "name=caf%C3%A9", expectedPath: "/greetings/caf%C3%A9"},
+		"raw unicode":   {path: "/hello/café", expectedName: "café", expectedQuery: "name=caf%C3%A9", expectedPath: "/greetings/caf%C3%A9"},
+		"escaped slash": {path: "/hello/a%2Fb", expectedName: "a/b", expectedQuery: "name=a%2Fb", expectedPath: "/greetings/a%2Fb"},
+		"plus":          {path: "/hello/a+b", expectedName: "a+b", expectedQuery: "name=a%2Bb", expectedPath: "/greetings/a+b"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			transport := multiplexertest.NewTransport()
+			transport.Add("http://views.internal/layout", multiplexertest.Response{Body: "{{{VIEW_PROXY_CONTENT}}}"})
+			transport.Add("http://views.internal"+tc.expectedPath, multiplexertest.Response{Body: "hello"})
+
+			viewProxyServer := NewServer("http://views.internal")
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.HttpTransport = transport
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/greetings/:name")})
+
+			var params map[string]string
+			viewProxyServer.Use(func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					next.ServeHTTP(w, r)
+					params = ParamsFromContext(r.Context())
+				})
+			})
+
+			r := httptest.NewRequest("GET", tc.path, nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.Handler().ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "hello", w.Body.String())
+			assert.Equal(t, tc.expectedName, params["name"])
+
+			requests := make(map[string]*http.Request)
+			for _, req := range transport.Requests() {
+				requests[strings.Split(req.URL.EscapedPath(), "/")[1]] = req
+			}
+
+			if assert.Contains(t, requests, "layout") {
+				assert.Equal(t, tc.expectedQuery, requests["layout"].URL.RawQuery)
+			}
+			if assert.Contains(t, requests, "greetings") {
+				assert.Equal(t, tc.expectedPath, requests["greetings"].URL.EscapedPath())
+				assert.Equal(t, "/greetings/"+tc.expectedName, requests["greetings"].URL.Path)
+			}
+		})
+	}
 }
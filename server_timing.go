@@ -0,0 +1,56 @@
+package viewproxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+// SetServerTiming sets the Server-Timing header with an entry for the layout,
+// when hasLayout is true, each fragment with a result, and the total time
+// since start. results are the layout's result followed by one for each
+// fragment.
+func (rb *responseBuilder) SetServerTiming(hasLayout bool, fragments []*Fragment, results []*multiplexer.Result, start time.Time) {
+	entries := make([]string, 0, len(results)+1)
+	if hasLayout && len(results) > 0 {
+		entries = append(entries, serverTimingEntry("layout", results[0].Duration))
+	}
+
+	for i, result := range results[1:] {
+		if i >= len(fragments) || result.Err != nil {
+			continue
+		}
+
+		entries = append(entries, serverTimingEntry(fragments[i].Name(), result.Duration))
+	}
+
+	entries = append(entries, serverTimingEntry("total", time.Since(start)))
+
+	rb.writer.Header().Set("Server-Timing", strings.Join(entries, ", "))
+}
+
+// serverTimingEntry returns a Server-Timing metric for name with duration in
+// milliseconds. Characters that aren't allowed in a metric name, like the `/`
+// in `widgets/header`, are replaced with `_`.
+func serverTimingEntry(name string, duration time.Duration) string {
+	metric := strings.Map(func(r rune) rune {
+		if isTokenChar(r) {
+			return r
+		}
+
+		return '_'
+	}, name)
+
+	return fmt.Sprintf("%s;dur=%.1f", metric, float64(duration.Microseconds())/1000)
+}
+
+// isTokenChar returns true when r can be used in an HTTP token.
+func isTokenChar(r rune) bool {
+	if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+		return true
+	}
+
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
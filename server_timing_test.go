@@ -0,0 +1,78 @@
+package viewproxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer/multiplexertest"
+	"github.com/stretchr/testify/assert"
+)
+
+// serverTimingPattern matches a Server-Timing header of metrics with a
+// duration, per https://www.w3.org/TR/server-timing/#the-server-timing-header-field.
+var serverTimingPattern = regexp.MustCompile("^[!#$%&'*+\\-.^_`|~0-9A-Za-z]+;dur=[0-9]+(\\.[0-9]+)?(, [!#$%&'*+\\-.^_`|~0-9A-Za-z]+;dur=[0-9]+(\\.[0-9]+)?)*$")
+
+func TestServerTiming(t *testing.T) {
+	transport := multiplexertest.NewTransport()
+	transport.Add("http://views.internal/layout", multiplexertest.Response{Body: "{{{VIEW_PROXY_CONTENT}}}", Latency: 10 * time.Millisecond})
+	transport.Add("http://views.internal/widgets/header", multiplexertest.Response{Body: "<header>", Latency: 20 * time.Millisecond})
+	transport.Add("http://views.internal/aside", multiplexertest.Response{Body: "<aside>"})
+
+	tests := map[string]struct {
+		emitServerTiming bool
+		expectedMetrics  []string
+	}{
+		"disabled": {emitServerTiming: false},
+		"enabled":  {emitServerTiming: true, expectedMetrics: []string{"layout", "widgets_header", "sidebar", "total"}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer("http://views.internal")
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.HttpTransport = transport
+			viewProxyServer.EmitServerTiming = tc.emitServerTiming
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{
+				NewFragment("/widgets/header"),
+				NewFragmentWithMetadata("/aside", map[string]string{"name": "sidebar"}),
+			})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			header := w.Header().Get("Server-Timing")
+			if !tc.emitServerTiming {
+				assert.Empty(t, header)
+				return
+			}
+
+			assert.Regexp(t, serverTimingPattern, header)
+
+			durations := make(map[string]float64)
+			var metrics []string
+			for _, entry := range strings.Split(header, ", ") {
+				parts := strings.SplitN(entry, ";dur=", 2)
+				duration, err := strconv.ParseFloat(parts[1], 64)
+				assert.Nil(t, err)
+
+				metrics = append(metrics, parts[0])
+				durations[parts[0]] = duration
+			}
+
+			assert.Equal(t, tc.expectedMetrics, metrics)
+			assert.GreaterOrEqual(t, durations["layout"], 10.0)
+			assert.GreaterOrEqual(t, durations["widgets_header"], 20.0)
+			assert.GreaterOrEqual(t, durations["total"], durations["widgets_header"])
+		})
+	}
+}
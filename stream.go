@@ -0,0 +1,89 @@
+package viewproxy
+
+import (
+	"context"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+// fragmentStream fetches a route's layout and fragments in the background,
+// making each result available as soon as it arrives so the response can be
+// streamed to the client in order.
+type fragmentStream struct {
+	arrivals []chan *multiplexer.Result
+	done     chan struct{}
+	results  []*multiplexer.Result
+	err      error
+}
+
+// startFragmentStream starts req, wrapping its AfterFetch and FetchFailed
+// hooks to record results as they arrive.
+func startFragmentStream(ctx context.Context, req *multiplexer.Request, fragments []*Fragment) *fragmentStream {
+	stream := &fragmentStream{
+		arrivals: make([]chan *multiplexer.Result, len(fragments)),
+		done:     make(chan struct{}),
+	}
+
+	for i := range stream.arrivals {
+		stream.arrivals[i] = make(chan *multiplexer.Result, 1)
+	}
+
+	afterFetch := req.AfterFetch
+	req.AfterFetch = func(i int, result *multiplexer.Result) {
+		if afterFetch != nil {
+			afterFetch(i, result)
+		}
+
+		for _, index := range req.FetchedWith(i) {
+			stream.arrivals[index] <- result
+		}
+	}
+
+	fetchFailed := req.FetchFailed
+	req.FetchFailed = func(i int, err error) {
+		if fetchFailed != nil {
+			fetchFailed(i, err)
+		}
+
+		for _, index := range req.FetchedWith(i) {
+			if index > 0 && fragments[index].Optional {
+				stream.arrivals[index] <- &multiplexer.Result{Url: fragments[index].Url, Err: err}
+			}
+		}
+	}
+
+	go func() {
+		defer close(stream.done)
+		stream.results, stream.err = req.Do(ctx)
+	}()
+
+	return stream
+}
+
+// next waits for the result at index i, returning nil when the request fails
+// before it arrives. Partial results returned on timeout are used for
+// fragments that didn't arrive.
+func (fs *fragmentStream) next(i int) *multiplexer.Result {
+	select {
+	case result := <-fs.arrivals[i]:
+		return result
+	case <-fs.done:
+		select {
+		case result := <-fs.arrivals[i]:
+			return result
+		default:
+			if fs.err == nil && i < len(fs.results) {
+				return fs.results[i]
+			}
+
+			return nil
+		}
+	}
+}
+
+// wait waits for every result, returning them in order.
+func (fs *fragmentStream) wait() ([]*multiplexer.Result, error) {
+	<-fs.done
+
+	return fs.results, fs.err
+}
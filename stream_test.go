@@ -0,0 +1,243 @@
+package viewproxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamResponsesFlushesLayoutBeforeFragments(t *testing.T) {
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Write([]byte("<head></head>\n{{{VIEW_PROXY_CONTENT}}}</html>"))
+		case "/header":
+			w.Write([]byte("<header></header>"))
+		case "/slow":
+			<-release
+			w.Write([]byte("<main></main>"))
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.StreamResponses = true
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/header"), NewFragment("/slow")})
+
+	proxy := httptest.NewServer(viewProxyServer)
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL + "/hello/world")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	head := make(chan string)
+	reader := bufio.NewReader(resp.Body)
+	go func() {
+		line, _ := reader.ReadString('\n')
+		head <- line
+	}()
+
+	select {
+	case line := <-head:
+		assert.Equal(t, "<head></head>\n", line)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the layout head to be flushed before the slow fragment completed")
+	}
+
+	close(release)
+	rest, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "<header></header><main></main></html>", string(rest))
+	assert.Equal(t, int64(-1), resp.ContentLength)
+}
+
+func TestStreamResponsesFallsBackToBuffering(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		case "/titled_layout":
+			w.Write([]byte("<title>{{{VIEW_PROXY_PAGE_TITLE}}}</title><body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		case "/fragment":
+			w.Write([]byte("hello"))
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		layout            string
+		fragment          string
+		compressResponses bool
+		expectedCode      int
+		expectedBody      string
+		expectedStreamed  bool
+	}{
+		"streamed":          {layout: "/layout", fragment: "/fragment", expectedCode: 200, expectedBody: "<body>hello</body>", expectedStreamed: true},
+		"title":             {layout: "/titled_layout", fragment: "/fragment", expectedCode: 200, expectedBody: "<title>viewproxy</title><body>hello</body>"},
+		"compression":       {layout: "/layout", fragment: "/fragment", compressResponses: true, expectedCode: 200, expectedBody: "<body>hello</body>"},
+		"missing layout":    {layout: "/missing", fragment: "/fragment", expectedCode: 404, expectedBody: "404 not found"},
+		"layout then error": {layout: "/titled_layout", fragment: "/broken", expectedCode: 500, expectedBody: "500 internal server error"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.StreamResponses = true
+			viewProxyServer.CompressResponses = tc.compressResponses
+			viewProxyServer.Get("/hello/:name", NewFragment(tc.layout), []*Fragment{NewFragment(tc.fragment)})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			w := httptest.NewRecorder()
+
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.expectedCode, resp.StatusCode)
+			assert.Equal(t, tc.expectedBody, string(body))
+			assert.Equal(t, tc.expectedStreamed, w.Flushed)
+		})
+	}
+}
+
+func TestStreamResponsesAbortsWhenAFragmentFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layout" {
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		} else {
+			time.Sleep(50 * time.Millisecond)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.StreamResponses = true
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/broken")})
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		viewProxyServer.ServeHTTP(w, r)
+	})
+	assert.Equal(t, "<body>", w.Body.String())
+}
+
+func TestStreamResponsesReplaceFragmentNonces(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Write([]byte(`<body>{{{VIEW_PROXY_CONTENT}}}</body>`))
+		case "/header":
+			w.Write([]byte(`<script nonce="{{{VIEW_PROXY_NONCE}}}"></script>`))
+		case "/footer":
+			w.Write([]byte(`<footer></footer>`))
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		contentSecurityPolicy string
+		expectedPolicy        string
+	}{
+		"with policy":    {contentSecurityPolicy: "script-src 'nonce-{{{VIEW_PROXY_NONCE}}}'", expectedPolicy: "script-src 'nonce-abc123'"},
+		"without policy": {contentSecurityPolicy: "", expectedPolicy: ""},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.StreamResponses = true
+			viewProxyServer.ContentSecurityPolicy = tc.contentSecurityPolicy
+			viewProxyServer.GenerateNonce = func() (string, error) { return "abc123", nil }
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/header"), NewFragment("/footer")})
+
+			proxy := httptest.NewServer(viewProxyServer)
+			defer proxy.Close()
+
+			resp, err := http.Get(proxy.URL + "/hello/world")
+			assert.Nil(t, err)
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, int64(-1), resp.ContentLength, "Expected the response to be streamed")
+			assert.Equal(t, tc.expectedPolicy, resp.Header.Get("Content-Security-Policy"))
+			assert.Equal(t, `<body><script nonce="abc123"></script><footer></footer></body>`, string(body))
+		})
+	}
+}
+
+func TestStreamResponsesFlushesDuplicateFragments(t *testing.T) {
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Write([]byte("<body>{{{VIEW_PROXY_CONTENT}}}</body>"))
+		case "/divider":
+			w.Write([]byte("<hr>"))
+		case "/slow":
+			<-release
+			w.Write([]byte("<main></main>"))
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := NewServer(server.URL)
+	viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+	viewProxyServer.StreamResponses = true
+	viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/divider"), NewFragment("/divider"), NewFragment("/slow")})
+
+	proxy := httptest.NewServer(viewProxyServer)
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL + "/hello/world")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	flushed := make(chan string)
+	go func() {
+		buf := make([]byte, len("<body><hr><hr>"))
+		_, err := io.ReadFull(resp.Body, buf)
+		assert.Nil(t, err)
+		flushed <- string(buf)
+	}()
+
+	select {
+	case body := <-flushed:
+		assert.Equal(t, "<body><hr><hr>", body)
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("Expected both dividers to be flushed before the slow fragment completed")
+	}
+
+	close(release)
+	rest, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "<main></main></body>", string(rest))
+}
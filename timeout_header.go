@@ -0,0 +1,33 @@
+package viewproxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// requestTimeout returns the timeout for fetching r's layout and fragments:
+// maxTimeout, or the client's budget in TimeoutHeader when it's smaller.
+// Budgets that aren't a positive number of milliseconds are ignored.
+func (s *Server) requestTimeout(r *http.Request, maxTimeout time.Duration) time.Duration {
+	if s.TimeoutHeader == "" {
+		return maxTimeout
+	}
+
+	value := r.Header.Get(s.TimeoutHeader)
+	if value == "" {
+		return maxTimeout
+	}
+
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms <= 0 {
+		s.Logger.Debugf("Ignoring invalid %s %q", s.TimeoutHeader, value)
+		return maxTimeout
+	}
+
+	if budget := time.Duration(ms) * time.Millisecond; budget < maxTimeout {
+		return budget
+	}
+
+	return maxTimeout
+}
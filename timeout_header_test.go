@@ -0,0 +1,58 @@
+package viewproxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeoutHeader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Write([]byte("{{{VIEW_PROXY_CONTENT}}}"))
+		case "/slow":
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte(r.Header.Get("X-Timeout-Ms")))
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		timeoutHeader string
+		budget        string
+		expectedCode  int
+		expectedBody  string
+	}{
+		"smaller budget":  {timeoutHeader: "X-Timeout-Ms", budget: "10", expectedCode: http.StatusGatewayTimeout, expectedBody: "504 gateway timeout"},
+		"larger budget":   {timeoutHeader: "X-Timeout-Ms", budget: "60000", expectedCode: http.StatusOK, expectedBody: "1000"},
+		"invalid budget":  {timeoutHeader: "X-Timeout-Ms", budget: "soon", expectedCode: http.StatusOK, expectedBody: "1000"},
+		"no budget":       {timeoutHeader: "X-Timeout-Ms", expectedCode: http.StatusOK, expectedBody: "1000"},
+		"header disabled": {budget: "10", expectedCode: http.StatusOK, expectedBody: "10"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.ProxyTimeout = time.Second
+			viewProxyServer.TimeoutHeader = tc.timeoutHeader
+			viewProxyServer.Get("/hello/:name", NewFragment("/layout"), []*Fragment{NewFragment("/slow")})
+
+			r := httptest.NewRequest("GET", "/hello/world", nil)
+			if tc.budget != "" {
+				r.Header.Set("X-Timeout-Ms", tc.budget)
+			}
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.expectedCode, w.Code)
+			assert.Equal(t, tc.expectedBody, w.Body.String())
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package viewproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// TrailingSlashPolicy determines how a request path that only differs from a
+// route by a trailing slash, like `/hello/world/` for `/hello/world`, is
+// handled.
+type TrailingSlashPolicy int
+
+const (
+	// Only match routes whose path is the same as the request's, responding
+	// with a 404 otherwise.
+	TrailingSlashStrict TrailingSlashPolicy = iota
+	// Redirect to the route's path, with a 301 for GET and HEAD requests and a
+	// 308 for others so their method and body are kept.
+	TrailingSlashRedirect
+	// Serve the route as if the request used its path.
+	TrailingSlashIgnore
+)
+
+// toggleTrailingSlash removes the trailing slash from path, or adds one when
+// it doesn't have one.
+func toggleTrailingSlash(path string) string {
+	if strings.HasSuffix(path, "/") {
+		return strings.TrimSuffix(path, "/")
+	}
+
+	return path + "/"
+}
+
+// redirectToPath redirects r to path under PathPrefix, keeping its query.
+func (s *Server) redirectToPath(w http.ResponseWriter, r *http.Request, path string) {
+	location := s.withPathPrefix(path)
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+
+	code := http.StatusPermanentRedirect
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		code = http.StatusMovedPermanently
+	}
+
+	s.Logger.Debugf("Redirecting %s to %s", r.URL.Path, location)
+	w.Header().Set("Location", location)
+	w.WriteHeader(code)
+}
@@ -0,0 +1,73 @@
+package viewproxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrailingSlashPolicies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		policy           TrailingSlashPolicy
+		method           string
+		url              string
+		expectedCode     int
+		expectedBody     string
+		expectedLocation string
+	}{
+		"strict param":               {policy: TrailingSlashStrict, url: "/hello/world/", expectedCode: 404, expectedBody: "404 not found"},
+		"strict static":              {policy: TrailingSlashStrict, url: "/about", expectedCode: 404, expectedBody: "404 not found"},
+		"strict exact":               {policy: TrailingSlashStrict, url: "/hello/world", expectedCode: 200, expectedBody: "/hello"},
+		"redirect param":             {policy: TrailingSlashRedirect, url: "/hello/world/?page=2", expectedCode: 301, expectedLocation: "/hello/world?page=2"},
+		"redirect static":            {policy: TrailingSlashRedirect, url: "/about", expectedCode: 301, expectedLocation: "/about/"},
+		"redirect post":              {policy: TrailingSlashRedirect, method: "POST", url: "/about", expectedCode: 308, expectedLocation: "/about/"},
+		"redirect exact":             {policy: TrailingSlashRedirect, url: "/about/", expectedCode: 200, expectedBody: "/about"},
+		"redirect unknown":           {policy: TrailingSlashRedirect, url: "/a/b/c/", expectedCode: 404, expectedBody: "404 not found"},
+		"redirect protocol relative": {policy: TrailingSlashRedirect, url: "//evil.com/", expectedCode: 200, expectedBody: "/catch_all"},
+		"ignore param":               {policy: TrailingSlashIgnore, url: "/hello/world/", expectedCode: 200, expectedBody: "/hello"},
+		"ignore static":              {policy: TrailingSlashIgnore, url: "/about", expectedCode: 200, expectedBody: "/about"},
+		"ignore method not allowed":  {policy: TrailingSlashIgnore, method: "DELETE", url: "/about", expectedCode: 405, expectedBody: "405 method not allowed"},
+		"ignore root":                {policy: TrailingSlashIgnore, url: "/", expectedCode: 200, expectedBody: "/root"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			viewProxyServer := NewServer(server.URL)
+			viewProxyServer.Logger = NewStdLogger(log.New(ioutil.Discard, "", log.Ldate|log.Ltime))
+			viewProxyServer.TrailingSlash = tc.policy
+			viewProxyServer.Get("/", NewFragment("/root"), []*Fragment{})
+			viewProxyServer.Get("/hello/:name", NewFragment("/hello"), []*Fragment{})
+			viewProxyServer.Get("/about/", NewFragment("/about"), []*Fragment{})
+			viewProxyServer.Post("/about/", NewFragment("/about"), []*Fragment{})
+			viewProxyServer.Get("/:first/:second", NewFragment("/catch_all"), []*Fragment{})
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			r := httptest.NewRequest(method, tc.url, nil)
+			w := httptest.NewRecorder()
+			viewProxyServer.ServeHTTP(w, r)
+
+			resp := w.Result()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, tc.expectedCode, resp.StatusCode)
+			assert.Equal(t, tc.expectedLocation, resp.Header.Get("Location"))
+			if tc.expectedBody != "" {
+				assert.Equal(t, tc.expectedBody, string(body))
+			}
+		})
+	}
+}